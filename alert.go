@@ -1,72 +1,195 @@
 package main
 
 import (
-	"encoding/xml"
+	"context"
 	"log"
-	"strings"
+	"math/rand"
+	"strconv"
 	"time"
 )
 
-type Zone struct {
-	Id     int64  `xml:"ID"`
-	Name   string `xml:"Name"`
-	Status string `xml:"Status"`
-}
-
-type Body struct {
-	XMLName xml.Name `xml:"Body"`
-	Zones   []Zone   `xml:"GetCPStateResponse>Rep>ECReply>Zones"`
+// ManageDectetorsAlert polls the panel every interval, plus a random jitter
+// of up to jitter, until ctx is done. A poll in progress when ctx is done is
+// completed with its own context, so the notifications it sends are not
+// lost, but is abandoned after timeout, so it neither delays a shutdown nor
+// alerts long after another instance took over. Status changes are reported
+// as debouncer allows.
+func ManageDectetorsAlert(ctx context.Context, storer Storer, panel AlarmPanel, requester Requester, escalation *Escalation, debouncer *Debouncer, interval, jitter, timeout time.Duration) {
+	var lastState *PanelState
+	var policies map[string]NotificationPolicy
+	unreachable := false
+	// another instance may have polled the panel since this one last did
+	escalation.Resume()
+	for {
+		pollCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		reply, err := panel.State(pollCtx)
+		if err == ErrPanelUnreachable {
+			// polling is paused by the circuit breaker, only report it once
+			if !unreachable {
+				log.Printf("Panel unreachable, polling is paused")
+				unreachable = true
+			}
+		} else if err != nil {
+			log.Printf("Got the following error trying to get the panel state: %s", err)
+		} else {
+			if unreachable {
+				log.Printf("Panel reachable again, polling resumed")
+				unreachable = false
+			}
+			escalation.Update(pollCtx, panelInAlarm(reply))
+			policies = readPolicies(storer, policies)
+			alertDetectors(pollCtx, storer, requester, debouncer, policies, reply.Partitions, reply.Zones)
+			lastState = storePanelState(storer, reply, lastState)
+			storeTransitions(storer, reply.Zones)
+		}
+		cancel()
+		if !sleep(ctx, jittered(interval, jitter)) {
+			log.Printf("Stopped polling the panel")
+			return
+		}
+	}
 }
 
-type RespEnvelope struct {
-	XMLName xml.Name `xml:"Envelope"`
-	Body    Body     `xml:"Body"`
+// jittered returns interval plus a random duration of up to jitter, so
+// polls of several instances do not line up.
+func jittered(interval, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(int64(jitter)))
 }
 
-func parseDetectors(detectorsXML string) ([]Zone, error) {
+// sleep waits for d, or until ctx is done. It tells whether the whole
+// duration passed.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 
-	var envelope RespEnvelope
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
 
-	err := xml.Unmarshal([]byte(detectorsXML), &envelope)
+// readPolicies returns the stored notification policies, or last when they
+// cannot be read, so a failed read neither makes silent detectors notify
+// nor intrusions be reported as information.
+func readPolicies(storer Storer, last map[string]NotificationPolicy) map[string]NotificationPolicy {
+	policies, err := storer.GetPolicies()
 	if err != nil {
-		return nil, err
+		log.Printf("Could not read notification policies, keeping the last ones read: %v", err)
+		return last
 	}
 
-	return envelope.Body.Zones, nil
+	return policies
 }
 
-func ManageDectetorsAlert(storer Storer, requester Requester) {
+// storePanelState saves the state in reply when it differs from lastState
+// and returns the state that is stored.
+func storePanelState(storer Storer, reply *PanelReading, lastState *PanelState) *PanelState {
+	state := newPanelState(reply)
+	if sameState(state, lastState) {
+		return lastState
+	}
 
-	for {
-		detectorsXML := requester.RequestFeenstra("get-detectors")
+	state.UpdatedAt = time.Now()
+	if err := storer.PutPanelState(state); err != nil {
+		log.Printf("Got the following error trying to save the panel state: %s", err)
+		return lastState
+	}
 
-		detectorsList, err := parseDetectors(detectorsXML)
-		if err != nil {
-			log.Printf("Got the following error trying to parse the detectors XML: %s", err)
-			log.Printf("Detectors xml: \n%v", detectorsXML)
-		}
+	return state
+}
+
+// Statuses sent to Maker when a detector starts or stops reporting a
+// trouble condition such as tamper, low battery or supervision loss.
+const (
+	troubleStatus         = "Trouble"
+	troubleRestoredStatus = "TroubleRestored"
+)
 
-		for _, detector := range detectorsList {
-			detectorSafeName := strings.Replace(detector.Name, " ", "-", -1)
-			storedDetector, err := storer.GetDetector(detectorSafeName)
+// alertDetectors sends an alert for every detector whose status or trouble
+// condition changed. Status changes are notified as the policy of the
+// detector in policies sets for the armed state of its partitions, detectors
+// without a policy are informational. Changes are only
+// stored once alerted, so failed alerts are sent again on the next poll.
+// Status changes held back by debouncer are summarized once its summary
+// period ends.
+func alertDetectors(ctx context.Context, storer Storer, requester Requester, debouncer *Debouncer, policies map[string]NotificationPolicy, partitions []Partition, detectorsList []Zone) {
+	zones := make(map[string]Zone, len(detectorsList))
+	for _, detector := range detectorsList {
+		id := detectorID(detector.ID)
+		zones[id] = detector
+		storedDetector, err := storer.GetDetector(id)
+		if err != nil {
+			log.Printf("Could not read stored status for detector '%v': %v", id, err)
+			err = storer.PutDetector(id, detector.Name, detector.Status)
 			if err != nil {
-				log.Printf("Could not read stored status for detector '%v': %v", detectorSafeName, err)
-				err = storer.PutDetector(detectorSafeName, detector.Status)
-				if err != nil {
-					log.Printf("Got the following error trying to save detector: %s", err)
-				}
+				log.Printf("Got the following error trying to save detector: %s", err)
 				continue
 			}
+			// a new detector is only alerted when it is already in trouble
+			storedDetector = &Detector{ID: id, Name: detector.Name, Status: detector.Status}
+		}
 
-			if storedDetector.Status != detector.Status {
-				log.Printf("Alerting for detector: %s with current status: %s", detectorSafeName, detector.Status)
-				requester.RequestMakerDetector(detectorSafeName, detector.Status)
-				err = storer.PutDetector(detectorSafeName, detector.Status)
-				if err != nil {
+		if debouncer.Observe(id, storedDetector.Status, detector.Status) {
+			level := policies[id].Level(zoneArmedState(detector, partitions), detector.Status)
+			if err := notifyDetector(ctx, requester, level, newDetectorEvent(detector, detector.Status)); err != nil {
+				log.Printf("Got the following error trying to alert for detector: %s", err)
+			} else {
+				debouncer.Reported(id, detector.Status)
+				if err := storer.PutDetector(id, detector.Name, detector.Status); err != nil {
 					log.Printf("Got the following error trying to save detector: %s", err)
 				}
 			}
+		} else if storedDetector.Name != detector.Name {
+			// the zone was renamed on the panel
+			if err := storer.PutDetector(id, detector.Name, storedDetector.Status); err != nil {
+				log.Printf("Got the following error trying to save detector: %s", err)
+			}
+		}
+
+		if storedDetector.Trouble != detector.Trouble {
+			status := troubleRestoredStatus
+			if detector.Trouble {
+				status = troubleStatus
+			}
+			log.Printf("Alerting for detector: %s with trouble status: %s", id, status)
+			if err := requester.RequestMakerDetector(ctx, newDetectorEvent(detector, status)); err != nil {
+				log.Printf("Got the following error trying to alert for detector: %s", err)
+			} else if err := storer.PutDetectorTrouble(id, detector.Trouble); err != nil {
+				log.Printf("Got the following error trying to save detector trouble: %s", err)
+			}
+		}
+	}
+
+	for _, summary := range debouncer.Summaries() {
+		zone, ok := zones[summary.Detector]
+		if !ok {
+			continue
+		}
+		log.Printf("Alerting for detector: %s with %d activations in the last %v", summary.Detector, summary.Activations, summary.Period)
+		minutes := strconv.Itoa(int(summary.Period / time.Minute))
+		if err := requester.RequestMakerDetector(ctx, newDetectorEvent(zone, activationsStatus), strconv.Itoa(summary.Activations), minutes); err != nil {
+			log.Printf("Got the following error trying to alert for detector activations: %s", err)
 		}
-		time.Sleep(1 * time.Second)
 	}
 }
+
+// notifyDetector notifies a change of the status of a detector at the given
+// level.
+func notifyDetector(ctx context.Context, requester Requester, level string, detector DetectorEvent) error {
+	switch level {
+	case silentLevel:
+		log.Printf("Not alerting for detector: %s with current status: %s", detector.ID, detector.Status)
+		return nil
+	case intrusionLevel:
+		log.Printf("Alerting for intrusion on detector: %s with current status: %s", detector.ID, detector.Status)
+		return requester.RequestMakerValues(ctx, intrusionEvent, detector.Name, detector.Status)
+	}
+
+	log.Printf("Alerting for detector: %s with current status: %s", detector.ID, detector.Status)
+	return requester.RequestMakerDetector(ctx, detector)
+}
@@ -1,55 +1,496 @@
 package main
 
 import (
-	"github.com/stretchr/testify/assert"
-	"io/ioutil"
+	"context"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
-func TestParseNames(t *testing.T) {
-	t.Run("ReturnsListOfNamesIfXMLIsValid", func(t *testing.T) {
-		xmlFile, _ := ioutil.ReadFile("testdata/detectors.xml")
-		xml := string(xmlFile)
-		got, err := parseDetectors(xml)
+type fakeStorer struct {
+	detectors   map[string]*Detector
+	events      map[string]Event
+	cursor      *EventCursor
+	state       *PanelState
+	stateputs   int
+	audit       []AuditEntry
+	auditErr    error
+	policies    map[string]NotificationPolicy
+	policiesErr error
+	history     []DetectorTransition
+
+	// leases are shared by the electors of a test
+	leaseMu sync.Mutex
+	leases  map[string]Lease
+
+	// the alarm is shared by the escalations of a test
+	alarmMu      sync.Mutex
+	alarm        Alarm
+	alarmErr     error
+	alarmUpdates int
+}
+
+func newFakeStorer() *fakeStorer {
+	return &fakeStorer{
+		detectors: make(map[string]*Detector),
+		events:    make(map[string]Event),
+		policies:  make(map[string]NotificationPolicy),
+		leases:    make(map[string]Lease),
+	}
+}
+
+func (f *fakeStorer) PutDetector(id, name, status string) error {
+	if d, ok := f.detectors[id]; ok {
+		d.Name = name
+		d.Status = status
+		return nil
+	}
+	f.detectors[id] = &Detector{ID: id, Name: name, Status: status}
+	return nil
+}
+
+func (f *fakeStorer) PutDetectorTrouble(id string, trouble bool) error {
+	if d, ok := f.detectors[id]; ok {
+		d.Trouble = trouble
+		return nil
+	}
+	f.detectors[id] = &Detector{ID: id, Trouble: trouble}
+	return nil
+}
+
+func (f *fakeStorer) GetDetector(id string) (*Detector, error) {
+	d, ok := f.detectors[id]
+	if !ok {
+		return nil, fmt.Errorf("detector %v not found", id)
+	}
+	detector := *d
+	return &detector, nil
+}
+
+func (f *fakeStorer) PutEvents(events []Event) error {
+	for _, event := range events {
+		f.events[eventID(event)] = event
+	}
+	return nil
+}
 
-		assert.Len(t, got, 7)
+func (f *fakeStorer) GetEventCursor() (*EventCursor, error) {
+	if f.cursor == nil {
+		return nil, nil
+	}
+	cursor := *f.cursor
+	return &cursor, nil
+}
 
-		assert.Equal(t, got[0].Id, int64(0))
-		assert.Equal(t, got[0].Name, "1 Voordeur")
-		assert.Equal(t, got[0].Status, "Off")
+func (f *fakeStorer) PutEventCursor(cursor *EventCursor) error {
+	stored := *cursor
+	f.cursor = &stored
+	return nil
+}
 
-		assert.Equal(t, got[1].Id, int64(1))
-		assert.Equal(t, got[1].Name, "2 Meterkast")
-		assert.Equal(t, got[1].Status, "Off")
+func (f *fakeStorer) PutPanelState(state *PanelState) error {
+	f.state = state
+	f.stateputs++
+	return nil
+}
 
-		assert.Equal(t, got[2].Id, int64(2))
-		assert.Equal(t, got[2].Name, "3 Hal Pir")
-		assert.Equal(t, got[2].Status, "Off")
+func (f *fakeStorer) GetPanelState() (*PanelState, error) {
+	if f.state == nil {
+		return nil, fmt.Errorf("panel state not found")
+	}
+	return f.state, nil
+}
 
-		assert.Equal(t, got[3].Id, int64(3))
-		assert.Equal(t, got[3].Name, "4 Hal Rook")
-		assert.Equal(t, got[3].Status, "Off")
+func (f *fakeStorer) PutAuditEntry(entry AuditEntry) error {
+	if f.auditErr != nil {
+		return f.auditErr
+	}
+	f.audit = append(f.audit, entry)
+	return nil
+}
 
-		assert.Equal(t, got[4].Id, int64(4))
-		assert.Equal(t, got[4].Name, "5 Woonkamer Pir")
-		assert.Equal(t, got[4].Status, "Off")
+func (f *fakeStorer) GetPolicies() (map[string]NotificationPolicy, error) {
+	if f.policiesErr != nil {
+		return nil, f.policiesErr
+	}
+	policies := make(map[string]NotificationPolicy, len(f.policies))
+	for detector, policy := range f.policies {
+		policies[detector] = policy
+	}
+	return policies, nil
+}
 
-		assert.Equal(t, got[5].Id, int64(5))
-		assert.Equal(t, got[5].Name, "6 Keukendeur")
-		assert.Equal(t, got[5].Status, "Off")
+func (f *fakeStorer) PutPolicy(policy NotificationPolicy) error {
+	f.policies[policy.Detector] = policy
+	return nil
+}
 
-		assert.Equal(t, got[6].Id, int64(6))
-		assert.Equal(t, got[6].Name, "7 Balkondeur")
-		assert.Equal(t, got[6].Status, "Off")
+func (f *fakeStorer) DeletePolicy(detector string) error {
+	delete(f.policies, detector)
+	return nil
+}
 
-		assert.Nil(t, err)
+func (f *fakeStorer) PutDetectorHistory(transitions []DetectorTransition) error {
+	f.history = append(f.history, transitions...)
+	for _, transition := range transitions {
+		d, ok := f.detectors[transition.Detector]
+		if !ok {
+			d = &Detector{ID: transition.Detector}
+			f.detectors[transition.Detector] = d
+		}
+		d.HistoryStatus = transition.Status
+		d.HistoryTrouble = transition.Trouble
+	}
+	return nil
+}
+
+func (f *fakeStorer) GetDetectorHistory(id string, from, to time.Time) ([]DetectorTransition, error) {
+	var transitions []DetectorTransition
+	for _, transition := range f.history {
+		if transition.Detector == id && !transition.Time.Before(from) && transition.Time.Before(to) {
+			transitions = append(transitions, transition)
+		}
+	}
+	return transitions, nil
+}
+
+func (f *fakeStorer) AcquireLease(name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	f.leaseMu.Lock()
+	defer f.leaseMu.Unlock()
+	lease, ok := f.leases[name]
+	if ok && lease.Holder != holder && now.Before(lease.ExpiresAt) {
+		return false, nil
+	}
+	if !ok || lease.Holder != holder {
+		lease = Lease{Holder: holder, AcquiredAt: now}
+	}
+	lease.ExpiresAt = now.Add(ttl)
+	f.leases[name] = lease
+	return true, nil
+}
+
+func (f *fakeStorer) ReleaseLease(name, holder string) error {
+	f.leaseMu.Lock()
+	defer f.leaseMu.Unlock()
+	if f.leases[name].Holder == holder {
+		delete(f.leases, name)
+	}
+	return nil
+}
+
+func (f *fakeStorer) GetLease(name string) (*Lease, error) {
+	f.leaseMu.Lock()
+	defer f.leaseMu.Unlock()
+	lease, ok := f.leases[name]
+	if !ok {
+		return nil, nil
+	}
+	return &lease, nil
+}
+
+func (f *fakeStorer) UpdateAlarm(update func(alarm *Alarm) bool) error {
+	f.alarmMu.Lock()
+	defer f.alarmMu.Unlock()
+	f.alarmUpdates++
+	if f.alarmErr != nil {
+		return f.alarmErr
+	}
+	alarm := f.alarm
+	if update(&alarm) {
+		f.alarm = alarm
+	}
+	return nil
+}
+
+type recordingRequester struct {
+	fakeRequester
+	alerts []string
+}
+
+func (r *recordingRequester) RequestMakerDetector(ctx context.Context, detector DetectorEvent, values ...string) error {
+	if r.makerErr != nil {
+		return r.makerErr
+	}
+	event := fmt.Sprintf("%v-%v", detector.Name, detector.Status)
+	if len(values) > 0 {
+		event += fmt.Sprint(values)
+	}
+	r.alerts = append(r.alerts, event)
+	return nil
+}
+
+func (r *recordingRequester) RequestMakerValues(ctx context.Context, event string, values ...string) error {
+	if r.makerErr != nil {
+		return r.makerErr
+	}
+	r.alerts = append(r.alerts, fmt.Sprintf("%v%v", event, values))
+	return nil
+}
+
+func TestAlertDetectors(t *testing.T) {
+	t.Run("StoresUnknownDetectorsWithoutAlerting", func(t *testing.T) {
+		storer := newFakeStorer()
+		requester := &recordingRequester{}
+
+		alertDetectors(ctx, storer, requester, nil, nil, nil, []Zone{
+			{ID: 0, Name: "1 Voordeur", Status: "Off"},
+			{ID: 6, Name: "7 Balkondeur", Status: "On"},
+		})
+
+		assert.Empty(t, requester.alerts)
+		assert.Equal(t, "Off", storer.detectors["zone-0"].Status)
+		assert.Equal(t, "On", storer.detectors["zone-6"].Status)
 	})
 
-	t.Run("ReturnsErrorIfXMLIsEmpty", func(t *testing.T) {
-		xml := ""
+	t.Run("AlertsOnlyWhenStatusChanges", func(t *testing.T) {
+		storer := newFakeStorer()
+		storer.PutDetector("zone-0", "1 Voordeur", "Off")
+		storer.PutDetector("zone-6", "7 Balkondeur", "Off")
+		requester := &recordingRequester{}
 
-		_, err := parseDetectors(xml)
+		alertDetectors(ctx, storer, requester, nil, nil, nil, []Zone{
+			{ID: 0, Name: "1 Voordeur", Status: "Off"},
+			{ID: 6, Name: "7 Balkondeur", Status: "On"},
+		})
 
-		assert.NotNil(t, err)
+		assert.Equal(t, []string{"7-Balkondeur-On"}, requester.alerts)
+		assert.Equal(t, "On", storer.detectors["zone-6"].Status)
 	})
+
+	t.Run("KeepsStatusWhenAlertFails", func(t *testing.T) {
+		storer := newFakeStorer()
+		storer.PutDetector("zone-6", "7 Balkondeur", "Off")
+		requester := &recordingRequester{}
+		requester.makerErr = fmt.Errorf("maker unreachable")
+
+		alertDetectors(ctx, storer, requester, nil, nil, nil, []Zone{
+			{ID: 6, Name: "7 Balkondeur", Status: "On"},
+		})
+		assert.Equal(t, "Off", storer.detectors["zone-6"].Status)
+
+		requester.makerErr = nil
+		alertDetectors(ctx, storer, requester, nil, nil, nil, []Zone{
+			{ID: 6, Name: "7 Balkondeur", Status: "On"},
+		})
+		assert.Equal(t, []string{"7-Balkondeur-On"}, requester.alerts)
+		assert.Equal(t, "On", storer.detectors["zone-6"].Status)
+	})
+
+	t.Run("KeepsDetectorWhenRenamed", func(t *testing.T) {
+		storer := newFakeStorer()
+		storer.PutDetector("zone-6", "7 Balkondeur", "Off")
+		requester := &recordingRequester{}
+
+		alertDetectors(ctx, storer, requester, nil, nil, nil, []Zone{
+			{ID: 6, Name: "7 Terrasdeur", Status: "Off"},
+		})
+		assert.Empty(t, requester.alerts)
+		assert.Equal(t, &Detector{ID: "zone-6", Name: "7 Terrasdeur", Status: "Off"}, storer.detectors["zone-6"])
+
+		alertDetectors(ctx, storer, requester, nil, nil, nil, []Zone{
+			{ID: 6, Name: "7 Terrasdeur", Status: "On"},
+		})
+		assert.Equal(t, []string{"7-Terrasdeur-On"}, requester.alerts)
+	})
+}
+
+func TestAlertDetectorsDebounced(t *testing.T) {
+	now := time.Date(2019, 8, 2, 0, 0, 0, 0, time.UTC)
+	debouncer := newTestDebouncer(&now)
+	storer := newFakeStorer()
+	storer.PutDetector("zone-2", "3 Hal Pir", "Off")
+	requester := &recordingRequester{}
+
+	// the PIR flaps every poll for five minutes
+	for i := 0; i <= 60; i++ {
+		status := "Off"
+		if i%2 == 1 {
+			status = "On"
+		}
+		alertDetectors(ctx, storer, requester, debouncer, nil, nil, []Zone{{ID: 2, Name: "3 Hal Pir", Status: status}})
+		now = now.Add(5 * time.Second)
+	}
+
+	assert.Equal(t, []string{"3-Hal-Pir-Activations[30 5]"}, requester.alerts)
+	assert.Equal(t, "Off", storer.detectors["zone-2"].Status)
+}
+
+func TestAlertDetectorsPolicies(t *testing.T) {
+	storer := newFakeStorer()
+	storer.PutDetector("zone-0", "1 Voordeur", "Off")
+	storer.PutDetector("zone-3", "4 Hal Rook", "Off")
+	policies := map[string]NotificationPolicy{
+		"zone-0": {Detector: "zone-0", Disarmed: silentLevel, PartArmed: infoLevel, Armed: intrusionLevel},
+	}
+	requester := &recordingRequester{}
+
+	for _, state := range []ArmedState{Disarm, PartialArm, AwayArm} {
+		partitions := []Partition{{ID: 0, ArmedState: state}}
+		for _, status := range []string{"On", "Off"} {
+			alertDetectors(ctx, storer, requester, nil, policies, partitions, []Zone{
+				{ID: 0, Name: "1 Voordeur", Status: status, Partitions: []int{0}},
+				{ID: 3, Name: "4 Hal Rook", Status: status, Partitions: []int{0}},
+			})
+		}
+	}
+
+	assert.Equal(t, []string{
+		"4-Hal-Rook-On", "4-Hal-Rook-Off",
+		"1-Voordeur-On", "4-Hal-Rook-On", "1-Voordeur-Off", "4-Hal-Rook-Off",
+		"Intrusion[1-Voordeur On]", "4-Hal-Rook-On", "1-Voordeur-Off", "4-Hal-Rook-Off",
+	}, requester.alerts)
+	assert.Equal(t, "Off", storer.detectors["zone-0"].Status)
+}
+
+func TestReadPolicies(t *testing.T) {
+	storer := newFakeStorer()
+	policy := NotificationPolicy{Detector: "zone-0", Disarmed: silentLevel}
+	storer.PutPolicy(policy)
+
+	policies := readPolicies(storer, nil)
+	assert.Equal(t, map[string]NotificationPolicy{"zone-0": policy}, policies)
+
+	storer.policiesErr = fmt.Errorf("firestore unreachable")
+	assert.Equal(t, policies, readPolicies(storer, policies), "the last policies read are kept")
+}
+
+func TestAlertDetectorsTrouble(t *testing.T) {
+	t.Run("AlertsNewDetectorInTrouble", func(t *testing.T) {
+		storer := newFakeStorer()
+		requester := &recordingRequester{}
+
+		alertDetectors(ctx, storer, requester, nil, nil, nil, []Zone{
+			{ID: 3, Name: "4 Hal Rook", Status: "Off", Trouble: true},
+		})
+
+		assert.Equal(t, []string{"4-Hal-Rook-Trouble"}, requester.alerts)
+		assert.Equal(t, &Detector{ID: "zone-3", Name: "4 Hal Rook", Status: "Off", Trouble: true}, storer.detectors["zone-3"])
+	})
+
+	t.Run("AlertsTroubleTransitions", func(t *testing.T) {
+		storer := newFakeStorer()
+		storer.PutDetector("zone-3", "4 Hal Rook", "Off")
+		requester := &recordingRequester{}
+
+		alertDetectors(ctx, storer, requester, nil, nil, nil, []Zone{
+			{ID: 3, Name: "4 Hal Rook", Status: "Off", Trouble: true},
+		})
+		alertDetectors(ctx, storer, requester, nil, nil, nil, []Zone{
+			{ID: 3, Name: "4 Hal Rook", Status: "Off", Trouble: true},
+		})
+		alertDetectors(ctx, storer, requester, nil, nil, nil, []Zone{
+			{ID: 3, Name: "4 Hal Rook", Status: "On", Trouble: false},
+		})
+
+		assert.Equal(t, []string{"4-Hal-Rook-Trouble", "4-Hal-Rook-On", "4-Hal-Rook-TroubleRestored"}, requester.alerts)
+		assert.Equal(t, &Detector{ID: "zone-3", Name: "4 Hal Rook", Status: "On", Trouble: false}, storer.detectors["zone-3"])
+	})
+}
+
+func TestStorePanelState(t *testing.T) {
+	storer := newFakeStorer()
+	reply := &PanelReading{
+		SystemStatus: "Disarmed",
+		Zones:        []Zone{{ID: 0, Name: "1 Voordeur", Status: "Off", Partitions: []int{0}}},
+		Partitions:   []Partition{{ID: 0, ArmedState: Disarm}},
+	}
+
+	last := storePanelState(storer, reply, nil)
+	assert.Equal(t, 1, storer.stateputs)
+	assert.Equal(t, "Disarmed", last.SystemStatus)
+	assert.False(t, last.UpdatedAt.IsZero())
+
+	last = storePanelState(storer, reply, last)
+	assert.Equal(t, 1, storer.stateputs, "unchanged state should not be stored again")
+
+	reply.Zones[0].Status = "On"
+	last = storePanelState(storer, reply, last)
+	assert.Equal(t, 2, storer.stateputs)
+	assert.Equal(t, "On", storer.state.Partitions[0].Zones[0].Status)
+}
+
+// blockingPanel returns its state once released.
+type blockingPanel struct {
+	fakePanel
+	reply   *PanelReading
+	polled  chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingPanel) State(ctx context.Context) (*PanelReading, error) {
+	p.polled <- struct{}{}
+	select {
+	case <-p.release:
+		return p.reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestManageDetectorsAlert(t *testing.T) {
+	t.Run("CompletesPollWhenStopped", func(t *testing.T) {
+		storer := newFakeStorer()
+		storer.PutDetector("zone-6", "7 Balkondeur", "Off")
+		requester := &recordingRequester{}
+		panel := &blockingPanel{
+			reply:   &PanelReading{Zones: []Zone{{ID: 6, Name: "7 Balkondeur", Status: "On"}}},
+			polled:  make(chan struct{}),
+			release: make(chan struct{}),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			ManageDectetorsAlert(ctx, storer, panel, requester, NewEscalation(requester, storer, time.Minute, 3), nil, time.Millisecond, 0, time.Minute)
+			close(done)
+		}()
+
+		<-panel.polled
+		cancel()
+		close(panel.release)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("polling did not stop")
+		}
+		assert.Equal(t, []string{"7-Balkondeur-On"}, requester.alerts)
+	})
+
+	t.Run("AbandonsPollAfterTimeout", func(t *testing.T) {
+		storer := newFakeStorer()
+		storer.PutDetector("zone-6", "7 Balkondeur", "Off")
+		requester := &recordingRequester{}
+		panel := &blockingPanel{
+			reply:   &PanelReading{Zones: []Zone{{ID: 6, Name: "7 Balkondeur", Status: "On"}}},
+			polled:  make(chan struct{}),
+			release: make(chan struct{}),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			ManageDectetorsAlert(ctx, storer, panel, requester, NewEscalation(requester, storer, time.Minute, 3), nil, time.Millisecond, 0, 10*time.Millisecond)
+			close(done)
+		}()
+
+		<-panel.polled
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("polling did not stop")
+		}
+		assert.Empty(t, requester.alerts)
+	})
+}
+
+func TestJittered(t *testing.T) {
+	assert.Equal(t, time.Second, jittered(time.Second, 0))
+	for i := 0; i < 100; i++ {
+		d := jittered(time.Second, 100*time.Millisecond)
+		assert.True(t, d >= time.Second && d < 1100*time.Millisecond, d)
+	}
 }
@@ -0,0 +1,192 @@
+package bstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"sync"
+	"time"
+
+	"github.com/go-session/session"
+	"github.com/tidwall/buntdb"
+)
+
+const keyPrefix = "session:"
+
+// NewManagerStore returns a session store keeping sessions in db until
+// they expire. Values are gob encoded, so their types other than the basic
+// ones must be registered with gob.Register. The provided database will
+// never be closed.
+func NewManagerStore(db *buntdb.DB) session.ManagerStore {
+	return &managerStore{db: db}
+}
+
+type managerStore struct {
+	db *buntdb.DB
+}
+
+func (m *managerStore) Check(ctx context.Context, sid string) (bool, error) {
+	err := m.db.View(func(tx *buntdb.Tx) error {
+		_, err := tx.Get(keyPrefix + sid)
+		return err
+	})
+	if err == buntdb.ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (m *managerStore) Create(ctx context.Context, sid string, expired int64) (session.Store, error) {
+	return newStore(ctx, m, sid, expired, nil), nil
+}
+
+func (m *managerStore) Update(ctx context.Context, sid string, expired int64) (session.Store, error) {
+	values, err := m.load(sid)
+	if err == buntdb.ErrNotFound {
+		return newStore(ctx, m, sid, expired, nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := m.save(sid, values, expired); err != nil {
+		return nil, err
+	}
+
+	return newStore(ctx, m, sid, expired, values), nil
+}
+
+func (m *managerStore) Delete(ctx context.Context, sid string) error {
+	err := m.db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(keyPrefix + sid)
+		return err
+	})
+	if err == buntdb.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+func (m *managerStore) Refresh(ctx context.Context, oldsid, sid string, expired int64) (session.Store, error) {
+	values, err := m.load(oldsid)
+	if err == buntdb.ErrNotFound {
+		return newStore(ctx, m, sid, expired, nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := m.save(sid, values, expired); err != nil {
+		return nil, err
+	}
+	if err := m.Delete(ctx, oldsid); err != nil {
+		return nil, err
+	}
+
+	return newStore(ctx, m, sid, expired, values), nil
+}
+
+func (m *managerStore) Close() error {
+	return nil
+}
+
+func (m *managerStore) load(sid string) (map[string]interface{}, error) {
+	var value string
+	err := m.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		value, err = tx.Get(keyPrefix + sid)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	if err := gob.NewDecoder(bytes.NewBufferString(value)).Decode(&values); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func (m *managerStore) save(sid string, values map[string]interface{}, expired int64) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return err
+	}
+
+	return m.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(keyPrefix+sid, buf.String(), &buntdb.SetOptions{Expires: true, TTL: time.Duration(expired) * time.Second})
+		return err
+	})
+}
+
+func newStore(ctx context.Context, m *managerStore, sid string, expired int64, values map[string]interface{}) *store {
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+
+	return &store{
+		m:       m,
+		ctx:     ctx,
+		sid:     sid,
+		expired: expired,
+		values:  values,
+	}
+}
+
+type store struct {
+	sync.RWMutex
+	m       *managerStore
+	ctx     context.Context
+	sid     string
+	expired int64
+	values  map[string]interface{}
+}
+
+func (s *store) Context() context.Context {
+	return s.ctx
+}
+
+func (s *store) SessionID() string {
+	return s.sid
+}
+
+func (s *store) Set(key string, value interface{}) {
+	s.Lock()
+	s.values[key] = value
+	s.Unlock()
+}
+
+func (s *store) Get(key string) (interface{}, bool) {
+	s.RLock()
+	val, ok := s.values[key]
+	s.RUnlock()
+	return val, ok
+}
+
+func (s *store) Delete(key string) interface{} {
+	s.Lock()
+	defer s.Unlock()
+
+	v, ok := s.values[key]
+	if ok {
+		delete(s.values, key)
+	}
+	return v
+}
+
+func (s *store) Flush() error {
+	s.Lock()
+	s.values = make(map[string]interface{})
+	s.Unlock()
+
+	return s.Save()
+}
+
+func (s *store) Save() error {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.m.save(s.sid, s.values, s.expired)
+}
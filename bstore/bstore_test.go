@@ -0,0 +1,59 @@
+package bstore
+
+import (
+	"context"
+	"encoding/gob"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/buntdb"
+)
+
+func TestManagerStore(t *testing.T) {
+	gob.Register(url.Values{})
+	ctx := context.Background()
+	db, err := buntdb.Open(":memory:")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	m := NewManagerStore(db)
+	ok, err := m.Check(ctx, "sid")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	s, err := m.Create(ctx, "sid", 60)
+	assert.Nil(t, err)
+	s.Set("LoggedInUserID", "user")
+	s.Set("ReturnUri", url.Values{"state": []string{"abc"}})
+	assert.Nil(t, s.Save())
+
+	ok, err = m.Check(ctx, "sid")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	s, err = m.Update(ctx, "sid", 60)
+	assert.Nil(t, err)
+	user, _ := s.Get("LoggedInUserID")
+	assert.Equal(t, "user", user)
+	form, _ := s.Get("ReturnUri")
+	assert.Equal(t, url.Values{"state": []string{"abc"}}, form)
+
+	s, err = m.Refresh(ctx, "sid", "newsid", 60)
+	assert.Nil(t, err)
+	assert.Equal(t, "newsid", s.SessionID())
+	ok, _ = m.Check(ctx, "sid")
+	assert.False(t, ok)
+
+	assert.Equal(t, "user", s.Delete("LoggedInUserID"))
+	assert.Nil(t, s.Save())
+	s, err = m.Update(ctx, "newsid", 60)
+	assert.Nil(t, err)
+	_, found := s.Get("LoggedInUserID")
+	assert.False(t, found)
+
+	assert.Nil(t, m.Delete(ctx, "newsid"))
+	assert.Nil(t, m.Delete(ctx, "newsid"))
+	ok, _ = m.Check(ctx, "newsid")
+	assert.False(t, ok)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// detectorCache keeps the detectors read or written by this instance and
+// the changes made elsewhere, as seen by a snapshot listener. A detector is
+// only replaced by a version of its document at least as recent, so a
+// snapshot sent before a write of this instance does not revert it. A
+// detectorCache is safe for concurrent use.
+type detectorCache struct {
+	mu        sync.RWMutex
+	detectors map[string]cachedDetector
+}
+
+// cachedDetector is a detector as of the update time of its document.
+type cachedDetector struct {
+	detector Detector
+	updated  time.Time
+}
+
+func newDetectorCache() *detectorCache {
+	return &detectorCache{detectors: make(map[string]cachedDetector)}
+}
+
+// get returns a copy of the cached detector with the given id.
+func (c *detectorCache) get(id string) (*Detector, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	cached, ok := c.detectors[id]
+	if !ok {
+		return nil, false
+	}
+	detector := cached.detector
+	return &detector, true
+}
+
+// put caches detector as of updated, unless a more recent version is
+// cached.
+func (c *detectorCache) put(detector Detector, updated time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.detectors[detector.ID]; ok && cached.updated.After(updated) {
+		return
+	}
+	c.detectors[detector.ID] = cachedDetector{detector: detector, updated: updated}
+}
+
+// update changes the cached detector with the given id as of updated. It
+// tells whether the detector was cached.
+func (c *detectorCache) update(id string, updated time.Time, change func(d *Detector)) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.detectors[id]
+	if !ok {
+		return false
+	}
+	if cached.updated.After(updated) {
+		return true
+	}
+	change(&cached.detector)
+	cached.updated = updated
+	c.detectors[id] = cached
+	return true
+}
+
+// remove forgets the detector with the given id, deleted as of read,
+// unless it was written again since.
+func (c *detectorCache) remove(id string, read time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.detectors[id]; ok && cached.updated.After(read) {
+		return
+	}
+	delete(c.detectors, id)
+}
+
+// reset forgets every detector, so they are read from firestore again.
+func (c *detectorCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.detectors = make(map[string]cachedDetector)
+}
+
+// policyCache keeps the notification policies as seen by a snapshot
+// listener, and the changes made by this instance since. Snapshots read
+// before the last change of this instance are ignored, so they do not
+// revert it. A policyCache is safe for concurrent use.
+type policyCache struct {
+	mu       sync.RWMutex
+	policies map[string]NotificationPolicy
+	loaded   bool
+	updated  time.Time
+}
+
+func newPolicyCache() *policyCache {
+	return &policyCache{policies: make(map[string]NotificationPolicy)}
+}
+
+// get returns a copy of the cached policies. It tells whether they were
+// loaded by the listener.
+func (c *policyCache) get() (map[string]NotificationPolicy, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.loaded {
+		return nil, false
+	}
+	policies := make(map[string]NotificationPolicy, len(c.policies))
+	for detector, policy := range c.policies {
+		policies[detector] = policy
+	}
+	return policies, true
+}
+
+// replace caches every policy of a snapshot read as of read, unless a
+// policy was changed by this instance since.
+func (c *policyCache) replace(policies map[string]NotificationPolicy, read time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.updated.After(read) {
+		return
+	}
+	c.policies = policies
+	c.loaded = true
+}
+
+// put caches policy as of updated.
+func (c *policyCache) put(policy NotificationPolicy, updated time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.policies[policy.Detector] = policy
+	c.changed(updated)
+}
+
+// remove forgets the policy of detector, deleted as of updated.
+func (c *policyCache) remove(detector string, updated time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.policies, detector)
+	c.changed(updated)
+}
+
+func (c *policyCache) changed(updated time.Time) {
+	if updated.After(c.updated) {
+		c.updated = updated
+	}
+}
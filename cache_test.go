@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectorCache(t *testing.T) {
+	start := time.Date(2019, 8, 2, 10, 0, 0, 0, time.UTC)
+
+	t.Run("KeepsNewestVersion", func(t *testing.T) {
+		cache := newDetectorCache()
+
+		cache.put(Detector{ID: "zone-0", Name: "1 Voordeur", Status: "On"}, start.Add(time.Second))
+		// a snapshot sent before the write above
+		cache.put(Detector{ID: "zone-0", Name: "1 Voordeur", Status: "Off"}, start)
+		d, ok := cache.get("zone-0")
+		assert.True(t, ok)
+		assert.Equal(t, "On", d.Status)
+
+		assert.True(t, cache.update("zone-0", start.Add(2*time.Second), func(d *Detector) { d.Trouble = true }))
+		assert.False(t, cache.update("zone-1", start, func(d *Detector) { d.Trouble = true }))
+		d, _ = cache.get("zone-0")
+		assert.Equal(t, &Detector{ID: "zone-0", Name: "1 Voordeur", Status: "On", Trouble: true}, d)
+
+		cache.remove("zone-0", start)
+		_, ok = cache.get("zone-0")
+		assert.True(t, ok, "a detector written after it was deleted is kept")
+		cache.remove("zone-0", start.Add(3*time.Second))
+		_, ok = cache.get("zone-0")
+		assert.False(t, ok)
+	})
+
+	t.Run("ReturnsCopies", func(t *testing.T) {
+		cache := newDetectorCache()
+		cache.put(Detector{ID: "zone-0", Status: "Off"}, start)
+
+		d, _ := cache.get("zone-0")
+		d.Status = "On"
+
+		d, _ = cache.get("zone-0")
+		assert.Equal(t, "Off", d.Status)
+	})
+
+	t.Run("IsSafeForConcurrentUse", func(t *testing.T) {
+		cache := newDetectorCache()
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				id := fmt.Sprintf("zone-%d", i%2)
+				for j := 0; j < 100; j++ {
+					updated := start.Add(time.Duration(j) * time.Millisecond)
+					switch j % 4 {
+					case 0:
+						cache.put(Detector{ID: id, Status: "On"}, updated)
+					case 1:
+						cache.update(id, updated, func(d *Detector) { d.Status = "Off" })
+					case 2:
+						cache.get(id)
+					default:
+						cache.remove(id, updated)
+					}
+				}
+				cache.reset()
+			}(i)
+		}
+		wg.Wait()
+	})
+}
+
+func TestPolicyCache(t *testing.T) {
+	start := time.Date(2019, 8, 2, 10, 0, 0, 0, time.UTC)
+	silent := NotificationPolicy{Detector: "zone-0", Disarmed: silentLevel}
+	intrusion := NotificationPolicy{Detector: "zone-0", Armed: intrusionLevel}
+
+	t.Run("NotLoadedUntilSnapshot", func(t *testing.T) {
+		cache := newPolicyCache()
+		cache.put(silent, start)
+		_, ok := cache.get()
+		assert.False(t, ok)
+
+		cache.replace(map[string]NotificationPolicy{"zone-0": silent}, start.Add(time.Second))
+		policies, ok := cache.get()
+		assert.True(t, ok)
+		assert.Equal(t, map[string]NotificationPolicy{"zone-0": silent}, policies)
+	})
+
+	t.Run("KeepsChangesNewerThanSnapshot", func(t *testing.T) {
+		cache := newPolicyCache()
+		cache.replace(map[string]NotificationPolicy{"zone-0": silent}, start)
+
+		cache.put(intrusion, start.Add(2*time.Second))
+		// a snapshot read before the write above
+		cache.replace(map[string]NotificationPolicy{"zone-0": silent}, start.Add(time.Second))
+		policies, _ := cache.get()
+		assert.Equal(t, intrusion, policies["zone-0"])
+
+		cache.remove("zone-0", start.Add(3*time.Second))
+		policies, _ = cache.get()
+		assert.Empty(t, policies)
+
+		cache.replace(map[string]NotificationPolicy{"zone-0": silent}, start.Add(4*time.Second))
+		policies, _ = cache.get()
+		assert.Equal(t, silent, policies["zone-0"])
+	})
+
+	t.Run("ReturnsCopies", func(t *testing.T) {
+		cache := newPolicyCache()
+		cache.replace(map[string]NotificationPolicy{"zone-0": silent}, start)
+
+		policies, _ := cache.get()
+		delete(policies, "zone-0")
+
+		policies, _ = cache.get()
+		assert.Equal(t, silent, policies["zone-0"])
+	})
+}
@@ -0,0 +1,37 @@
+// Command fake-elas serves a simulated ELAS panel, so the app can be run without
+// a real panel by pointing its feenstra-url flag at it.
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/alecthomas/kingpin"
+
+	"github.com/vitorarins/magic-island/elas/elassim"
+)
+
+var (
+
+	// flags
+	port     = kingpin.Flag("port", "The port to be allocated for the fake panel.").Default("8450").Envar("PORT").String()
+	passCode = kingpin.Flag("pass-code", "Pass code accepted by the fake panel.").Default("1234").Envar("PASS_CODE").String()
+	key      = kingpin.Flag("feenstra-key", "Key accepted by the fake panel.").Default("key").Envar("FEENSTRA_KEY").String()
+)
+
+func main() {
+
+	// parse command line parameters
+	kingpin.Parse()
+
+	// log to stdout and hide timestamp
+	log.SetOutput(os.Stdout)
+	log.SetFlags(log.Flags() &^ (log.Ldate | log.Ltime))
+
+	panel := elassim.NewPanel(*passCode, *key)
+	http.Handle("/ELAS/WUWS/WUREQUEST.ASMX", panel)
+
+	log.Printf("Fake panel listening on port %s", *port)
+	log.Fatal(http.ListenAndServe(":"+*port, nil))
+}
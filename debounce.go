@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// activeStatus is the status of a detector that is open or sensing
+// movement.
+const activeStatus = "On"
+
+// activationsStatus is sent to Maker along with the number of activations
+// of a detector whose changes were held back, and the summary period in
+// minutes.
+const activationsStatus = "Activations"
+
+// DebounceConfig tunes how the status changes of a detector are reported.
+type DebounceConfig struct {
+	// Hold is how long a new status must last before it is reported.
+	Hold time.Duration
+	// Window is the minimum time between two reports of the detector.
+	Window time.Duration
+}
+
+// ParseDebounceConfigs reads the debounce configuration of detectors given
+// as HOLD,WINDOW durations keyed by detector id, such as zone-2=10s,1m.
+// Detectors used to be keyed by name, so other keys are refused rather than
+// silently ignored.
+func ParseDebounceConfigs(values map[string]string) (map[string]DebounceConfig, error) {
+	configs := make(map[string]DebounceConfig, len(values))
+	for id, value := range values {
+		if err := checkDetectorID(id); err != nil {
+			return nil, err
+		}
+		fields := strings.Split(value, ",")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid debounce %s for detector %s, it must be HOLD,WINDOW", value, id)
+		}
+		hold, err := time.ParseDuration(strings.TrimSpace(fields[0]))
+		if err != nil || hold < 0 {
+			return nil, fmt.Errorf("invalid hold time %s for detector %s", fields[0], id)
+		}
+		window, err := time.ParseDuration(strings.TrimSpace(fields[1]))
+		if err != nil || window < 0 {
+			return nil, fmt.Errorf("invalid debounce window %s for detector %s", fields[1], id)
+		}
+		configs[id] = DebounceConfig{Hold: hold, Window: window}
+	}
+
+	return configs, nil
+}
+
+// Debouncer holds back the status changes of flapping detectors. A new
+// status is only reported once it lasted the hold time of the detector, and
+// at most once per debounce window. When changes were held back, the number
+// of activations is reported in a summary at the end of every summary
+// period instead.
+//
+// A nil *Debouncer reports every change. A Debouncer is safe for
+// concurrent use.
+type Debouncer struct {
+	defaults DebounceConfig
+	configs  map[string]DebounceConfig
+	period   time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	detectors map[string]*debounceState
+}
+
+// debounceState tracks a detector between polls.
+type debounceState struct {
+	seen         string
+	pending      string
+	pendingSince time.Time
+	lastReport   time.Time
+	periodStart  time.Time
+	activations  int
+	reported     int
+}
+
+// ActivationSummary counts the activations of a detector in a summary
+// period.
+type ActivationSummary struct {
+	Detector    string
+	Activations int
+	Period      time.Duration
+}
+
+// NewDebouncer returns a debouncer using configs for the detectors they
+// name and defaults for the others. A zero summary period disables
+// summaries.
+func NewDebouncer(defaults DebounceConfig, configs map[string]DebounceConfig, period time.Duration) *Debouncer {
+	return &Debouncer{
+		defaults:  defaults,
+		configs:   configs,
+		period:    period,
+		now:       time.Now,
+		detectors: make(map[string]*debounceState),
+	}
+}
+
+// Observe records the status of a detector seen by a poll, reported being
+// its last reported status. It tells whether the change to status should be
+// reported now.
+func (d *Debouncer) Observe(name, reported, status string) bool {
+	if d == nil {
+		return reported != status
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	s, ok := d.detectors[name]
+	if !ok {
+		s = &debounceState{seen: reported, periodStart: now}
+		d.detectors[name] = s
+	}
+	if s.seen != status && status == activeStatus {
+		s.activations++
+	}
+	s.seen = status
+
+	if status == reported {
+		s.pending = ""
+		return false
+	}
+	if s.pending != status {
+		s.pending = status
+		s.pendingSince = now
+	}
+
+	config, ok := d.configs[name]
+	if !ok {
+		config = d.defaults
+	}
+	if now.Sub(s.pendingSince) < config.Hold {
+		return false
+	}
+	if !s.lastReport.IsZero() && now.Sub(s.lastReport) < config.Window {
+		return false
+	}
+	return true
+}
+
+// Reported records that the change of a detector to status was reported.
+func (d *Debouncer) Reported(name, status string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if s, ok := d.detectors[name]; ok {
+		s.pending = ""
+		s.lastReport = d.now()
+		if status == activeStatus {
+			s.reported++
+		}
+	}
+}
+
+// Summaries returns the detectors whose summary period ended with
+// activations that were held back, and starts a new period for every
+// detector whose period ended.
+func (d *Debouncer) Summaries() []ActivationSummary {
+	if d == nil || d.period <= 0 {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	var summaries []ActivationSummary
+	for name, s := range d.detectors {
+		if now.Sub(s.periodStart) < d.period {
+			continue
+		}
+		if s.activations > s.reported {
+			summaries = append(summaries, ActivationSummary{Detector: name, Activations: s.activations, Period: d.period})
+		}
+		s.periodStart = now
+		s.activations = 0
+		s.reported = 0
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Detector < summaries[j].Detector })
+
+	return summaries
+}
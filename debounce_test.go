@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDebounceConfigs(t *testing.T) {
+	configs, err := ParseDebounceConfigs(map[string]string{"zone-2": "10s,1m", "zone-4": "0s, 30s"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]DebounceConfig{
+		"zone-2": {Hold: 10 * time.Second, Window: time.Minute},
+		"zone-4": {Window: 30 * time.Second},
+	}, configs)
+
+	_, err = ParseDebounceConfigs(map[string]string{"zone-2": "10s"})
+	assert.EqualError(t, err, "invalid debounce 10s for detector zone-2, it must be HOLD,WINDOW")
+
+	_, err = ParseDebounceConfigs(map[string]string{"zone-2": "10s,-1m"})
+	assert.EqualError(t, err, "invalid debounce window -1m for detector zone-2")
+
+	_, err = ParseDebounceConfigs(map[string]string{"3-Hal-Pir": "10s,1m"})
+	assert.EqualError(t, err, "invalid detector 3-Hal-Pir, detectors are keyed by zone id such as zone-2")
+}
+
+func newTestDebouncer(now *time.Time) *Debouncer {
+	debouncer := NewDebouncer(DebounceConfig{}, map[string]DebounceConfig{
+		"zone-2": {Hold: 10 * time.Second, Window: time.Minute},
+	}, 5*time.Minute)
+	debouncer.now = func() time.Time { return *now }
+	return debouncer
+}
+
+func TestDebouncer(t *testing.T) {
+	start := time.Date(2019, 8, 2, 0, 0, 0, 0, time.UTC)
+
+	t.Run("ReportsOtherDetectorsRightAway", func(t *testing.T) {
+		now := start
+		debouncer := newTestDebouncer(&now)
+
+		assert.False(t, debouncer.Observe("zone-0", "Off", "Off"))
+		assert.True(t, debouncer.Observe("zone-0", "Off", "On"))
+	})
+
+	t.Run("HoldsShortChanges", func(t *testing.T) {
+		now := start
+		debouncer := newTestDebouncer(&now)
+
+		assert.False(t, debouncer.Observe("zone-2", "Off", "On"))
+		now = now.Add(5 * time.Second)
+		assert.False(t, debouncer.Observe("zone-2", "Off", "Off"))
+		now = now.Add(5 * time.Second)
+		assert.False(t, debouncer.Observe("zone-2", "Off", "On"))
+		now = now.Add(10 * time.Second)
+		assert.True(t, debouncer.Observe("zone-2", "Off", "On"))
+	})
+
+	t.Run("ReportsOncePerWindow", func(t *testing.T) {
+		now := start
+		debouncer := newTestDebouncer(&now)
+
+		debouncer.Observe("zone-2", "Off", "On")
+		now = now.Add(10 * time.Second)
+		assert.True(t, debouncer.Observe("zone-2", "Off", "On"))
+		debouncer.Reported("zone-2", "On")
+
+		debouncer.Observe("zone-2", "On", "Off")
+		now = now.Add(10 * time.Second)
+		assert.False(t, debouncer.Observe("zone-2", "On", "Off"))
+		now = now.Add(time.Minute)
+		assert.True(t, debouncer.Observe("zone-2", "On", "Off"))
+	})
+
+	t.Run("SummarizesHeldBackActivations", func(t *testing.T) {
+		now := start
+		debouncer := newTestDebouncer(&now)
+
+		for i := 0; i < 4; i++ {
+			debouncer.Observe("zone-2", "Off", "On")
+			debouncer.Observe("zone-0", "Off", "On")
+			debouncer.Reported("zone-0", "On")
+			now = now.Add(time.Second)
+			debouncer.Observe("zone-2", "Off", "Off")
+			debouncer.Observe("zone-0", "On", "Off")
+			debouncer.Reported("zone-0", "Off")
+			now = now.Add(time.Second)
+		}
+		assert.Empty(t, debouncer.Summaries())
+
+		now = start.Add(5 * time.Minute)
+		assert.Equal(t, []ActivationSummary{{Detector: "zone-2", Activations: 4, Period: 5 * time.Minute}}, debouncer.Summaries())
+		assert.Empty(t, debouncer.Summaries())
+	})
+
+	t.Run("ReportsEveryChangeWhenNil", func(t *testing.T) {
+		var debouncer *Debouncer
+
+		assert.False(t, debouncer.Observe("zone-2", "Off", "Off"))
+		assert.True(t, debouncer.Observe("zone-2", "Off", "On"))
+		assert.Nil(t, debouncer.Summaries())
+	})
+}
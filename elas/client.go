@@ -0,0 +1,188 @@
+package elas
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const timeout = 30 * time.Second
+
+// defaultHTTPClient is shared by clients without an HTTPClient, so their
+// connections are kept alive between calls.
+var defaultHTTPClient = &http.Client{
+	Transport: NewTransport(),
+	Timeout:   timeout,
+}
+
+// NewTransport returns a transport allowing the TLS renegotiation the panel
+// requires. Connections are kept alive and limited, as a single panel sits
+// behind the web service.
+func NewTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost:   4,
+		MaxConnsPerHost:       4,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       &tls.Config{Renegotiation: tls.RenegotiateFreelyAsClient},
+	}
+}
+
+// Client sends requests to an ELAS endpoint.
+type Client struct {
+	// URL is the address of the WUREQUEST web service.
+	URL string
+	// Key is the basic authorization key of the account.
+	Key string
+	// HTTPClient is used to send requests. When nil a shared client using
+	// NewTransport is used.
+	HTTPClient *http.Client
+	// Retry is the policy used to retry requests that only read from the
+	// panel. Commands changing the panel are sent once.
+	Retry Backoff
+	// Breaker, when set, stops requests to a panel that keeps failing.
+	Breaker *Breaker
+}
+
+// StatusError is returned when the panel answers with an unexpected HTTP
+// status and no fault.
+type StatusError struct {
+	Operation string
+	Status    string
+	Code      int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status for %s request: %s", e.Operation, e.Status)
+}
+
+// NewClient returns a client for the ELAS endpoint at url.
+func NewClient(url, key string) *Client {
+	return &Client{
+		URL: url,
+		Key: key,
+	}
+}
+
+// Call sends req to the panel and decodes its reply into resp. The request
+// is abandoned when ctx is done. SOAP faults are returned as *Fault.
+func (c *Client) Call(ctx context.Context, req Request, resp interface{}) error {
+	var body bytes.Buffer
+	if err := encodeEnvelope(&body, req); err != nil {
+		return fmt.Errorf("could not encode %s request: %v", req.Operation(), err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.URL, &body)
+	if err != nil {
+		return fmt.Errorf("could not create %s request: %v", req.Operation(), err)
+	}
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Basic %v", c.Key))
+	httpReq.Header.Set("User-Agent", "ksoap2-android/2.6.0+")
+	httpReq.Header.Set("Content-Type", "application/soap+xml;charset=utf-8")
+
+	httpResp, err := c.httpClient().Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("could not execute %s request: %w", req.Operation(), err)
+	}
+	defer httpResp.Body.Close()
+
+	// faults come with an error status, so the body is decoded first
+	err = decodeEnvelope(httpResp.Body, resp)
+	if _, ok := err.(*Fault); ok {
+		return err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return &StatusError{Operation: req.Operation(), Status: httpResp.Status, Code: httpResp.StatusCode}
+	}
+	return err
+}
+
+// response is implemented by every reply, which carries a result code.
+type response interface {
+	result() ResultCode
+}
+
+// send calls the panel through the breaker and checks the result of the
+// reply.
+func (c *Client) send(ctx context.Context, req Request, resp response) error {
+	if !c.Breaker.allow() {
+		return ErrPanelUnreachable
+	}
+
+	err := c.Call(ctx, req, resp)
+	if err != nil && ctx.Err() != nil {
+		// the caller gave up, which tells nothing about the panel
+		err = fmt.Errorf("abandoned %s request: %w", req.Operation(), ctx.Err())
+	}
+	if err == nil {
+		err = resp.result().Check(req.Operation())
+	}
+	c.Breaker.record(err)
+	return err
+}
+
+// GetCPState returns the current state of the panel. A reply with a result
+// other than ASNoError is returned as *ResultError, as with every operation.
+func (c *Client) GetCPState(ctx context.Context, req *GetCPState) (*GetCPStateResponse, error) {
+	var resp GetCPStateResponse
+	err := c.Retry.do(ctx, func() error {
+		resp = GetCPStateResponse{}
+		return c.send(ctx, req, &resp)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CPPartArm changes the armed state of the partitions in req.
+func (c *Client) CPPartArm(ctx context.Context, req *CPPartArm) (*CPPartArmResponse, error) {
+	var resp CPPartArmResponse
+	if err := c.send(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CPZoneBypass bypasses or restores the zone in req.
+func (c *Client) CPZoneBypass(ctx context.Context, req *CPZoneBypass) (*CPZoneBypassResponse, error) {
+	var resp CPZoneBypassResponse
+	if err := c.send(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SetCPUser changes the user slot in req.
+func (c *Client) SetCPUser(ctx context.Context, req *SetCPUser) (*SetCPUserResponse, error) {
+	var resp SetCPUserResponse
+	if err := c.send(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetCPEventLogExWithPaging returns a page of the panel event log.
+func (c *Client) GetCPEventLogExWithPaging(ctx context.Context, req *GetCPEventLogExWithPaging) (*GetCPEventLogExWithPagingResponse, error) {
+	var resp GetCPEventLogExWithPagingResponse
+	err := c.Retry.do(ctx, func() error {
+		resp = GetCPEventLogExWithPagingResponse{}
+		return c.send(ctx, req, &resp)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return defaultHTTPClient
+}
@@ -0,0 +1,151 @@
+package elas
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var ctx = context.Background()
+
+func newTestServer(t *testing.T, status int, file string) *httptest.Server {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Basic key", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/soap+xml;charset=utf-8", r.Header.Get("Content-Type"))
+
+		w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+}
+
+func TestGetCPState(t *testing.T) {
+	server := newTestServer(t, http.StatusOK, "testdata/detectors.xml")
+	defer server.Close()
+
+	client := NewClient(server.URL, "key")
+	resp, err := client.GetCPState(ctx, &GetCPState{PassCode: "1234"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, ASNoError, resp.Result)
+	assert.Len(t, resp.Reply.Zones, 7)
+}
+
+func TestCPPartArm(t *testing.T) {
+	server := newTestServer(t, http.StatusOK, "testdata/cp-part-arm.xml")
+	defer server.Close()
+
+	client := NewClient(server.URL, "key")
+	resp, err := client.CPPartArm(ctx, NewCPPartArm("1234", 0, AwayArm, ArmOptions{}))
+
+	assert.Nil(t, err)
+	assert.Equal(t, ASNoError, resp.Result)
+}
+
+func TestCPZoneBypass(t *testing.T) {
+	server := newTestServer(t, http.StatusOK, "testdata/cp-zone-bypass.xml")
+	defer server.Close()
+
+	client := NewClient(server.URL, "key")
+	resp, err := client.CPZoneBypass(ctx, &CPZoneBypass{PassCode: "1234", ZoneID: 6, Bypass: true})
+
+	assert.Nil(t, err)
+	assert.Equal(t, ASNoError, resp.Result)
+}
+
+func TestSetCPUser(t *testing.T) {
+	server := newTestServer(t, http.StatusOK, "testdata/set-cp-user-response.xml")
+	defer server.Close()
+
+	client := NewClient(server.URL, "key")
+	resp, err := client.SetCPUser(ctx, &SetCPUser{PassCode: "1234", User: User{ID: 3, UserType: UnusedUserType}})
+
+	assert.Nil(t, err)
+	assert.Equal(t, ASNoError, resp.Result)
+}
+
+func TestCallErrors(t *testing.T) {
+	t.Run("ReturnsFaultOnServerError", func(t *testing.T) {
+		server := newTestServer(t, http.StatusInternalServerError, "testdata/fault.xml")
+		defer server.Close()
+
+		client := NewClient(server.URL, "key")
+		_, err := client.GetCPState(ctx, &GetCPState{PassCode: "1234"})
+
+		_, ok := err.(*Fault)
+		assert.True(t, ok, "unexpected error: %v", err)
+	})
+
+	t.Run("ReturnsErrorOnUnexpectedStatus", func(t *testing.T) {
+		server := newTestServer(t, http.StatusUnauthorized, "testdata/detectors.xml")
+		defer server.Close()
+
+		client := NewClient(server.URL, "key")
+		_, err := client.GetCPState(ctx, &GetCPState{PassCode: "1234"})
+
+		assert.EqualError(t, err, "unexpected status for GetCPState request: 401 Unauthorized")
+	})
+}
+
+func TestCallCancel(t *testing.T) {
+	server := newTestServer(t, http.StatusOK, "testdata/detectors.xml")
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	client := NewClient(server.URL, "key")
+	_, err := client.GetCPState(ctx, &GetCPState{PassCode: "1234"})
+
+	assert.True(t, errors.Is(err, context.Canceled), "unexpected error: %v", err)
+}
+
+func TestResultError(t *testing.T) {
+	server := newTestServer(t, http.StatusOK, "testdata/cp-part-arm-not-ready.xml")
+	defer server.Close()
+
+	client := NewClient(server.URL, "key")
+	resp, err := client.CPPartArm(ctx, NewCPPartArm("1234", 0, AwayArm, ArmOptions{}))
+
+	assert.Nil(t, resp)
+	assert.Equal(t, &ResultError{Operation: "CPPartArm", Code: ASNotReady}, err)
+	assert.EqualError(t, err, "CPPartArm failed with result ASNotReady")
+}
+
+func TestGetCPEventLogExWithPaging(t *testing.T) {
+	server := newTestServer(t, http.StatusOK, "testdata/get-cp-event-log-response.xml")
+	defer server.Close()
+
+	client := NewClient(server.URL, "key")
+	resp, err := client.GetCPEventLogExWithPaging(ctx, &GetCPEventLogExWithPaging{
+		PassCode:  "1234",
+		LangID:    "en-us",
+		NewerThan: time.Date(2019, 8, 1, 22, 30, 0, 0, time.UTC),
+		Count:     100,
+	})
+
+	assert.Nil(t, err)
+	assert.Len(t, resp.Events, 3)
+
+	assert.Equal(t, time.Date(2019, 8, 2, 7, 45, 10, 0, time.UTC), resp.Events[0].Time.UTC())
+	assert.Equal(t, "Disarm", resp.Events[0].EventType)
+	assert.Equal(t, "Gebruiker 00", resp.Events[0].User)
+	assert.Equal(t, "", resp.Events[0].Zone)
+
+	assert.Equal(t, time.Date(2019, 8, 2, 8, 1, 33, 0, time.UTC), resp.Events[1].Time.UTC())
+	assert.Equal(t, "ZoneOpen", resp.Events[1].EventType)
+	assert.Equal(t, "1 Voordeur", resp.Events[1].Zone)
+
+	assert.Equal(t, time.Date(2019, 8, 2, 8, 2, 5, 120000000, time.UTC), resp.Events[2].Time.UTC())
+}
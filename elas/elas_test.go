@@ -0,0 +1,41 @@
+package elas
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZonePartitions(t *testing.T) {
+	tests := map[string][]int{
+		"":      nil,
+		"0":     {0},
+		"0,1":   {0, 1},
+		"1, 2,": {1, 2},
+	}
+
+	for csv, want := range tests {
+		zone := Zone{PartAssociationCSV: csv}
+		assert.Equal(t, want, zone.Partitions(), csv)
+	}
+}
+
+func TestPartitionCSV(t *testing.T) {
+	assert.Equal(t, "", PartitionCSV(nil))
+	assert.Equal(t, "0", PartitionCSV([]int{0}))
+	assert.Equal(t, "0,2", PartitionCSV([]int{0, 2}))
+}
+
+func TestAlarmStateActive(t *testing.T) {
+	assert.False(t, AlarmState("").Active())
+	assert.False(t, NoAlarm.Active())
+	assert.True(t, AlarmState("Burglary").Active())
+}
+
+func TestPassCode(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "1234", PassCode(ctx, "1234"))
+	assert.Equal(t, "5678", PassCode(WithPassCode(ctx, "5678"), "1234"))
+	assert.Equal(t, "1234", PassCode(WithPassCode(ctx, ""), "1234"))
+}
@@ -0,0 +1,628 @@
+// Package elassim simulates an ELAS panel in memory.
+//
+// The simulated panel speaks the same SOAP operations as the real web
+// service and keeps the state of its partitions and zones, so clients can be
+// pointed at it instead of a real panel. The same operations can be called
+// in memory, without SOAP. Zone changes, alarms and failures can be scripted
+// while the panel is serving requests.
+package elassim
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vitorarins/magic-island/elas"
+)
+
+// Zone statuses reported by the panel.
+const (
+	ZoneOpen   = "On"
+	ZoneClosed = "Off"
+)
+
+// Panel is a simulated ELAS panel. It implements http.Handler and is safe for
+// concurrent use.
+type Panel struct {
+	passCode string
+	key      string
+
+	mu      sync.Mutex
+	reply   elas.ECReply
+	events  []elas.Event
+	results map[string]elas.ResultCode
+	faults  map[string]*elas.Fault
+	calls   map[string]int
+	now     func() time.Time
+}
+
+// NewPanel returns a disarmed panel with a single partition and a few
+// closed zones. Requests must carry passCode, or the code of a user, and be
+// authorized with key. In memory calls use the code set on their context
+// with elas.WithPassCode, passCode otherwise.
+func NewPanel(passCode, key string) *Panel {
+	return &Panel{
+		passCode: passCode,
+		key:      key,
+		reply: elas.ECReply{
+			Zones: []elas.Zone{
+				newZone(0, "1 Voordeur"),
+				newZone(1, "2 Meterkast"),
+				newZone(2, "3 Hal Pir"),
+				newZone(3, "4 Hal Rook"),
+				newZone(4, "5 Woonkamer Pir"),
+				newZone(5, "6 Keukendeur"),
+				newZone(6, "7 Balkondeur"),
+			},
+			Users: []elas.User{
+				{ID: 0, Name: "Gebruiker 00", UserType: "GRAND_08", PassCode: passCode, Part: "F", PartAssociationCSV: "0"},
+				{ID: 1, UserType: elas.UnusedUserType, Part: "No"},
+				{ID: 2, UserType: elas.UnusedUserType, Part: "No"},
+				{ID: 3, UserType: elas.UnusedUserType, Part: "No"},
+			},
+			SysStat:     sysStat(elas.Disarm),
+			SystemReady: true,
+			Partitions: []elas.Partition{
+				{ID: 0, ArmedState: elas.Disarm, ReadyState: elas.AwayReady, AlarmState: elas.NoAlarm},
+			},
+		},
+		results: make(map[string]elas.ResultCode),
+		faults:  make(map[string]*elas.Fault),
+		calls:   make(map[string]int),
+		now:     time.Now,
+	}
+}
+
+func newZone(id int64, name string) elas.Zone {
+	return elas.Zone{
+		Id:                 id,
+		Name:               name,
+		ZoneType:           "Unknown",
+		Status:             ZoneClosed,
+		Part:               "F",
+		PartAssociationCSV: "0",
+		RegDevSN:           2,
+	}
+}
+
+// Reply returns a copy of the current state of the panel.
+func (p *Panel) Reply() elas.ECReply {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.copyReply()
+}
+
+// SetZone changes the status of a zone, ZoneOpen or ZoneClosed, and logs it.
+func (p *Panel) SetZone(id int64, status string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	zone, err := p.zone(id)
+	if err != nil {
+		return err
+	}
+	if zone.Status == status {
+		return nil
+	}
+	zone.Status = status
+
+	eventType := "ZoneClose"
+	if status == ZoneOpen {
+		eventType = "ZoneOpen"
+	}
+	p.logEvent(eventType, "", zone.Name)
+	p.updateReady()
+	return nil
+}
+
+// SetTrouble changes the trouble condition of a zone.
+func (p *Panel) SetTrouble(id int64, trouble bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	zone, err := p.zone(id)
+	if err != nil {
+		return err
+	}
+	zone.Trouble = trouble
+
+	p.reply.Trouble = false
+	for _, zone := range p.reply.Zones {
+		p.reply.Trouble = p.reply.Trouble || zone.Trouble
+	}
+	return nil
+}
+
+// SetAlarm changes the alarm state of a partition. The bell is on while any
+// partition is in alarm.
+func (p *Panel) SetAlarm(partition int, state elas.AlarmState) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	part, err := p.partition(partition)
+	if err != nil {
+		return err
+	}
+	part.AlarmState = state
+
+	p.reply.BellOn = false
+	for _, part := range p.reply.Partitions {
+		p.reply.BellOn = p.reply.BellOn || part.AlarmState.Active()
+	}
+	return nil
+}
+
+// SetResult makes every following call of operation reply with code.
+// ASNoError restores the normal behaviour.
+func (p *Panel) SetResult(operation string, code elas.ResultCode) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if code == elas.ASNoError {
+		delete(p.results, operation)
+		return
+	}
+	p.results[operation] = code
+}
+
+// SetFault makes every following call of operation fail with fault. A nil
+// fault restores the normal behaviour.
+func (p *Panel) SetFault(operation string, fault *elas.Fault) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if fault == nil {
+		delete(p.faults, operation)
+		return
+	}
+	p.faults[operation] = fault
+}
+
+// Calls returns the number of requests received for operation.
+func (p *Panel) Calls(operation string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.calls[operation]
+}
+
+// State returns the state of the panel, as GetCPState does.
+func (p *Panel) State(ctx context.Context) (*elas.ECReply, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.scripted("GetCPState", elas.PassCode(ctx, p.passCode)); err != nil {
+		return nil, err
+	}
+	reply := p.copyReply()
+	return &reply, nil
+}
+
+// Arm sets a partition to the given armed state, as CPPartArm does.
+func (p *Panel) Arm(ctx context.Context, partition int, state elas.ArmedState, options elas.ArmOptions) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	passCode := elas.PassCode(ctx, p.passCode)
+	if err := p.scripted("CPPartArm", passCode); err != nil {
+		return err
+	}
+	req := elas.NewCPPartArm(passCode, partition, state, options)
+	return p.arm(req.Partitions, p.userName(passCode)).Check(req.Operation())
+}
+
+// Bypass bypasses or restores a zone, as CPZoneBypass does.
+func (p *Panel) Bypass(ctx context.Context, zone int64, bypass bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	passCode := elas.PassCode(ctx, p.passCode)
+	if err := p.scripted("CPZoneBypass", passCode); err != nil {
+		return err
+	}
+	return p.bypass(zone, bypass, p.userName(passCode)).Check("CPZoneBypass")
+}
+
+// SetUser changes a user slot, as SetCPUser does.
+func (p *Panel) SetUser(ctx context.Context, user elas.User) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	passCode := elas.PassCode(ctx, p.passCode)
+	if err := p.scripted("SetCPUser", passCode); err != nil {
+		return err
+	}
+	if fault := p.setUser(user, p.userName(passCode)); fault != nil {
+		return fault
+	}
+	return nil
+}
+
+// Events returns a page of the event log, as GetCPEventLogExWithPaging does.
+func (p *Panel) Events(ctx context.Context, newerThan time.Time, offset, count int) ([]elas.Event, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.scripted("GetCPEventLogExWithPaging", elas.PassCode(ctx, p.passCode)); err != nil {
+		return nil, err
+	}
+	return p.eventPage(newerThan, offset, count), nil
+}
+
+// scripted counts an in memory call of operation and returns the failure
+// scripted for it, if any, or checks the pass code.
+func (p *Panel) scripted(operation, passCode string) error {
+	p.calls[operation]++
+	if fault, ok := p.faults[operation]; ok {
+		return fault
+	}
+	return p.result(operation, passCode).Check(operation)
+}
+
+// ServeHTTP answers a SOAP request sent to the panel.
+func (p *Panel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Authorization") != fmt.Sprintf("Basic %v", p.key) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	req, err := decodeRequest(r.Body)
+	if err != nil {
+		writeFault(w, &elas.Fault{Code: "soap:Sender", Reason: err.Error()})
+		return
+	}
+
+	resp, fault := p.handle(req)
+	if fault != nil {
+		writeFault(w, fault)
+		return
+	}
+	writeEnvelope(w, http.StatusOK, &response{Operation: req.Operation(), Content: resp})
+}
+
+func (p *Panel) handle(req elas.Request) (interface{}, *elas.Fault) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.calls[req.Operation()]++
+	if fault, ok := p.faults[req.Operation()]; ok {
+		return nil, fault
+	}
+
+	switch req := req.(type) {
+	case *elas.GetCPState:
+		resp := &elas.GetCPStateResponse{Result: p.result(req.Operation(), req.PassCode)}
+		if resp.Result == elas.ASNoError {
+			resp.Reply = p.copyReply()
+			resp.CPTime = elas.DateTime{Time: p.now()}
+		}
+		return resp, nil
+	case *elas.CPPartArm:
+		resp := &elas.CPPartArmResponse{Result: p.result(req.Operation(), req.PassCode)}
+		if resp.Result == elas.ASNoError {
+			resp.Result = p.arm(req.Partitions, p.userName(req.PassCode))
+		}
+		return resp, nil
+	case *elas.CPZoneBypass:
+		resp := &elas.CPZoneBypassResponse{Result: p.result(req.Operation(), req.PassCode)}
+		if resp.Result == elas.ASNoError {
+			resp.Result = p.bypass(req.ZoneID, req.Bypass, p.userName(req.PassCode))
+		}
+		return resp, nil
+	case *elas.SetCPUser:
+		resp := &elas.SetCPUserResponse{Result: p.result(req.Operation(), req.PassCode)}
+		if resp.Result == elas.ASNoError {
+			if fault := p.setUser(req.User, p.userName(req.PassCode)); fault != nil {
+				return nil, fault
+			}
+		}
+		return resp, nil
+	case *elas.GetCPEventLogExWithPaging:
+		resp := &elas.GetCPEventLogExWithPagingResponse{Result: p.result(req.Operation(), req.PassCode)}
+		if resp.Result == elas.ASNoError {
+			resp.Events = p.eventPage(req.NewerThan, req.Offset, req.Count)
+		}
+		return resp, nil
+	}
+
+	return nil, &elas.Fault{Code: "soap:Sender", Reason: fmt.Sprintf("unsupported operation %s", req.Operation())}
+}
+
+// result returns the scripted result of operation, if any, or checks the
+// pass code. The panel accepts its own pass code and the code of every user
+// slot in use.
+func (p *Panel) result(operation, passCode string) elas.ResultCode {
+	if code, ok := p.results[operation]; ok {
+		return code
+	}
+	if passCode != p.passCode && p.user(passCode) == nil {
+		return elas.ASInvalidPassCode
+	}
+	return elas.ASNoError
+}
+
+func (p *Panel) arm(partitions []elas.Partition, userName string) elas.ResultCode {
+	for _, requested := range partitions {
+		part, err := p.partition(requested.ID)
+		if err != nil {
+			return elas.ASArmNotAllowed
+		}
+		if requested.ArmedState != elas.Disarm && requested.ReadyState != elas.ForceReady && !p.ready(part.ID) {
+			return elas.ASNotReady
+		}
+	}
+
+	for _, requested := range partitions {
+		part, _ := p.partition(requested.ID)
+		part.ArmedState = requested.ArmedState
+		part.ExitDelayTO = requested.ExitDelayTO
+		if requested.ArmedState == elas.Disarm {
+			part.AlarmState = elas.NoAlarm
+		}
+		p.logEvent(string(requested.ArmedState), userName, "")
+	}
+
+	p.reply.SysStat = sysStat(p.reply.Partitions[0].ArmedState)
+	p.reply.BellOn = false
+	for _, part := range p.reply.Partitions {
+		p.reply.BellOn = p.reply.BellOn || part.AlarmState.Active()
+	}
+	return elas.ASNoError
+}
+
+func (p *Panel) bypass(id int64, bypass bool, userName string) elas.ResultCode {
+	zone, err := p.zone(id)
+	if err != nil {
+		return elas.ASArmNotAllowed
+	}
+	zone.Bypassed = bypass
+
+	eventType := "ZoneBypassRestore"
+	if bypass {
+		eventType = "ZoneBypass"
+	}
+	p.logEvent(eventType, userName, zone.Name)
+	p.updateReady()
+	return elas.ASNoError
+}
+
+// setUser replaces a user slot. The slot is cleared when the user type is
+// elas.UnusedUserType.
+func (p *Panel) setUser(user elas.User, userName string) *elas.Fault {
+	for i := range p.reply.Users {
+		if p.reply.Users[i].ID != user.ID {
+			continue
+		}
+
+		eventType := "UserCodeChanged"
+		if user.UserType == elas.UnusedUserType {
+			user = elas.User{ID: user.ID, UserType: elas.UnusedUserType}
+			eventType = "UserCodeDeleted"
+		}
+		user.Part = "No"
+		if len(user.Partitions()) > 0 {
+			user.Part = "F"
+		}
+		p.reply.Users[i] = user
+		p.logEvent(eventType, userName, "")
+		return nil
+	}
+	return &elas.Fault{Code: "soap:Sender", Reason: fmt.Sprintf("unknown user %d", user.ID)}
+}
+
+// eventPage returns the events newer than newerThan, oldest first, the way
+// the panel pages them.
+func (p *Panel) eventPage(newerThan time.Time, offset, count int) []elas.Event {
+	var newer []elas.Event
+	for _, event := range p.events {
+		if event.Time.After(newerThan) {
+			newer = append(newer, event)
+		}
+	}
+	if offset >= len(newer) {
+		return nil
+	}
+	end := offset + count
+	if end > len(newer) {
+		end = len(newer)
+	}
+	return newer[offset:end]
+}
+
+// ready tells whether every zone of a partition is closed or bypassed.
+func (p *Panel) ready(partition int) bool {
+	for _, zone := range p.reply.Zones {
+		if zone.Status != ZoneOpen || zone.Bypassed {
+			continue
+		}
+		for _, id := range zone.Partitions() {
+			if id == partition {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (p *Panel) updateReady() {
+	p.reply.SystemReady = true
+	for _, part := range p.reply.Partitions {
+		p.reply.SystemReady = p.reply.SystemReady && p.ready(part.ID)
+	}
+}
+
+func (p *Panel) logEvent(eventType, user, zone string) {
+	p.events = append(p.events, elas.Event{
+		Time:      elas.DateTime{Time: p.now().UTC().Truncate(time.Second)},
+		EventType: eventType,
+		User:      user,
+		Zone:      zone,
+	})
+}
+
+// user returns the user slot in use owning the pass code, if any.
+func (p *Panel) user(passCode string) *elas.User {
+	for i, user := range p.reply.Users {
+		if user.UserType != elas.UnusedUserType && user.PassCode == passCode {
+			return &p.reply.Users[i]
+		}
+	}
+	return nil
+}
+
+// userName returns the name of the user owning the pass code.
+func (p *Panel) userName(passCode string) string {
+	if user := p.user(passCode); user != nil {
+		return user.Name
+	}
+	return ""
+}
+
+func (p *Panel) zone(id int64) (*elas.Zone, error) {
+	for i := range p.reply.Zones {
+		if p.reply.Zones[i].Id == id {
+			return &p.reply.Zones[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown zone %d", id)
+}
+
+func (p *Panel) partition(id int) (*elas.Partition, error) {
+	for i := range p.reply.Partitions {
+		if p.reply.Partitions[i].ID == id {
+			return &p.reply.Partitions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown partition %d", id)
+}
+
+func (p *Panel) copyReply() elas.ECReply {
+	reply := p.reply
+	reply.Zones = append([]elas.Zone(nil), p.reply.Zones...)
+	reply.Users = append([]elas.User(nil), p.reply.Users...)
+	reply.Partitions = append([]elas.Partition(nil), p.reply.Partitions...)
+	return reply
+}
+
+func sysStat(state elas.ArmedState) string {
+	switch state {
+	case elas.AwayArm:
+		return "AwayArmed"
+	case elas.PartialArm:
+		return "PartialArmed"
+	}
+	return "Disarmed"
+}
+
+// requestEnvelope is the SOAP envelope sent by clients.
+type requestEnvelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    struct {
+		Content []byte `xml:",innerxml"`
+	} `xml:"Body"`
+}
+
+// decodeRequest reads a request envelope and decodes the operation it
+// wraps.
+func decodeRequest(r io.Reader) (elas.Request, error) {
+	var envelope requestEnvelope
+	if err := xml.NewDecoder(r).Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("could not decode soap envelope: %v", err)
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(envelope.Body.Content))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("could not decode soap body: %v", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		var req elas.Request
+		switch start.Name.Local {
+		case "GetCPState":
+			req = &elas.GetCPState{}
+		case "CPPartArm":
+			req = &elas.CPPartArm{}
+		case "CPZoneBypass":
+			req = &elas.CPZoneBypass{}
+		case "SetCPUser":
+			req = &elas.SetCPUser{}
+		case "GetCPEventLogExWithPaging":
+			req = &elas.GetCPEventLogExWithPaging{}
+		default:
+			return nil, fmt.Errorf("unsupported operation %s", start.Name.Local)
+		}
+		if err := decoder.DecodeElement(req, &start); err != nil {
+			return nil, fmt.Errorf("could not decode %s request: %v", start.Name.Local, err)
+		}
+		return req, nil
+	}
+}
+
+// responseEnvelope is the SOAP envelope sent back by the panel.
+type responseEnvelope struct {
+	XMLName xml.Name `xml:"soap:Envelope"`
+	Soap    string   `xml:"xmlns:soap,attr"`
+	XSI     string   `xml:"xmlns:i,attr"`
+	XSD     string   `xml:"xmlns:d,attr"`
+	Body    struct {
+		Content interface{}
+	} `xml:"soap:Body"`
+}
+
+// response is the reply to an operation, which the panel puts in its
+// namespace.
+type response struct {
+	Operation string
+	Content   interface{}
+}
+
+func (r *response) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(r.Content, xml.StartElement{
+		Name: xml.Name{Space: elas.Namespace, Local: r.Operation + "Response"},
+	})
+}
+
+// writeFault answers with a fault, which the panel sends with an error
+// status.
+func writeFault(w http.ResponseWriter, fault *elas.Fault) {
+	writeEnvelope(w, http.StatusInternalServerError, &struct {
+		XMLName xml.Name `xml:"soap:Fault"`
+		*elas.Fault
+	}{Fault: fault})
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, content interface{}) {
+	envelope := responseEnvelope{
+		Soap: "http://www.w3.org/2003/05/soap-envelope",
+		XSI:  "http://www.w3.org/2001/XMLSchema-instance",
+		XSD:  "http://www.w3.org/2001/XMLSchema",
+	}
+	envelope.Body.Content = content
+
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	if err := xml.NewEncoder(&body).Encode(envelope); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
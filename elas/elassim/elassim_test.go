@@ -0,0 +1,208 @@
+package elassim
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vitorarins/magic-island/elas"
+)
+
+var ctx = context.Background()
+
+func newServer(passCode, key string) (*httptest.Server, *Panel) {
+	panel := NewPanel(passCode, key)
+	return httptest.NewServer(panel), panel
+}
+
+func TestPanel(t *testing.T) {
+	t.Run("ReturnsState", func(t *testing.T) {
+		server, _ := newServer("1234", "key")
+		defer server.Close()
+
+		resp, err := elas.NewClient(server.URL, "key").GetCPState(ctx, &elas.GetCPState{PassCode: "1234"})
+
+		assert.Nil(t, err)
+		assert.Len(t, resp.Reply.Zones, 7)
+		assert.Equal(t, "Disarmed", resp.Reply.SysStat)
+		assert.Equal(t, []elas.Partition{
+			{ID: 0, ArmedState: elas.Disarm, ReadyState: elas.AwayReady, AlarmState: elas.NoAlarm},
+		}, resp.Reply.Partitions)
+	})
+
+	t.Run("ArmsOnlyWhenReady", func(t *testing.T) {
+		server, panel := newServer("1234", "key")
+		defer server.Close()
+		client := elas.NewClient(server.URL, "key")
+
+		assert.Nil(t, panel.SetZone(6, ZoneOpen))
+		_, err := client.CPPartArm(ctx, elas.NewCPPartArm("1234", 0, elas.AwayArm, elas.ArmOptions{}))
+		assert.Equal(t, &elas.ResultError{Operation: "CPPartArm", Code: elas.ASNotReady}, err)
+
+		_, err = client.CPZoneBypass(ctx, &elas.CPZoneBypass{PassCode: "1234", ZoneID: 6, Bypass: true})
+		assert.Nil(t, err)
+		_, err = client.CPPartArm(ctx, elas.NewCPPartArm("1234", 0, elas.AwayArm, elas.ArmOptions{ExitDelay: 30 * time.Second}))
+		assert.Nil(t, err)
+
+		reply := panel.Reply()
+		assert.Equal(t, "AwayArmed", reply.SysStat)
+		assert.Equal(t, elas.AwayArm, reply.Partitions[0].ArmedState)
+		assert.Equal(t, 30, reply.Partitions[0].ExitDelayTO)
+		assert.True(t, reply.Zones[6].Bypassed)
+	})
+
+	t.Run("ForceArmsWithOpenZones", func(t *testing.T) {
+		server, panel := newServer("1234", "key")
+		defer server.Close()
+
+		panel.SetZone(0, ZoneOpen)
+		_, err := elas.NewClient(server.URL, "key").CPPartArm(ctx, elas.NewCPPartArm("1234", 0, elas.PartialArm, elas.ArmOptions{Force: true}))
+
+		assert.Nil(t, err)
+		assert.Equal(t, elas.PartialArm, panel.Reply().Partitions[0].ArmedState)
+	})
+
+	t.Run("ReportsAlarms", func(t *testing.T) {
+		server, panel := newServer("1234", "key")
+		defer server.Close()
+
+		panel.SetAlarm(0, "Burglary")
+		resp, err := elas.NewClient(server.URL, "key").GetCPState(ctx, &elas.GetCPState{PassCode: "1234"})
+
+		assert.Nil(t, err)
+		assert.True(t, resp.Reply.BellOn)
+		assert.Equal(t, elas.AlarmState("Burglary"), resp.Reply.Partitions[0].AlarmState)
+	})
+
+	t.Run("PagesEventLog", func(t *testing.T) {
+		server, panel := newServer("1234", "key")
+		defer server.Close()
+
+		start := time.Date(2019, 8, 2, 0, 0, 0, 0, time.UTC)
+		now := start
+		panel.now = func() time.Time {
+			now = now.Add(time.Minute)
+			return now
+		}
+		for i := 0; i < 3; i++ {
+			panel.SetZone(0, ZoneOpen)
+			panel.SetZone(0, ZoneClosed)
+		}
+
+		resp, err := elas.NewClient(server.URL, "key").GetCPEventLogExWithPaging(ctx, &elas.GetCPEventLogExWithPaging{
+			PassCode:  "1234",
+			LangID:    "en-us",
+			NewerThan: start.Add(time.Minute),
+			Offset:    1,
+			Count:     2,
+		})
+
+		assert.Nil(t, err)
+		assert.Len(t, resp.Events, 2)
+		assert.Equal(t, start.Add(3*time.Minute), resp.Events[0].Time.UTC())
+		assert.Equal(t, "ZoneOpen", resp.Events[0].EventType)
+		assert.Equal(t, "1 Voordeur", resp.Events[0].Zone)
+	})
+
+	t.Run("ChangesUsers", func(t *testing.T) {
+		server, panel := newServer("1234", "key")
+		defer server.Close()
+		client := elas.NewClient(server.URL, "key")
+
+		_, err := client.SetCPUser(ctx, &elas.SetCPUser{
+			PassCode: "1234",
+			User:     elas.User{ID: 3, Name: "Schoonmaker", UserType: "GRAND_08", PassCode: "5678", PartAssociationCSV: "0"},
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, elas.User{ID: 3, Name: "Schoonmaker", UserType: "GRAND_08", PassCode: "5678", Part: "F", PartAssociationCSV: "0"}, panel.Reply().Users[3])
+
+		_, err = client.SetCPUser(ctx, &elas.SetCPUser{PassCode: "1234", User: elas.User{ID: 3, UserType: elas.UnusedUserType}})
+		assert.Nil(t, err)
+		assert.Equal(t, elas.User{ID: 3, UserType: elas.UnusedUserType, Part: "No"}, panel.Reply().Users[3])
+
+		_, err = client.SetCPUser(ctx, &elas.SetCPUser{PassCode: "1234", User: elas.User{ID: 40, UserType: elas.UnusedUserType}})
+		assert.Equal(t, &elas.Fault{Code: "soap:Sender", Reason: "unknown user 40"}, err)
+	})
+
+	t.Run("RefusesWrongPassCode", func(t *testing.T) {
+		server, _ := newServer("1234", "key")
+		defer server.Close()
+
+		_, err := elas.NewClient(server.URL, "key").GetCPState(ctx, &elas.GetCPState{PassCode: "0000"})
+
+		assert.Equal(t, &elas.ResultError{Operation: "GetCPState", Code: elas.ASInvalidPassCode}, err)
+	})
+
+	t.Run("RefusesWrongKey", func(t *testing.T) {
+		server, _ := newServer("1234", "key")
+		defer server.Close()
+
+		_, err := elas.NewClient(server.URL, "other").GetCPState(ctx, &elas.GetCPState{PassCode: "1234"})
+
+		assert.EqualError(t, err, "unexpected status for GetCPState request: 401 Unauthorized")
+	})
+
+	t.Run("ReturnsScriptedFailures", func(t *testing.T) {
+		server, panel := newServer("1234", "key")
+		defer server.Close()
+		client := elas.NewClient(server.URL, "key")
+
+		panel.SetResult("GetCPState", elas.ASPanelBusy)
+		_, err := client.GetCPState(ctx, &elas.GetCPState{PassCode: "1234"})
+		assert.Equal(t, &elas.ResultError{Operation: "GetCPState", Code: elas.ASPanelBusy}, err)
+
+		panel.SetFault("GetCPState", &elas.Fault{Code: "soap:Receiver", Reason: "Server was unable to process request."})
+		_, err = client.GetCPState(ctx, &elas.GetCPState{PassCode: "1234"})
+		assert.Equal(t, &elas.Fault{Code: "soap:Receiver", Reason: "Server was unable to process request."}, err)
+
+		panel.SetResult("GetCPState", elas.ASNoError)
+		panel.SetFault("GetCPState", nil)
+		_, err = client.GetCPState(ctx, &elas.GetCPState{PassCode: "1234"})
+		assert.Nil(t, err)
+	})
+}
+
+func TestPanelInMemory(t *testing.T) {
+	panel := NewPanel("1234", "key")
+
+	panel.SetZone(2, ZoneOpen)
+	err := panel.Arm(ctx, 0, elas.AwayArm, elas.ArmOptions{})
+	assert.Equal(t, &elas.ResultError{Operation: "CPPartArm", Code: elas.ASNotReady}, err)
+
+	assert.Nil(t, panel.Bypass(ctx, 2, true))
+	assert.Nil(t, panel.Arm(ctx, 0, elas.AwayArm, elas.ArmOptions{}))
+
+	reply, err := panel.State(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, elas.AwayArm, reply.Partitions[0].ArmedState)
+
+	events, err := panel.Events(ctx, time.Time{}, 0, 10)
+	assert.Nil(t, err)
+	assert.Len(t, events, 3)
+
+	panel.SetResult("GetCPState", elas.ASPanelBusy)
+	_, err = panel.State(ctx)
+	assert.Equal(t, &elas.ResultError{Operation: "GetCPState", Code: elas.ASPanelBusy}, err)
+	assert.Equal(t, 2, panel.Calls("GetCPState"))
+}
+
+func TestPanelUserPassCode(t *testing.T) {
+	panel := NewPanel("1234", "key")
+	assert.Nil(t, panel.SetUser(ctx, elas.User{ID: 3, Name: "Schoonmaker", UserType: "GRAND_08", PassCode: "5678", PartAssociationCSV: "0"}))
+
+	err := panel.Arm(elas.WithPassCode(ctx, "0000"), 0, elas.AwayArm, elas.ArmOptions{})
+	assert.Equal(t, &elas.ResultError{Operation: "CPPartArm", Code: elas.ASInvalidPassCode}, err)
+
+	assert.Nil(t, panel.Arm(elas.WithPassCode(ctx, "5678"), 0, elas.AwayArm, elas.ArmOptions{}))
+	assert.Nil(t, panel.Arm(ctx, 0, elas.Disarm, elas.ArmOptions{}))
+
+	events, err := panel.Events(ctx, time.Time{}, 0, 10)
+	assert.Nil(t, err)
+	assert.Len(t, events, 3)
+	assert.Equal(t, "AwayArm", events[1].EventType)
+	assert.Equal(t, "Schoonmaker", events[1].User)
+	assert.Equal(t, "Gebruiker 00", events[2].User)
+}
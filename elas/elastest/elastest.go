@@ -0,0 +1,21 @@
+// Package elastest serves simulated ELAS panels for tests.
+package elastest
+
+import (
+	"net/http/httptest"
+
+	"github.com/vitorarins/magic-island/elas/elassim"
+)
+
+// Zone statuses reported by the panel.
+const (
+	ZoneOpen   = elassim.ZoneOpen
+	ZoneClosed = elassim.ZoneClosed
+)
+
+// NewServer starts a server for a new simulated panel. The caller must
+// close it when done, as with httptest.NewServer.
+func NewServer(passCode, key string) (*httptest.Server, *elassim.Panel) {
+	panel := elassim.NewPanel(passCode, key)
+	return httptest.NewServer(panel), panel
+}
@@ -0,0 +1,21 @@
+package elas
+
+import "context"
+
+type passCodeKey struct{}
+
+// WithPassCode returns a copy of ctx carrying the pass code of the user on
+// whose behalf commands are sent, so the panel event log attributes them to
+// that user.
+func WithPassCode(ctx context.Context, passCode string) context.Context {
+	return context.WithValue(ctx, passCodeKey{}, passCode)
+}
+
+// PassCode returns the pass code carried by ctx, or fallback when there is
+// none.
+func PassCode(ctx context.Context, fallback string) string {
+	if passCode, ok := ctx.Value(passCodeKey{}).(string); ok && passCode != "" {
+		return passCode
+	}
+	return fallback
+}
@@ -0,0 +1,180 @@
+package elas
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrPanelUnreachable is returned without contacting the panel while the
+// circuit breaker of the client is open.
+var ErrPanelUnreachable = errors.New("panel unreachable")
+
+// Temporary tells whether err is a failure that may go away when the
+// request is sent again, such as a timeout, a refused or reset connection
+// or a busy panel. Cancelled requests and other network errors, like
+// certificate or DNS failures, are not temporary.
+func Temporary(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	// timeouts of the HTTP client are deadline errors too, only the ones
+	// of the caller, left bare, are not temporary
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && error(netErr) != context.DeadlineExceeded {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500
+	}
+
+	var fault *Fault
+	if errors.As(err, &fault) {
+		return fault.Code == "soap:Receiver"
+	}
+
+	var resultErr *ResultError
+	if errors.As(err, &resultErr) {
+		switch resultErr.Code {
+		case ASPanelNotConnected, ASPanelBusy, ASCommunicationFailed:
+			return true
+		}
+	}
+
+	return false
+}
+
+// Backoff is the policy used to retry idempotent requests. The zero value
+// sends requests once.
+type Backoff struct {
+	// Attempts is the maximum number of times a request is sent.
+	Attempts int
+	// Initial is the delay before the first retry. It doubles on every
+	// retry, up to Max, and a random jitter of up to half of it is removed.
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// do calls fn until it succeeds, fails with an error that is not
+// temporary, runs out of attempts or ctx is done.
+func (b Backoff) do(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !Temporary(err) || attempt >= b.Attempts {
+			return err
+		}
+
+		timer := time.NewTimer(b.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// delay returns the time to wait before the given retry.
+func (b Backoff) delay(retry int) time.Duration {
+	delay := b.Initial
+	for i := 1; i < retry && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+	if half := int64(delay / 2); half > 0 {
+		delay -= time.Duration(rand.Int63n(half))
+	}
+	return delay
+}
+
+// Breaker stops requests to a panel that keeps failing. After threshold
+// consecutive temporary failures it opens and requests fail with
+// ErrPanelUnreachable. Once cooldown has passed a single request is let
+// through, closing the breaker again when it succeeds.
+//
+// A nil *Breaker lets every request through. A Breaker is safe for
+// concurrent use and is meant to be shared by the clients of a panel.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// NewBreaker returns a closed breaker.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Open tells whether requests are currently refused.
+func (b *Breaker) Open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.failures >= b.threshold && (b.probing || b.now().Before(b.openUntil))
+}
+
+// allow tells whether a request can be sent.
+func (b *Breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record updates the breaker with the outcome of a request. Errors that
+// are not temporary show the panel is reachable, but they neither close
+// the breaker nor count as failures.
+func (b *Breaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case err == nil:
+		b.failures = 0
+	case Temporary(err):
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openUntil = b.now().Add(b.cooldown)
+		}
+	}
+	b.probing = false
+}
@@ -0,0 +1,217 @@
+package elas
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemporary(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: urlError(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), want: true},
+		{err: urlError(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), want: true},
+		{err: urlError(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "i/o timeout", Name: "panel", IsTimeout: true}}), want: true},
+		{err: urlError(&timeoutError{}), want: true},
+		{err: urlError(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "panel", IsNotFound: true}}), want: false},
+		{err: urlError(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), want: false},
+		{err: urlError(context.Canceled), want: false},
+		{err: fmt.Errorf("abandoned GetCPState request: %w", context.DeadlineExceeded), want: false},
+		{err: &StatusError{Operation: "GetCPState", Status: "503 Service Unavailable", Code: 503}, want: true},
+		{err: &StatusError{Operation: "GetCPState", Status: "401 Unauthorized", Code: 401}, want: false},
+		{err: &Fault{Code: "soap:Receiver"}, want: true},
+		{err: &Fault{Code: "soap:Sender"}, want: false},
+		{err: &ResultError{Operation: "GetCPState", Code: ASPanelBusy}, want: true},
+		{err: &ResultError{Operation: "GetCPState", Code: ASInvalidPassCode}, want: false},
+		{err: ErrPanelUnreachable, want: false},
+	}
+
+	for _, test := range tests {
+		if got := Temporary(test.err); got != test.want {
+			t.Errorf("unexpected result for %v: got (%v) want (%v)", test.err, got, test.want)
+		}
+	}
+}
+
+// urlError wraps err like the HTTP client does.
+func urlError(err error) error {
+	return fmt.Errorf("could not execute GetCPState request: %w", &url.Error{Op: "Post", URL: "https://panel", Err: err})
+}
+
+// timeoutError is the error of a request timed out by the HTTP client,
+// which is a deadline error as well.
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "Client.Timeout exceeded while awaiting headers" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+func (e *timeoutError) Is(err error) bool {
+	return err == context.DeadlineExceeded
+}
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{Attempts: 5, Initial: 100 * time.Millisecond, Max: time.Second}
+
+	tests := []struct {
+		retry int
+		max   time.Duration
+	}{
+		{retry: 1, max: 100 * time.Millisecond},
+		{retry: 2, max: 200 * time.Millisecond},
+		{retry: 3, max: 400 * time.Millisecond},
+		{retry: 5, max: time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 10; i++ {
+			delay := backoff.delay(test.retry)
+			if delay > test.max || delay <= test.max/2 {
+				t.Errorf("unexpected delay for retry %v: got (%v) want in (%v, %v]", test.retry, delay, test.max/2, test.max)
+			}
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2019, 8, 2, 0, 0, 0, 0, time.UTC)
+	breaker := NewBreaker(2, time.Minute)
+	breaker.now = func() time.Time { return now }
+	busy := &ResultError{Operation: "GetCPState", Code: ASPanelBusy}
+
+	assert.True(t, breaker.allow())
+	breaker.record(busy)
+	assert.False(t, breaker.Open())
+	assert.True(t, breaker.allow())
+	breaker.record(busy)
+	assert.True(t, breaker.Open())
+	assert.False(t, breaker.allow())
+
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.allow(), "a probe is let through after the cooldown")
+	assert.False(t, breaker.allow(), "only a single probe is let through")
+	breaker.record(busy)
+	assert.True(t, breaker.Open())
+
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.allow())
+	breaker.record(nil)
+	assert.False(t, breaker.Open())
+	assert.True(t, breaker.allow())
+}
+
+// newFlakyServer replies with a fault to the first failures requests and
+// with file afterwards.
+func newFlakyServer(t *testing.T, failures int, file string) (*httptest.Server, *int) {
+	fault, err := ioutil.ReadFile("testdata/fault.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(fault)
+			return
+		}
+		w.Write(body)
+	}))
+	return server, &calls
+}
+
+func TestClientRetry(t *testing.T) {
+	backoff := Backoff{Attempts: 3, Initial: time.Millisecond, Max: time.Millisecond}
+
+	t.Run("RetriesReads", func(t *testing.T) {
+		server, calls := newFlakyServer(t, 2, "testdata/detectors.xml")
+		defer server.Close()
+
+		client := NewClient(server.URL, "key")
+		client.Retry = backoff
+		resp, err := client.GetCPState(ctx, &GetCPState{PassCode: "1234"})
+
+		assert.Nil(t, err)
+		assert.Len(t, resp.Reply.Zones, 7)
+		assert.Equal(t, 3, *calls)
+	})
+
+	t.Run("GivesUpAfterAttempts", func(t *testing.T) {
+		server, calls := newFlakyServer(t, 5, "testdata/detectors.xml")
+		defer server.Close()
+
+		client := NewClient(server.URL, "key")
+		client.Retry = backoff
+		_, err := client.GetCPState(ctx, &GetCPState{PassCode: "1234"})
+
+		_, ok := err.(*Fault)
+		assert.True(t, ok, "unexpected error: %v", err)
+		assert.Equal(t, 3, *calls)
+	})
+
+	t.Run("NeverRetriesCommands", func(t *testing.T) {
+		server, calls := newFlakyServer(t, 1, "testdata/cp-part-arm.xml")
+		defer server.Close()
+
+		client := NewClient(server.URL, "key")
+		client.Retry = backoff
+		_, err := client.CPPartArm(ctx, NewCPPartArm("1234", 0, AwayArm, ArmOptions{}))
+
+		assert.NotNil(t, err)
+		assert.Equal(t, 1, *calls)
+	})
+
+	t.Run("StopsWhenBreakerOpens", func(t *testing.T) {
+		server, calls := newFlakyServer(t, 5, "testdata/detectors.xml")
+		defer server.Close()
+
+		client := NewClient(server.URL, "key")
+		client.Retry = backoff
+		client.Breaker = NewBreaker(2, time.Minute)
+		_, err := client.GetCPState(ctx, &GetCPState{PassCode: "1234"})
+		assert.Equal(t, ErrPanelUnreachable, err)
+		_, err = client.GetCPState(ctx, &GetCPState{PassCode: "1234"})
+		assert.Equal(t, ErrPanelUnreachable, err)
+
+		assert.Equal(t, 2, *calls)
+	})
+
+	t.Run("IgnoresRequestsAbandonedByCaller", func(t *testing.T) {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer server.Close()
+		defer close(release)
+
+		client := NewClient(server.URL, "key")
+		client.Retry = backoff
+		client.Breaker = NewBreaker(1, time.Minute)
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err := client.GetCPState(ctx, &GetCPState{PassCode: "1234"})
+
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+		assert.False(t, Temporary(err))
+		assert.False(t, client.Breaker.Open())
+	})
+}
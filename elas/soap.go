@@ -0,0 +1,103 @@
+package elas
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+const (
+	soapEnvelopeNamespace = "http://www.w3.org/2003/05/soap-envelope"
+	soapEncodingNamespace = "http://www.w3.org/2003/05/soap-encoding"
+	xsiNamespace          = "http://www.w3.org/2001/XMLSchema-instance"
+	xsdNamespace          = "http://www.w3.org/2001/XMLSchema"
+)
+
+// requestEnvelope is the SOAP envelope wrapping requests. The prefixes are
+// spelled out because the panel only accepts the layout its own app sends.
+type requestEnvelope struct {
+	XMLName xml.Name    `xml:"v:Envelope"`
+	XSI     string      `xml:"xmlns:i,attr"`
+	XSD     string      `xml:"xmlns:d,attr"`
+	Enc     string      `xml:"xmlns:c,attr"`
+	Env     string      `xml:"xmlns:v,attr"`
+	Header  struct{}    `xml:"v:Header"`
+	Body    requestBody `xml:"v:Body"`
+}
+
+type requestBody struct {
+	Request Request
+}
+
+func (b requestBody) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	operation := xml.StartElement{
+		Name: xml.Name{Space: Namespace, Local: b.Request.Operation()},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "id"}, Value: "o0"},
+			{Name: xml.Name{Local: "c:root"}, Value: "1"},
+		},
+	}
+	if err := e.EncodeElement(b.Request, operation); err != nil {
+		return err
+	}
+	return e.EncodeToken(start.End())
+}
+
+func newRequestEnvelope(req Request) *requestEnvelope {
+	return &requestEnvelope{
+		XSI:  xsiNamespace,
+		XSD:  xsdNamespace,
+		Enc:  soapEncodingNamespace,
+		Env:  soapEnvelopeNamespace,
+		Body: requestBody{Request: req},
+	}
+}
+
+// responseEnvelope is the SOAP envelope wrapping replies and faults.
+type responseEnvelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    struct {
+		Fault   *Fault `xml:"Fault"`
+		Content []byte `xml:",innerxml"`
+	} `xml:"Body"`
+}
+
+// Fault is a SOAP 1.2 fault returned by the panel. It is returned as an
+// error by the client.
+type Fault struct {
+	Code    string `xml:"Code>Value"`
+	Subcode string `xml:"Code>Subcode>Value"`
+	Reason  string `xml:"Reason>Text"`
+	Detail  string `xml:"Detail"`
+}
+
+func (f *Fault) Error() string {
+	if f.Subcode != "" {
+		return fmt.Sprintf("soap fault %s (%s): %s", f.Code, f.Subcode, f.Reason)
+	}
+	return fmt.Sprintf("soap fault %s: %s", f.Code, f.Reason)
+}
+
+// encodeEnvelope writes req wrapped in a SOAP envelope to w.
+func encodeEnvelope(w io.Writer, req Request) error {
+	return xml.NewEncoder(w).Encode(newRequestEnvelope(req))
+}
+
+// decodeEnvelope reads a SOAP envelope from r and decodes its body into resp.
+// A fault inside the body is returned as a *Fault.
+func decodeEnvelope(r io.Reader, resp interface{}) error {
+	var envelope responseEnvelope
+	if err := xml.NewDecoder(r).Decode(&envelope); err != nil {
+		return fmt.Errorf("could not decode soap envelope: %v", err)
+	}
+	if envelope.Body.Fault != nil {
+		return envelope.Body.Fault
+	}
+	if err := xml.Unmarshal(envelope.Body.Content, resp); err != nil {
+		return fmt.Errorf("could not decode soap body: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package elas
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeEnvelope(t *testing.T) {
+	tests := []struct {
+		golden  string
+		request Request
+	}{
+		{
+			golden:  "testdata/get-cp-state.xml",
+			request: &GetCPState{PassCode: "1234"},
+		},
+		{
+			golden:  "testdata/arm.xml",
+			request: NewCPPartArm("1234", 0, AwayArm, ArmOptions{}),
+		},
+		{
+			golden:  "testdata/arm-partition-1.xml",
+			request: NewCPPartArm("1234", 1, AwayArm, ArmOptions{}),
+		},
+		{
+			golden:  "testdata/arm-force-exit-delay.xml",
+			request: NewCPPartArm("1234", 0, AwayArm, ArmOptions{ExitDelay: 45 * time.Second, Force: true}),
+		},
+		{
+			golden:  "testdata/partarm.xml",
+			request: NewCPPartArm("1234", 0, PartialArm, ArmOptions{}),
+		},
+		{
+			golden:  "testdata/disarm.xml",
+			request: NewCPPartArm("1234", 0, Disarm, ArmOptions{}),
+		},
+		{
+			golden:  "testdata/bypass.xml",
+			request: &CPZoneBypass{PassCode: "1234", ZoneID: 6, Bypass: true},
+		},
+		{
+			golden: "testdata/set-cp-user.xml",
+			request: &SetCPUser{
+				PassCode: "1234",
+				User:     User{ID: 3, Name: "Schoonmaker", UserType: "GRAND_08", PassCode: "5678", Part: "F", PartAssociationCSV: "0"},
+			},
+		},
+		{
+			golden: "testdata/get-cp-event-log.xml",
+			request: &GetCPEventLogExWithPaging{
+				PassCode:  "1234",
+				LangID:    "en-us",
+				NewerThan: time.Date(2019, 8, 1, 22, 30, 0, 0, time.UTC),
+				Offset:    0,
+				Count:     100,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		want, err := ioutil.ReadFile(test.golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got bytes.Buffer
+		encoder := xml.NewEncoder(&got)
+		encoder.Indent("", "  ")
+		if err := encoder.Encode(newRequestEnvelope(test.request)); err != nil {
+			t.Fatalf("unexpected error encoding %v: %v", test.golden, err)
+		}
+
+		assert.Equal(t, strings.TrimSpace(string(want)), got.String(), test.golden)
+	}
+}
+
+func TestDecodeEnvelope(t *testing.T) {
+	t.Run("ReturnsZonesIfXMLIsValid", func(t *testing.T) {
+		xmlFile, err := os.Open("testdata/detectors.xml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer xmlFile.Close()
+
+		var resp GetCPStateResponse
+		err = decodeEnvelope(xmlFile, &resp)
+		assert.Nil(t, err)
+
+		assert.Equal(t, ASNoError, resp.Result)
+		assert.Equal(t, time.Date(2019, 7, 28, 0, 20, 48, 529032300, time.UTC), resp.CPTime.UTC())
+		assert.False(t, resp.PartReadySupported)
+
+		got := resp.Reply.Zones
+		assert.Len(t, got, 7)
+		names := []string{"1 Voordeur", "2 Meterkast", "3 Hal Pir", "4 Hal Rook", "5 Woonkamer Pir", "6 Keukendeur", "7 Balkondeur"}
+		for i, name := range names {
+			assert.Equal(t, int64(i), got[i].Id)
+			assert.Equal(t, name, got[i].Name)
+			assert.Equal(t, "Off", got[i].Status)
+			assert.Equal(t, "Unknown", got[i].ZoneType)
+			assert.False(t, got[i].Trouble)
+			assert.Equal(t, "F", got[i].Part)
+			assert.Equal(t, []int{0}, got[i].Partitions())
+			assert.Equal(t, 2, got[i].RegDevSN)
+		}
+
+		users := resp.Reply.Users
+		assert.Len(t, users, 32)
+		assert.Equal(t, User{ID: 0, Name: "Gebruiker 00", UserType: "GRAND_08", Part: "F", PartAssociationCSV: "0"}, users[0])
+		assert.Equal(t, User{ID: 1, UserType: "UserTypeNotSet", Part: "No"}, users[1])
+		assert.Nil(t, users[1].Partitions())
+		assert.Equal(t, "DURESS_0D", users[31].UserType)
+
+		assert.Equal(t, "Disarmed", resp.Reply.SysStat)
+		assert.True(t, resp.Reply.SystemReady)
+		assert.False(t, resp.Reply.Trouble)
+		assert.False(t, resp.Reply.BatLow)
+		assert.False(t, resp.Reply.AcLost)
+		assert.False(t, resp.Reply.ArmNotAllowed)
+		assert.Equal(t, []DevCollection{
+			{DevType: 21, Devices: []Device{{Num: 0, Desc: "Het Alarmsysteem"}}},
+			{DevType: 1000, Devices: []Device{{Num: 0, Desc: "22400428070"}}},
+		}, resp.Reply.DevCollection)
+
+		assert.Equal(t, []Partition{
+			{ID: 0, ArmedState: Disarm, ReadyState: AwayReady, AlarmState: NoAlarm},
+		}, resp.Reply.Partitions)
+	})
+
+	t.Run("ReturnsFaultIfBodyHasFault", func(t *testing.T) {
+		xmlFile, err := os.Open("testdata/fault.xml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer xmlFile.Close()
+
+		var resp GetCPStateResponse
+		err = decodeEnvelope(xmlFile, &resp)
+
+		fault, ok := err.(*Fault)
+		if !ok {
+			t.Fatalf("unexpected error: got (%v) want a *Fault", err)
+		}
+		assert.Equal(t, "soap:Receiver", fault.Code)
+		assert.Equal(t, "Server was unable to process request. ---> Object reference not set to an instance of an object.", fault.Reason)
+	})
+
+	t.Run("ReturnsErrorIfXMLIsEmpty", func(t *testing.T) {
+		var resp GetCPStateResponse
+		err := decodeEnvelope(strings.NewReader(""), &resp)
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorIfBodyIsUnexpected", func(t *testing.T) {
+		xmlFile, err := os.Open("testdata/cp-part-arm.xml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer xmlFile.Close()
+
+		var resp GetCPStateResponse
+		err = decodeEnvelope(xmlFile, &resp)
+
+		assert.NotNil(t, err)
+	})
+}
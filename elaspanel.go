@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/vitorarins/magic-island/elas"
+	"github.com/vitorarins/magic-island/elas/elassim"
+)
+
+// elasBackend sends ELAS operations to a panel, the real web service or a
+// simulated panel. Commands are sent with the pass code set on ctx with
+// elas.WithPassCode.
+type elasBackend interface {
+	State(ctx context.Context) (*elas.ECReply, error)
+	Arm(ctx context.Context, partition int, state elas.ArmedState, options elas.ArmOptions) error
+	Bypass(ctx context.Context, zone int64, bypass bool) error
+	Events(ctx context.Context, newerThan time.Time, offset, count int) ([]elas.Event, error)
+	SetUser(ctx context.Context, user elas.User) error
+}
+
+// elasPanel drives a panel that speaks ELAS. It translates between the
+// types of the app and those of ELAS, so no ELAS type leaves this file.
+type elasPanel struct {
+	backend elasBackend
+}
+
+// NewELASPanel returns a panel driven through the ELAS SOAP web service.
+// Its HTTP client is shared by every request, so connections are kept alive
+// between polls.
+func NewELASPanel(feenstraPassCode, feenstraKey, feenstraUrl string) AlarmPanel {
+	return &elasPanel{backend: &elasService{
+		FeenstraPassCode: feenstraPassCode,
+		FeenstraKey:      feenstraKey,
+		FeenstraUrl:      feenstraUrl,
+		FeenstraRetry:    elas.Backoff{Attempts: 3, Initial: 500 * time.Millisecond, Max: 5 * time.Second},
+		FeenstraBreaker:  elas.NewBreaker(5, 30*time.Second),
+		FeenstraHTTP: &http.Client{
+			Transport: &timedTransport{base: elas.NewTransport(), histogram: feenstraLatency},
+			Timeout:   feenstraTimeout,
+		},
+	}}
+}
+
+// NewSimulatedPanel returns a panel simulated in memory, which accepts
+// passCode.
+func NewSimulatedPanel(passCode, key string) AlarmPanel {
+	return &elasPanel{backend: elassim.NewPanel(passCode, key)}
+}
+
+// State reads the current state of the panel.
+func (p *elasPanel) State(ctx context.Context) (*PanelReading, error) {
+	reply, err := p.backend.State(p.context(ctx))
+	if err != nil {
+		return nil, panelError(err)
+	}
+
+	return newPanelReading(reply), nil
+}
+
+// Arm sets a partition of the panel to the given armed state.
+func (p *elasPanel) Arm(ctx context.Context, partition int, state ArmedState, options ArmOptions) error {
+	return panelError(p.backend.Arm(p.context(ctx), partition, elas.ArmedState(state), elas.ArmOptions{
+		ExitDelay: options.ExitDelay,
+		Force:     options.Force,
+	}))
+}
+
+// Bypass bypasses a zone of the panel, or restores it.
+func (p *elasPanel) Bypass(ctx context.Context, zone int64, bypass bool) error {
+	return panelError(p.backend.Bypass(p.context(ctx), zone, bypass))
+}
+
+// Events reads a page of the panel event log.
+func (p *elasPanel) Events(ctx context.Context, newerThan time.Time, offset, count int) ([]PanelEvent, error) {
+	events, err := p.backend.Events(p.context(ctx), newerThan, offset, count)
+	if err != nil {
+		return nil, panelError(err)
+	}
+
+	panelEvents := make([]PanelEvent, 0, len(events))
+	for _, event := range events {
+		panelEvents = append(panelEvents, PanelEvent{
+			Time:      event.Time.Time,
+			EventType: event.EventType,
+			User:      event.User,
+			Zone:      event.Zone,
+		})
+	}
+
+	return panelEvents, nil
+}
+
+// SetUser replaces a user slot of the panel.
+func (p *elasPanel) SetUser(ctx context.Context, user PanelUser) error {
+	return panelError(p.backend.SetUser(p.context(ctx), elas.User{
+		ID:                 user.ID,
+		Name:               user.Name,
+		UserType:           user.Type,
+		PassCode:           user.PassCode,
+		Part:               user.Part,
+		PartAssociationCSV: elas.PartitionCSV(user.Partitions),
+	}))
+}
+
+// context hands the pass code carried by ctx over to the backend.
+func (p *elasPanel) context(ctx context.Context) context.Context {
+	return elas.WithPassCode(ctx, PassCode(ctx, ""))
+}
+
+func newPanelReading(reply *elas.ECReply) *PanelReading {
+	reading := &PanelReading{
+		SystemStatus:     reply.SysStat,
+		SystemReady:      reply.SystemReady,
+		Trouble:          reply.Trouble,
+		AlarmPending:     reply.AlmPend,
+		BatteryLow:       reply.BatLow,
+		ACLost:           reply.AcLost,
+		BellOn:           reply.BellOn,
+		ArmNotAllowed:    reply.ArmNotAllowed,
+		DisarmNotAllowed: reply.DisarmNotAllowed,
+	}
+
+	for _, part := range reply.Partitions {
+		reading.Partitions = append(reading.Partitions, Partition{
+			ID:         part.ID,
+			ArmedState: ArmedState(part.ArmedState),
+			ReadyState: ReadyState(part.ReadyState),
+			AlarmState: AlarmState(part.AlarmState),
+		})
+	}
+
+	for _, zone := range reply.Zones {
+		reading.Zones = append(reading.Zones, Zone{
+			ID:         zone.Id,
+			Name:       zone.Name,
+			Type:       zone.ZoneType,
+			Status:     zone.Status,
+			Trouble:    zone.Trouble,
+			Bypassed:   zone.Bypassed,
+			Part:       zone.Part,
+			Partitions: zone.Partitions(),
+			Device:     zone.RegDevSN,
+		})
+	}
+
+	for _, user := range reply.Users {
+		reading.Users = append(reading.Users, PanelUser{
+			ID:         user.ID,
+			Name:       user.Name,
+			Type:       user.UserType,
+			PassCode:   user.PassCode,
+			Part:       user.Part,
+			Partitions: user.Partitions(),
+		})
+	}
+
+	return reading
+}
+
+// refusalReasons maps the ELAS results to the reasons a panel refuses a
+// command.
+var refusalReasons = map[elas.ResultCode]string{
+	elas.ASInvalidPassCode:     InvalidPassCode,
+	elas.ASNotReady:            NotReady,
+	elas.ASArmNotAllowed:       ArmNotAllowed,
+	elas.ASDisarmNotAllowed:    DisarmNotAllowed,
+	elas.ASPanelNotConnected:   PanelNotAvailable,
+	elas.ASPanelBusy:           PanelNotAvailable,
+	elas.ASCommunicationFailed: PanelNotAvailable,
+}
+
+// panelError returns the error of the app for an ELAS error. Errors that
+// are not about the panel, such as transport errors, are returned as is.
+func panelError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, elas.ErrPanelUnreachable) {
+		return ErrPanelUnreachable
+	}
+
+	var resultErr *elas.ResultError
+	if errors.As(err, &resultErr) {
+		reason, ok := refusalReasons[resultErr.Code]
+		if !ok {
+			reason = string(resultErr.Code)
+		}
+		return &RefusedError{Operation: resultErr.Operation, Reason: reason}
+	}
+
+	return err
+}
+
+// feenstraTimeout is the timeout of a whole request to the panel, reading
+// the reply included.
+const feenstraTimeout = 30 * time.Second
+
+// elasService sends ELAS operations to the SOAP web service.
+type elasService struct {
+	FeenstraPassCode string
+	FeenstraKey      string
+	FeenstraUrl      string
+	FeenstraRetry    elas.Backoff
+	FeenstraBreaker  *elas.Breaker
+	FeenstraHTTP     *http.Client
+}
+
+// State reads the current state of the panel.
+func (s *elasService) State(ctx context.Context) (*elas.ECReply, error) {
+	resp, err := s.feenstraClient().GetCPState(ctx, &elas.GetCPState{PassCode: s.passCode(ctx)})
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp.Reply, nil
+}
+
+// Arm sets a partition of the panel to the given armed state. Arm commands
+// are not idempotent, so after a temporary failure the command is only sent
+// once more, and only if the panel shows it did not take effect.
+func (s *elasService) Arm(ctx context.Context, partition int, state elas.ArmedState, options elas.ArmOptions) error {
+	client := s.feenstraClient()
+	req := elas.NewCPPartArm(s.passCode(ctx), partition, state, options)
+
+	_, err := client.CPPartArm(ctx, req)
+	if err == nil || !elas.Temporary(err) {
+		return err
+	}
+
+	resp, stateErr := client.GetCPState(ctx, &elas.GetCPState{PassCode: s.passCode(ctx)})
+	if stateErr != nil {
+		return err
+	}
+	for _, part := range resp.Reply.Partitions {
+		if part.ID == partition && part.ArmedState == state {
+			return nil
+		}
+	}
+
+	log.Printf("Retrying to set partition %d to %s after: %v", partition, state, err)
+	_, err = client.CPPartArm(ctx, req)
+
+	return err
+}
+
+// Bypass bypasses a zone of the panel, or restores it.
+func (s *elasService) Bypass(ctx context.Context, zone int64, bypass bool) error {
+	_, err := s.feenstraClient().CPZoneBypass(ctx, &elas.CPZoneBypass{
+		PassCode: s.passCode(ctx),
+		ZoneID:   zone,
+		Bypass:   bypass,
+	})
+
+	return err
+}
+
+// Events reads a page of the panel event log.
+func (s *elasService) Events(ctx context.Context, newerThan time.Time, offset, count int) ([]elas.Event, error) {
+	resp, err := s.feenstraClient().GetCPEventLogExWithPaging(ctx, &elas.GetCPEventLogExWithPaging{
+		PassCode:  s.passCode(ctx),
+		LangID:    "en-us",
+		NewerThan: newerThan,
+		Offset:    offset,
+		Count:     count,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Events, nil
+}
+
+// SetUser replaces a user slot of the panel.
+func (s *elasService) SetUser(ctx context.Context, user elas.User) error {
+	_, err := s.feenstraClient().SetCPUser(ctx, &elas.SetCPUser{
+		PassCode: s.passCode(ctx),
+		User:     user,
+	})
+
+	return err
+}
+
+// passCode returns the code commands are sent with: the code of the user
+// carried by ctx, or the code of the app.
+func (s *elasService) passCode(ctx context.Context) string {
+	return elas.PassCode(ctx, s.FeenstraPassCode)
+}
+
+func (s *elasService) feenstraClient() *elas.Client {
+	client := elas.NewClient(s.FeenstraUrl, s.FeenstraKey)
+	client.HTTPClient = s.FeenstraHTTP
+	client.Retry = s.FeenstraRetry
+	client.Breaker = s.FeenstraBreaker
+
+	return client
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vitorarins/magic-island/elas"
+	"github.com/vitorarins/magic-island/elas/elassim"
+	"github.com/vitorarins/magic-island/elas/elastest"
+)
+
+func TestELASPanel(t *testing.T) {
+	server, fake := elastest.NewServer("1234", "key")
+	defer server.Close()
+
+	panel := NewELASPanel("1234", "key", server.URL)
+
+	reply, err := panel.State(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, reply.Zones, 7)
+	assert.Equal(t, "Off", reply.Zones[5].Status)
+
+	fake.SetZone(5, elastest.ZoneOpen)
+	reply, err = panel.State(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "On", reply.Zones[5].Status)
+
+	err = panel.Arm(ctx, 0, AwayArm, ArmOptions{})
+	assert.Equal(t, &RefusedError{Operation: "CPPartArm", Reason: NotReady}, err)
+
+	assert.Nil(t, panel.Bypass(ctx, 5, true))
+	assert.Nil(t, panel.Arm(ctx, 0, AwayArm, ArmOptions{}))
+	assert.Equal(t, elas.AwayArm, fake.Reply().Partitions[0].ArmedState)
+
+	events, err := panel.Events(ctx, time.Time{}, 0, 10)
+	assert.Nil(t, err)
+	var types []string
+	for _, event := range events {
+		types = append(types, event.EventType)
+	}
+	assert.Equal(t, []string{"ZoneOpen", "ZoneBypass", "AwayArm"}, types)
+}
+
+func TestELASPanelWithWrongPassCode(t *testing.T) {
+	server, _ := elastest.NewServer("1234", "key")
+	defer server.Close()
+
+	panel := NewELASPanel("0000", "key", server.URL)
+	_, err := panel.State(ctx)
+
+	assert.Equal(t, &RefusedError{Operation: "GetCPState", Reason: InvalidPassCode}, err)
+}
+
+func TestELASPanelWithUserPassCode(t *testing.T) {
+	server, fake := elastest.NewServer("1234", "key")
+	defer server.Close()
+
+	panel := NewELASPanel("1234", "key", server.URL)
+	assert.Nil(t, panel.SetUser(ctx, PanelUser{ID: 3, Name: "Schoonmaker", Type: "GRAND_08", PassCode: "5678", Partitions: []int{0}}))
+	assert.Nil(t, panel.Arm(WithPassCode(ctx, "5678"), 0, AwayArm, ArmOptions{}))
+
+	events, err := fake.Events(ctx, time.Time{}, 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, "AwayArm", events[len(events)-1].EventType)
+	assert.Equal(t, "Schoonmaker", events[len(events)-1].User)
+}
+
+func TestELASPanelReusesConnections(t *testing.T) {
+	fake := elassim.NewPanel("1234", "key")
+	server := httptest.NewUnstartedServer(fake)
+	connections := 0
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections++
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	panel := NewELASPanel("1234", "key", server.URL)
+	for i := 0; i < 3; i++ {
+		_, err := panel.State(ctx)
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, 1, connections)
+}
+
+func TestELASPanelArmRetry(t *testing.T) {
+	t.Run("RetriesOnceWhenNotApplied", func(t *testing.T) {
+		server, fake := elastest.NewServer("1234", "key")
+		defer server.Close()
+		fake.SetFault("CPPartArm", &elas.Fault{Code: "soap:Receiver", Reason: "Server was unable to process request."})
+
+		panel := NewELASPanel("1234", "key", server.URL)
+		err := panel.Arm(ctx, 0, AwayArm, ArmOptions{})
+
+		assert.NotNil(t, err)
+		assert.Equal(t, 2, fake.Calls("CPPartArm"))
+		assert.Equal(t, 1, fake.Calls("GetCPState"))
+	})
+
+	t.Run("NeverRetriesRefusedCommands", func(t *testing.T) {
+		server, fake := elastest.NewServer("1234", "key")
+		defer server.Close()
+		fake.SetZone(0, elastest.ZoneOpen)
+
+		panel := NewELASPanel("1234", "key", server.URL)
+		err := panel.Arm(ctx, 0, AwayArm, ArmOptions{})
+
+		assert.Equal(t, &RefusedError{Operation: "CPPartArm", Reason: NotReady}, err)
+		assert.Equal(t, 1, fake.Calls("CPPartArm"))
+		assert.Equal(t, 0, fake.Calls("GetCPState"))
+	})
+}
+
+func TestSimulatedPanel(t *testing.T) {
+	panel := NewSimulatedPanel("1234", "key")
+
+	assert.Nil(t, panel.SetUser(ctx, PanelUser{ID: 3, Name: "Schoonmaker", Type: "GRAND_08", PassCode: "5678", Partitions: []int{0, 1}}))
+	assert.Nil(t, panel.Arm(WithPassCode(ctx, "5678"), 0, PartialArm, ArmOptions{}))
+
+	reply, err := panel.State(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, PartialArm, reply.Partitions[0].ArmedState)
+	assert.Equal(t, PanelUser{ID: 3, Name: "Schoonmaker", Type: "GRAND_08", PassCode: "5678", Part: "F", Partitions: []int{0, 1}}, reply.Users[3])
+	assert.Equal(t, []int{0}, reply.Zones[0].Partitions)
+
+	events, err := panel.Events(ctx, time.Time{}, 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, "Schoonmaker", events[len(events)-1].User)
+
+	err = panel.Arm(WithPassCode(ctx, "0000"), 0, Disarm, ArmOptions{})
+	assert.Equal(t, &RefusedError{Operation: "CPPartArm", Reason: InvalidPassCode}, err)
+}
+
+func TestPanelError(t *testing.T) {
+	fault := &elas.Fault{Code: "soap:Receiver", Reason: "Server was unable to process request."}
+
+	assert.Nil(t, panelError(nil))
+	assert.Equal(t, ErrPanelUnreachable, panelError(fmt.Errorf("GetCPState: %w", elas.ErrPanelUnreachable)))
+	assert.Equal(t, &RefusedError{Operation: "CPPartArm", Reason: PanelNotAvailable}, panelError(&elas.ResultError{Operation: "CPPartArm", Code: elas.ASPanelBusy}))
+	assert.Equal(t, &RefusedError{Operation: "CPPartArm", Reason: "ASSomethingNew"}, panelError(&elas.ResultError{Operation: "CPPartArm", Code: "ASSomethingNew"}))
+	assert.Equal(t, fault, panelError(fault))
+}
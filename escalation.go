@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Maker events sent while the panel is in alarm. The escalated event is
+// meant to notify more contacts than the others.
+const (
+	alarmTriggeredEvent = "AlarmTriggered"
+	alarmReminderEvent  = "AlarmReminder"
+	alarmEscalatedEvent = "AlarmEscalated"
+	alarmClearedEvent   = "AlarmCleared"
+)
+
+// Alarm is the state of the notifications of an alarm. It is stored, so an
+// alarm acknowledged through any instance stops the notifications sent by
+// the instance polling the panel, and an instance taking over polling
+// resumes them.
+type Alarm struct {
+	Active       bool `json:"active" firestore:"active"`
+	Acknowledged bool `json:"acknowledged" firestore:"acknowledged"`
+	// ClearPending is set while the notification that the alarm ended
+	// failed to be sent.
+	ClearPending  bool      `json:"clearPending" firestore:"clearPending"`
+	LastNotified  time.Time `json:"lastNotified" firestore:"lastNotified"`
+	Notifications int       `json:"notifications" firestore:"notifications"`
+}
+
+// Escalation notifies about alarms until they are acknowledged. The first
+// notification is sent as soon as the alarm is seen, then a reminder is sent
+// every repeat interval and, after escalateAfter reminders, the alarm is
+// escalated on every interval instead.
+type Escalation struct {
+	requester      Requester
+	storer         Storer
+	repeatInterval time.Duration
+	escalateAfter  int
+	now            func() time.Time
+
+	// alarm is the stored alarm as last read by this instance, loaded
+	// tells whether it was read since Resume.
+	mu     sync.Mutex
+	alarm  Alarm
+	loaded bool
+}
+
+func NewEscalation(requester Requester, storer Storer, repeatInterval time.Duration, escalateAfter int) *Escalation {
+	return &Escalation{
+		requester:      requester,
+		storer:         storer,
+		repeatInterval: repeatInterval,
+		escalateAfter:  escalateAfter,
+		now:            time.Now,
+	}
+}
+
+// Resume makes the next update read the stored alarm again, as another
+// instance may have changed it while this one was not polling the panel.
+func (e *Escalation) Resume() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.loaded = false
+}
+
+// Update moves the workflow forward given whether the panel is in alarm.
+// It is called on every poll of the panel. The stored alarm is only read
+// while there is something to notify, so polls of a quiet panel do not
+// reach the storage.
+func (e *Escalation) Update(ctx context.Context, inAlarm bool) {
+	event := e.next(inAlarm)
+	if event == "" {
+		return
+	}
+
+	log.Printf("Alerting for alarm with event: %s", event)
+	if err := e.requester.RequestMaker(ctx, event); err != nil {
+		log.Printf("Got the following error trying to alert for alarm: %s", err)
+		e.retry(event)
+	}
+}
+
+// retry makes the next poll send a notification again, instead of waiting
+// for the repeat interval after a failed one. A failed first notification is
+// sent again as triggered rather than as a reminder, and a failed cleared
+// notification is sent again until it succeeds or a new alarm starts.
+func (e *Escalation) retry(event string) {
+	err := e.update(func(alarm *Alarm) bool {
+		if event == alarmClearedEvent {
+			alarm.ClearPending = true
+			return true
+		}
+		alarm.LastNotified = time.Time{}
+		if event == alarmTriggeredEvent {
+			alarm.Notifications = 0
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("Could not store the failed alarm notification %s, going on with the last alarm read: %v", event, err)
+	}
+}
+
+// next returns the notification to send, if any, and stores the alarm
+// as of sending it.
+func (e *Escalation) next(inAlarm bool) string {
+	if e.settled(inAlarm) {
+		return ""
+	}
+
+	now := e.now()
+	var event string
+	err := e.update(func(alarm *Alarm) bool {
+		event = e.nextEvent(alarm, inAlarm, now)
+		return event != ""
+	})
+	if err != nil {
+		log.Printf("Could not update the stored alarm, going on with the last alarm read: %v", err)
+	}
+
+	return event
+}
+
+// settled tells whether the alarm last read leaves nothing to notify, so
+// the stored alarm need not be read. Acknowledgements only matter during
+// alarms that are not acknowledged yet.
+func (e *Escalation) settled(inAlarm bool) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.loaded {
+		return false
+	}
+	if inAlarm {
+		return e.alarm.Active && e.alarm.Acknowledged
+	}
+	return !e.alarm.Active && !e.alarm.ClearPending
+}
+
+// update changes the stored alarm with change, which tells whether it
+// changed it, and keeps the alarm stored. When the storage fails, the alarm
+// last read is changed instead, so alarms are notified all the same.
+func (e *Escalation) update(change func(alarm *Alarm) bool) error {
+	var updated Alarm
+	err := e.storer.UpdateAlarm(func(alarm *Alarm) bool {
+		changed := change(alarm)
+		updated = *alarm
+		return changed
+	})
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err != nil {
+		change(&e.alarm)
+		return err
+	}
+	e.alarm = updated
+	e.loaded = true
+
+	return nil
+}
+
+// nextEvent moves alarm forward and returns the notification to send, or
+// an empty string when alarm is left as is.
+func (e *Escalation) nextEvent(alarm *Alarm, inAlarm bool, now time.Time) string {
+	switch {
+	case inAlarm && !alarm.Active:
+		alarm.Active = true
+		alarm.Acknowledged = false
+		alarm.ClearPending = false
+		alarm.LastNotified = now
+		alarm.Notifications = 1
+		return alarmTriggeredEvent
+	case inAlarm && !alarm.Acknowledged && now.Sub(alarm.LastNotified) >= e.repeatInterval:
+		alarm.LastNotified = now
+		alarm.Notifications++
+		if alarm.Notifications == 1 {
+			return alarmTriggeredEvent
+		}
+		if alarm.Notifications > e.escalateAfter+1 {
+			return alarmEscalatedEvent
+		}
+		return alarmReminderEvent
+	case !inAlarm && alarm.Active:
+		alarm.Active = false
+		alarm.Acknowledged = false
+		alarm.Notifications = 0
+		return alarmClearedEvent
+	case !inAlarm && alarm.ClearPending:
+		alarm.ClearPending = false
+		return alarmClearedEvent
+	}
+
+	return ""
+}
+
+// Acknowledge stops the notifications of the current alarm, whichever
+// instance polls the panel. It returns false when there is no alarm to
+// acknowledge.
+func (e *Escalation) Acknowledge() (bool, error) {
+	active := false
+	err := e.storer.UpdateAlarm(func(alarm *Alarm) bool {
+		active = alarm.Active
+		if !alarm.Active || alarm.Acknowledged {
+			return false
+		}
+		alarm.Acknowledged = true
+		return true
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return active, nil
+}
+
+// panelInAlarm tells whether any partition of the panel is in alarm.
+func panelInAlarm(reply *PanelReading) bool {
+	if reply.BellOn {
+		return true
+	}
+	for _, partition := range reply.Partitions {
+		if partition.AlarmState.Active() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// makerRequester records the Maker events it is asked to send.
+type makerRequester struct {
+	fakeRequester
+	events []string
+}
+
+func (r *makerRequester) RequestMaker(ctx context.Context, event string) error {
+	if r.makerErr != nil {
+		return r.makerErr
+	}
+	r.events = append(r.events, event)
+	return nil
+}
+
+func newTestEscalation(requester Requester, storer Storer, now *time.Time) *Escalation {
+	escalation := NewEscalation(requester, storer, 5*time.Minute, 2)
+	escalation.now = func() time.Time { return *now }
+	return escalation
+}
+
+func TestEscalation(t *testing.T) {
+	start := time.Date(2019, 8, 2, 0, 0, 0, 0, time.UTC)
+
+	t.Run("RemindsThenEscalatesUntilCleared", func(t *testing.T) {
+		now := start
+		requester := &makerRequester{}
+		escalation := newTestEscalation(requester, newFakeStorer(), &now)
+
+		escalation.Update(ctx, false)
+		escalation.Update(ctx, true)
+		now = now.Add(time.Minute)
+		escalation.Update(ctx, true)
+		for i := 0; i < 3; i++ {
+			now = now.Add(5 * time.Minute)
+			escalation.Update(ctx, true)
+		}
+		escalation.Update(ctx, false)
+		escalation.Update(ctx, false)
+
+		assert.Equal(t, []string{
+			alarmTriggeredEvent,
+			alarmReminderEvent,
+			alarmReminderEvent,
+			alarmEscalatedEvent,
+			alarmClearedEvent,
+		}, requester.events)
+	})
+
+	t.Run("StopsNotifyingWhenAcknowledged", func(t *testing.T) {
+		now := start
+		requester := &makerRequester{}
+		escalation := newTestEscalation(requester, newFakeStorer(), &now)
+
+		escalation.Update(ctx, true)
+		acknowledged, err := escalation.Acknowledge()
+		assert.NoError(t, err)
+		assert.True(t, acknowledged)
+		now = now.Add(10 * time.Minute)
+		escalation.Update(ctx, true)
+		escalation.Update(ctx, false)
+
+		assert.Equal(t, []string{alarmTriggeredEvent, alarmClearedEvent}, requester.events)
+	})
+
+	t.Run("NewAlarmAfterClearIsNotified", func(t *testing.T) {
+		now := start
+		requester := &makerRequester{}
+		escalation := newTestEscalation(requester, newFakeStorer(), &now)
+
+		escalation.Update(ctx, true)
+		escalation.Acknowledge()
+		escalation.Update(ctx, false)
+		escalation.Update(ctx, true)
+
+		assert.Equal(t, []string{alarmTriggeredEvent, alarmClearedEvent, alarmTriggeredEvent}, requester.events)
+	})
+
+	t.Run("RetriesFailedNotification", func(t *testing.T) {
+		now := start
+		requester := &makerRequester{}
+		escalation := newTestEscalation(requester, newFakeStorer(), &now)
+
+		requester.makerErr = fmt.Errorf("maker unreachable")
+		escalation.Update(ctx, true)
+		requester.makerErr = nil
+		now = now.Add(time.Second)
+		escalation.Update(ctx, true)
+
+		assert.Equal(t, []string{alarmTriggeredEvent}, requester.events)
+	})
+
+	t.Run("RemindsAfterRetriedTrigger", func(t *testing.T) {
+		now := start
+		requester := &makerRequester{}
+		escalation := newTestEscalation(requester, newFakeStorer(), &now)
+
+		requester.makerErr = fmt.Errorf("maker unreachable")
+		escalation.Update(ctx, true)
+		now = now.Add(time.Second)
+		escalation.Update(ctx, true)
+		requester.makerErr = nil
+		now = now.Add(time.Second)
+		escalation.Update(ctx, true)
+		now = now.Add(5 * time.Minute)
+		escalation.Update(ctx, true)
+
+		assert.Equal(t, []string{alarmTriggeredEvent, alarmReminderEvent}, requester.events)
+	})
+
+	t.Run("RetriesFailedClear", func(t *testing.T) {
+		now := start
+		requester := &makerRequester{}
+		escalation := newTestEscalation(requester, newFakeStorer(), &now)
+
+		escalation.Update(ctx, true)
+		requester.makerErr = fmt.Errorf("maker unreachable")
+		escalation.Update(ctx, false)
+		requester.makerErr = nil
+		escalation.Update(ctx, false)
+		escalation.Update(ctx, false)
+
+		assert.Equal(t, []string{alarmTriggeredEvent, alarmClearedEvent}, requester.events)
+	})
+
+	t.Run("NewAlarmDropsFailedClear", func(t *testing.T) {
+		now := start
+		requester := &makerRequester{}
+		escalation := newTestEscalation(requester, newFakeStorer(), &now)
+
+		escalation.Update(ctx, true)
+		requester.makerErr = fmt.Errorf("maker unreachable")
+		escalation.Update(ctx, false)
+		requester.makerErr = nil
+		escalation.Update(ctx, true)
+		escalation.Update(ctx, false)
+
+		assert.Equal(t, []string{alarmTriggeredEvent, alarmTriggeredEvent, alarmClearedEvent}, requester.events)
+	})
+
+	t.Run("AcknowledgedThroughAnotherInstance", func(t *testing.T) {
+		now := start
+		storer := newFakeStorer()
+		requester := &makerRequester{}
+		leader := newTestEscalation(requester, storer, &now)
+		other := newTestEscalation(&makerRequester{}, storer, &now)
+
+		leader.Update(ctx, true)
+		acknowledged, err := other.Acknowledge()
+		assert.NoError(t, err)
+		assert.True(t, acknowledged)
+		now = now.Add(10 * time.Minute)
+		leader.Update(ctx, true)
+
+		assert.Equal(t, []string{alarmTriggeredEvent}, requester.events)
+	})
+
+	t.Run("ResumedByNewLeader", func(t *testing.T) {
+		now := start
+		storer := newFakeStorer()
+		requester := &makerRequester{}
+		leader := newTestEscalation(requester, storer, &now)
+		takeover := newTestEscalation(requester, storer, &now)
+
+		leader.Update(ctx, true)
+		takeover.Resume()
+		now = now.Add(time.Minute)
+		takeover.Update(ctx, true)
+		now = now.Add(5 * time.Minute)
+		takeover.Update(ctx, true)
+		takeover.Update(ctx, false)
+
+		assert.Equal(t, []string{alarmTriggeredEvent, alarmReminderEvent, alarmClearedEvent}, requester.events)
+	})
+
+	t.Run("QuietPollsDoNotReadStorage", func(t *testing.T) {
+		now := start
+		storer := newFakeStorer()
+		escalation := newTestEscalation(&makerRequester{}, storer, &now)
+
+		for i := 0; i < 3; i++ {
+			escalation.Update(ctx, false)
+		}
+		assert.Equal(t, 1, storer.alarmUpdates)
+
+		escalation.Resume()
+		escalation.Update(ctx, false)
+		assert.Equal(t, 2, storer.alarmUpdates)
+	})
+
+	t.Run("NotifiesWhileStorageFails", func(t *testing.T) {
+		now := start
+		storer := newFakeStorer()
+		requester := &makerRequester{}
+		escalation := newTestEscalation(requester, storer, &now)
+
+		storer.alarmErr = fmt.Errorf("firestore unreachable")
+		escalation.Update(ctx, true)
+		now = now.Add(5 * time.Minute)
+		escalation.Update(ctx, true)
+		escalation.Update(ctx, false)
+
+		assert.Equal(t, []string{alarmTriggeredEvent, alarmReminderEvent, alarmClearedEvent}, requester.events)
+	})
+
+	t.Run("NothingToAcknowledgeWithoutAlarm", func(t *testing.T) {
+		now := start
+		escalation := newTestEscalation(&makerRequester{}, newFakeStorer(), &now)
+
+		acknowledged, err := escalation.Acknowledge()
+		assert.NoError(t, err)
+		assert.False(t, acknowledged)
+	})
+}
+
+func TestPanelInAlarm(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply *PanelReading
+		want  bool
+	}{
+		{
+			name:  "NoAlarm",
+			reply: &PanelReading{Partitions: []Partition{{ID: 0, AlarmState: NoAlarm}}},
+			want:  false,
+		},
+		{
+			name:  "PartitionInAlarm",
+			reply: &PanelReading{Partitions: []Partition{{ID: 0, AlarmState: NoAlarm}, {ID: 1, AlarmState: "Burglary"}}},
+			want:  true,
+		},
+		{
+			name:  "BellOn",
+			reply: &PanelReading{BellOn: true},
+			want:  true,
+		},
+	}
+
+	for _, test := range tests {
+		if got := panelInAlarm(test.reply); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
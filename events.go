@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// eventsPageSize is the number of events read from the panel at once.
+const eventsPageSize = 100
+
+// eventsEpoch is where the event log is read from when no cursor was
+// stored yet.
+var eventsEpoch = time.Date(2019, 8, 1, 0, 0, 0, 0, time.UTC)
+
+// ManageEventsIngestion reads the panel event log every interval until ctx
+// is done. Reads in progress are abandoned, the stored cursor makes the next
+// run resume from the last page stored.
+func ManageEventsIngestion(ctx context.Context, storer Storer, panel AlarmPanel, interval time.Duration) {
+	for {
+		if err := ingestEvents(ctx, storer, panel); err != nil && ctx.Err() == nil {
+			log.Printf("Got the following error trying to ingest panel events: %s", err)
+		}
+		if !sleep(ctx, interval) {
+			log.Printf("Stopped ingesting panel events")
+			return
+		}
+	}
+}
+
+// ingestEvents stores every event newer than the stored cursor. The cursor
+// is saved after each page, so a restart resumes from the last page read.
+// The events of the last second read are read again by the next run.
+func ingestEvents(ctx context.Context, storer Storer, panel AlarmPanel) error {
+	cursor, err := storer.GetEventCursor()
+	if err != nil {
+		return err
+	}
+	if cursor == nil {
+		cursor = &EventCursor{
+			NewerThan: eventsEpoch,
+			Latest:    eventsEpoch,
+		}
+	}
+
+	previous := cursor.Latest
+	for {
+		page, err := panel.Events(ctx, cursor.NewerThan, cursor.Offset, eventsPageSize)
+		if err != nil {
+			return err
+		}
+
+		events := make([]Event, 0, len(page))
+		for _, event := range page {
+			events = append(events, Event{
+				Time:      event.Time,
+				User:      event.User,
+				Zone:      event.Zone,
+				EventType: event.EventType,
+			})
+			if event.Time.After(cursor.Latest) {
+				cursor.Latest = event.Time
+			}
+		}
+		if err := storer.PutEvents(events); err != nil {
+			return err
+		}
+
+		if len(page) < eventsPageSize {
+			// last page, the next run asks for the events of the last
+			// second read again, as the panel logs times in seconds and can
+			// still add events sharing it. Events are stored by content, so
+			// the ones read twice are only stored once.
+			cursor.NewerThan = cursor.Latest.Add(-time.Second)
+			cursor.Offset = 0
+			if cursor.Latest.After(previous) {
+				log.Printf("Stored %d panel events up to %v", len(events), cursor.Latest)
+			}
+
+			return storer.PutEventCursor(cursor)
+		}
+
+		cursor.Offset += len(page)
+		if err := storer.PutEventCursor(cursor); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eventLogPanel serves a fixed event log, oldest event first.
+type eventLogPanel struct {
+	fakePanel
+	log   []PanelEvent
+	fail  bool
+	calls []string
+}
+
+func (r *eventLogPanel) Events(ctx context.Context, newerThan time.Time, offset, count int) ([]PanelEvent, error) {
+	r.calls = append(r.calls, fmt.Sprintf("%v+%v", newerThan.Format(time.RFC3339), offset))
+	if r.fail {
+		return nil, fmt.Errorf("panel unreachable")
+	}
+
+	var newer []PanelEvent
+	for _, event := range r.log {
+		if event.Time.After(newerThan) {
+			newer = append(newer, event)
+		}
+	}
+	if offset >= len(newer) {
+		return nil, nil
+	}
+	end := offset + count
+	if end > len(newer) {
+		end = len(newer)
+	}
+	return newer[offset:end], nil
+}
+
+func newEventLog(start time.Time, n int) []PanelEvent {
+	events := make([]PanelEvent, n)
+	for i := range events {
+		events[i] = PanelEvent{
+			Time:      start.Add(time.Duration(i) * time.Minute),
+			EventType: "ZoneOpen",
+			Zone:      "1 Voordeur",
+		}
+	}
+	return events
+}
+
+func TestIngestEvents(t *testing.T) {
+	start := time.Date(2019, 8, 2, 0, 0, 0, 0, time.UTC)
+
+	t.Run("ReadsEveryPageAndMovesCursor", func(t *testing.T) {
+		storer := newFakeStorer()
+		panel := &eventLogPanel{log: newEventLog(start, 250)}
+
+		err := ingestEvents(ctx, storer, panel)
+
+		assert.Nil(t, err)
+		assert.Len(t, storer.events, 250)
+		assert.Equal(t, []string{"2019-08-01T00:00:00Z+0", "2019-08-01T00:00:00Z+100", "2019-08-01T00:00:00Z+200"}, panel.calls)
+
+		latest := start.Add(249 * time.Minute)
+		assert.Equal(t, &EventCursor{NewerThan: latest.Add(-time.Second), Offset: 0, Latest: latest}, storer.cursor)
+	})
+
+	t.Run("OnlyAsksForNewerEventsOnNextRun", func(t *testing.T) {
+		storer := newFakeStorer()
+		panel := &eventLogPanel{log: newEventLog(start, 3)}
+
+		assert.Nil(t, ingestEvents(ctx, storer, panel))
+		panel.log = newEventLog(start, 5)
+		panel.calls = nil
+		assert.Nil(t, ingestEvents(ctx, storer, panel))
+
+		assert.Len(t, storer.events, 5)
+		assert.Equal(t, []string{"2019-08-02T00:01:59Z+0"}, panel.calls)
+	})
+
+	t.Run("ReadsEventsLoggedLaterInTheLastSecond", func(t *testing.T) {
+		storer := newFakeStorer()
+		log := newEventLog(start, 2)
+		panel := &eventLogPanel{log: log}
+
+		assert.Nil(t, ingestEvents(ctx, storer, panel))
+		sameSecond := log[1]
+		sameSecond.Zone = "2 Achterdeur"
+		panel.log = append(log, sameSecond)
+		assert.Nil(t, ingestEvents(ctx, storer, panel))
+
+		assert.Len(t, storer.events, 3)
+		assert.Equal(t, start.Add(time.Minute), storer.cursor.Latest)
+	})
+
+	t.Run("ResumesFromStoredOffset", func(t *testing.T) {
+		storer := newFakeStorer()
+		storer.cursor = &EventCursor{NewerThan: eventsEpoch, Offset: 100, Latest: start.Add(99 * time.Minute)}
+		panel := &eventLogPanel{log: newEventLog(start, 150)}
+
+		err := ingestEvents(ctx, storer, panel)
+
+		assert.Nil(t, err)
+		assert.Len(t, storer.events, 50)
+		assert.Equal(t, []string{"2019-08-01T00:00:00Z+100"}, panel.calls)
+	})
+
+	t.Run("KeepsCursorOnError", func(t *testing.T) {
+		storer := newFakeStorer()
+		cursor := &EventCursor{NewerThan: start, Offset: 0, Latest: start}
+		storer.cursor = cursor
+		panel := &eventLogPanel{fail: true}
+
+		err := ingestEvents(ctx, storer, panel)
+
+		assert.EqualError(t, err, "panel unreachable")
+		assert.Equal(t, cursor, storer.cursor)
+	})
+}
+
+func TestManageEventsIngestionStops(t *testing.T) {
+	storer := newFakeStorer()
+	panel := &eventLogPanel{log: newEventLog(time.Date(2019, 8, 2, 0, 0, 0, 0, time.UTC), 3)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ManageEventsIngestion(ctx, storer, panel, time.Hour)
+
+	assert.Len(t, panel.calls, 1)
+}
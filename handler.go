@@ -4,30 +4,37 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"cloud.google.com/go/firestore"
+	"github.com/go-oauth2/oauth2/v4"
 	"github.com/go-oauth2/oauth2/v4/errors"
 	"github.com/go-oauth2/oauth2/v4/manage"
 	"github.com/go-oauth2/oauth2/v4/models"
 	"github.com/go-oauth2/oauth2/v4/server"
 	"github.com/go-oauth2/oauth2/v4/store"
 	"github.com/go-session/session"
-	"golang.org/x/crypto/bcrypt"
-	"google.golang.org/api/iterator"
-
-	"github.com/vitorarins/magic-island/fstore"
 )
 
 type Handler interface {
 	IndexHandler(w http.ResponseWriter, r *http.Request)
 	AlarmHandler(w http.ResponseWriter, r *http.Request)
+	StateHandler(w http.ResponseWriter, r *http.Request)
+	BypassHandler(w http.ResponseWriter, r *http.Request)
+	AcknowledgeHandler(w http.ResponseWriter, r *http.Request)
+	MetricsHandler(w http.ResponseWriter, r *http.Request)
+	UsersHandler(w http.ResponseWriter, r *http.Request)
+	PoliciesHandler(w http.ResponseWriter, r *http.Request)
+	HistoryHandler(w http.ResponseWriter, r *http.Request)
 	AuthorizeHandler(w http.ResponseWriter, r *http.Request)
 	TokenHandler(w http.ResponseWriter, r *http.Request)
 	StatusHandler(w http.ResponseWriter, r *http.Request)
@@ -38,14 +45,25 @@ type Handler interface {
 	HomeHandler(w http.ResponseWriter, r *http.Request)
 }
 
+// actionStates maps every action to the armed state it sets on the panel.
+var actionStates = map[string]ArmedState{
+	"arm":     AwayArm,
+	"partarm": PartialArm,
+	"disarm":  Disarm,
+}
+
 type handlerImpl struct {
-	requester       Requester
-	allowedActions  map[string]string
-	srv             *server.Server
-	firestoreClient *firestore.Client
+	panel          AlarmPanel
+	requester      Requester
+	escalation     *Escalation
+	storer         Storer
+	users          UserStore
+	userCodes      UserCodes
+	allowedActions map[string]string
+	srv            *server.Server
 }
 
-func NewHandler(oauthClientId, oauthClientSecret, domain string, redirectURIs []string, requester Requester, firestoreClient *firestore.Client) Handler {
+func NewHandler(oauthClientId, oauthClientSecret, domain string, redirectURIs []string, panel AlarmPanel, requester Requester, escalation *Escalation, storer Storer, users UserStore, tokens oauth2.TokenStore, userCodes UserCodes) Handler {
 
 	// setup OAuth stuff
 	manager := manage.NewDefaultManager()
@@ -83,10 +101,7 @@ func NewHandler(oauthClientId, oauthClientSecret, domain string, redirectURIs []
 		return
 	})
 
-	// token firestore
-
-	storage := fstore.New(firestoreClient, "tokens")
-	manager.MapTokenStorage(storage)
+	manager.MapTokenStorage(tokens)
 	// client firestore store
 	clientStore := store.NewClientStore()
 
@@ -102,7 +117,7 @@ func NewHandler(oauthClientId, oauthClientSecret, domain string, redirectURIs []
 	srv.SetAllowGetAccessRequest(true)
 	srv.SetClientInfoHandler(server.ClientFormHandler)
 
-	passwordAuthorizeHandler := passwordAuthorizeHandlerGenerator(firestoreClient)
+	passwordAuthorizeHandler := passwordAuthorizeHandlerGenerator(users)
 	srv.SetPasswordAuthorizationHandler(passwordAuthorizeHandler)
 	srv.SetUserAuthorizationHandler(userAuthorizeHandler)
 
@@ -116,15 +131,19 @@ func NewHandler(oauthClientId, oauthClientSecret, domain string, redirectURIs []
 	})
 
 	return &handlerImpl{
-		requester: requester,
-		srv:       srv,
+		panel:      panel,
+		requester:  requester,
+		escalation: escalation,
+		storer:     storer,
+		users:      users,
+		userCodes:  userCodes,
+		srv:        srv,
 		allowedActions: map[string]string{
 			"fullarm": "arm",
 			"arm":     "arm",
 			"partarm": "partarm",
 			"disarm":  "disarm",
 		},
-		firestoreClient: firestoreClient,
 	}
 }
 
@@ -146,7 +165,7 @@ func (h *handlerImpl) IndexHandler(w http.ResponseWriter, r *http.Request) {
 
 // AlarmHandler sets up the alarm system with arm, partarm or disarm
 func (h *handlerImpl) AlarmHandler(w http.ResponseWriter, r *http.Request) {
-	_, err := h.srv.ValidationBearerToken(r)
+	token, err := h.srv.ValidationBearerToken(r)
 	if err != nil {
 		log.Printf("Error validating token: %v", err)
 		http.Error(w, err.Error(), http.StatusUnauthorized)
@@ -158,10 +177,507 @@ func (h *handlerImpl) AlarmHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	h.requester.RequestFeenstra(action)
+
+	alarmReq, err := parseAlarmRequest(action, r)
+	if err != nil {
+		log.Printf("Error parsing request for action %s: %v", action, err)
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	ctx, err := h.userContext(r.Context(), token.GetUserID())
+	if err != nil {
+		writeUserContextError(w, err)
+		return
+	}
+	if err := h.panel.Arm(ctx, alarmReq.Partition, actionStates[action], alarmReq.Options); err != nil {
+		log.Printf("Error executing action %s: %v", action, err)
+		writePanelError(w, err)
+
+		return
+	}
 	fmt.Fprintf(w, "Successfuly executed action %s", action)
 }
 
+// StateHandler responds with the state of every partition and its zones
+func (h *handlerImpl) StateHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := h.srv.ValidationBearerToken(r)
+	if err != nil {
+		log.Printf("Error validating token: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	reply, err := h.panel.State(r.Context())
+	if err != nil {
+		log.Printf("Error reading panel state: %v", err)
+		writePanelError(w, err)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newPanelState(reply)); err != nil {
+		log.Printf("Error encoding json: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
+
+// BypassHandler bypasses a zone on POST /alarm/zones/{id}/bypass and restores
+// it on DELETE
+func (h *handlerImpl) BypassHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := h.srv.ValidationBearerToken(r)
+	if err != nil {
+		log.Printf("Error validating token: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) != 4 || segments[0] != "alarm" || segments[1] != "zones" || segments[3] != "bypass" {
+		http.NotFound(w, r)
+		return
+	}
+	zone, err := strconv.ParseInt(segments[2], 10, 64)
+	if err != nil || zone < 0 {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid zone %s", segments[2]))
+		return
+	}
+
+	var bypass bool
+	switch r.Method {
+	case "POST":
+		bypass = true
+	case "DELETE":
+		bypass = false
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, err := h.userContext(r.Context(), token.GetUserID())
+	if err != nil {
+		writeUserContextError(w, err)
+		return
+	}
+	if err := h.panel.Bypass(ctx, zone, bypass); err != nil {
+		log.Printf("Error setting bypass of zone %d to %v: %v", zone, bypass, err)
+		writePanelError(w, err)
+
+		return
+	}
+	if bypass {
+		fmt.Fprintf(w, "Successfuly bypassed zone %d", zone)
+	} else {
+		fmt.Fprintf(w, "Successfuly restored zone %d", zone)
+	}
+}
+
+// AcknowledgeHandler stops the notifications of the current alarm, sent by
+// whichever instance polls the panel
+func (h *handlerImpl) AcknowledgeHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := h.srv.ValidationBearerToken(r)
+	if err != nil {
+		log.Printf("Error validating token: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	acknowledged, err := h.escalation.Acknowledge()
+	if err != nil {
+		log.Printf("Error acknowledging alarm: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+	if !acknowledged {
+		writeJSONError(w, http.StatusConflict, "There is no alarm to acknowledge")
+		return
+	}
+	log.Printf("Alarm acknowledged by %s", token.GetUserID())
+	fmt.Fprint(w, "Successfuly acknowledged alarm")
+}
+
+// MetricsHandler responds with the latency histograms of the requests sent
+// to the panel and to Maker
+func (h *handlerImpl) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := h.srv.ValidationBearerToken(r)
+	if err != nil {
+		log.Printf("Error validating token: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	data := map[string]HistogramSnapshot{
+		"feenstra": feenstraLatency.Snapshot(),
+		"maker":    makerLatency.Snapshot(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("Error encoding json: %v", err)
+	}
+}
+
+// UsersHandler lets admins manage the user slots of the panel. GET
+// /alarm/users lists the slots, PUT /alarm/users/{id} assigns a code to a
+// slot, DELETE /alarm/users/{id} revokes it and PUT
+// /alarm/users/{id}/partitions sets the partitions its user can access
+func (h *handlerImpl) UsersHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := h.srv.ValidationBearerToken(r)
+	if err != nil {
+		log.Printf("Error validating token: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) < 2 || len(segments) > 4 || segments[0] != "alarm" || segments[1] != "users" ||
+		(len(segments) == 4 && segments[3] != "partitions") {
+		http.NotFound(w, r)
+		return
+	}
+	methods := map[int][]string{2: {"GET"}, 3: {"PUT", "DELETE"}, 4: {"PUT"}}[len(segments)]
+	allowed := false
+	for _, method := range methods {
+		allowed = allowed || r.Method == method
+	}
+	if !allowed {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	actor := token.GetUserID()
+	admin, err := h.isAdmin(ctx, actor)
+	if err != nil {
+		log.Printf("Error reading user %s: %v", actor, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+	if !admin {
+		writeJSONError(w, http.StatusForbidden, "Only admins can manage panel users")
+		return
+	}
+
+	reply, err := h.panel.State(ctx)
+	if err != nil {
+		log.Printf("Error reading panel users: %v", err)
+		writePanelError(w, err)
+
+		return
+	}
+
+	if len(segments) == 2 {
+		users := make([]UserState, 0, len(reply.Users))
+		for _, user := range reply.Users {
+			users = append(users, newUserState(user))
+		}
+		writeJSON(w, users)
+
+		return
+	}
+
+	id, err := strconv.Atoi(segments[2])
+	if err != nil || id < 0 {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid user %s", segments[2]))
+		return
+	}
+	var slot *PanelUser
+	for i := range reply.Users {
+		if reply.Users[i].ID == id {
+			slot = &reply.Users[i]
+		}
+	}
+	if slot == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("unknown user %d", id))
+		return
+	}
+
+	var user PanelUser
+	var action, message string
+	switch {
+	case len(segments) == 4:
+		user, err = parseUserPartitionsRequest(r, reply, *slot)
+		action, message = "set-user-partitions", "Successfuly set partitions of user %d"
+	case r.Method == "PUT":
+		user, err = parseUserCodeRequest(r, reply, *slot)
+		action, message = "assign-user-code", "Successfuly assigned code to user %d"
+	default:
+		user = PanelUser{ID: id, Type: UnusedUserType}
+		action, message = "revoke-user-code", "Successfuly revoked code of user %d"
+	}
+	if err != nil {
+		log.Printf("Error parsing request for user %d: %v", id, err)
+		status := http.StatusBadRequest
+		if err == errUnusedUser {
+			status = http.StatusConflict
+		}
+		writeJSONError(w, status, err.Error())
+
+		return
+	}
+
+	entry := AuditEntry{
+		Time:   time.Now(),
+		Actor:  actor,
+		Action: action,
+		Target: fmt.Sprintf("user %d", id),
+	}
+	if user.Type != UnusedUserType {
+		entry.Details = fmt.Sprintf("name %s, type %s, partitions %s", user.Name, user.Type, partitionList(user.Partitions))
+	}
+	// the entry is stored first, so no change reaches the panel unaudited
+	if err := h.storer.PutAuditEntry(entry); err != nil {
+		log.Printf("Error storing audit entry %+v: %v", entry, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if err := h.panel.SetUser(ctx, user); err != nil {
+		log.Printf("Error executing %s on user %d: %v", action, id, err)
+		writePanelError(w, err)
+
+		return
+	}
+	fmt.Fprintf(w, message, id)
+}
+
+// PoliciesHandler serves the notification policies of the detectors. GET
+// /alarm/policies lists the stored policies and GET /alarm/policies/{id}
+// returns the policy of a detector. Admins replace it with PUT and reset it
+// with DELETE
+func (h *handlerImpl) PoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := h.srv.ValidationBearerToken(r)
+	if err != nil {
+		log.Printf("Error validating token: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) < 2 || len(segments) > 3 || segments[0] != "alarm" || segments[1] != "policies" {
+		http.NotFound(w, r)
+		return
+	}
+	if len(segments) == 2 && r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if len(segments) == 3 {
+		if err := checkDetectorID(segments[2]); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	policies, err := h.storer.GetPolicies()
+	if err != nil {
+		log.Printf("Error reading notification policies: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if len(segments) == 2 {
+		list := make([]NotificationPolicy, 0, len(policies))
+		for _, policy := range policies {
+			list = append(list, policy)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Detector < list[j].Detector })
+		writeJSON(w, list)
+
+		return
+	}
+
+	detector := segments[2]
+	switch r.Method {
+	case "GET":
+		policy, ok := policies[detector]
+		if !ok {
+			policy = NotificationPolicy{Detector: detector}
+		}
+		writeJSON(w, policy)
+
+		return
+	case "PUT", "DELETE":
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	actor := token.GetUserID()
+	admin, err := h.isAdmin(ctx, actor)
+	if err != nil {
+		log.Printf("Error reading user %s: %v", actor, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+	if !admin {
+		writeJSONError(w, http.StatusForbidden, "Only admins can change notification policies")
+		return
+	}
+
+	entry := AuditEntry{
+		Time:   time.Now(),
+		Actor:  actor,
+		Target: fmt.Sprintf("detector %s", detector),
+	}
+	var policy NotificationPolicy
+	var message string
+	if r.Method == "PUT" {
+		if r.Body == nil {
+			writeJSONError(w, http.StatusBadRequest, "missing policy")
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid policy: %v", err))
+			return
+		}
+		policy.Detector = detector
+		if err := policy.Validate(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		entry.Action = "set-policy"
+		entry.Details = fmt.Sprintf("disarmed %s, partArmed %s, armed %s", policy.Disarmed, policy.PartArmed, policy.Armed)
+		message = "Successfuly set policy of detector %s"
+	} else {
+		entry.Action = "reset-policy"
+		message = "Successfuly reset policy of detector %s"
+	}
+
+	// the entry is stored first, so no policy changes unaudited
+	if err := h.storer.PutAuditEntry(entry); err != nil {
+		log.Printf("Error storing audit entry %+v: %v", entry, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if r.Method == "PUT" {
+		err = h.storer.PutPolicy(policy)
+	} else {
+		err = h.storer.DeletePolicy(detector)
+	}
+	if err != nil {
+		log.Printf("Error executing %s on detector %s: %v", entry.Action, detector, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	fmt.Fprintf(w, message, detector)
+}
+
+// HistoryHandler responds on GET /api/detectors/{id}/history with the
+// transitions of a detector between the from and to RFC 3339 times of the
+// query string, the last day by default
+func (h *handlerImpl) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := h.srv.ValidationBearerToken(r)
+	if err != nil {
+		log.Printf("Error validating token: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) != 4 || segments[0] != "api" || segments[1] != "detectors" || segments[3] != "history" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := checkDetectorID(segments[2]); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	from, to, err := parseHistoryRange(r.URL.Query(), time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	transitions, err := h.storer.GetDetectorHistory(segments[2], from, to)
+	if err != nil {
+		log.Printf("Error reading history of detector %s: %v", segments[2], err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+	if transitions == nil {
+		transitions = []DetectorTransition{}
+	}
+	writeJSON(w, transitions)
+}
+
+// userContext returns a copy of ctx carrying the pass code of the panel
+// user linked to a web user by its PanelUser, so the panel attributes
+// commands to them. Commands of users without a linked panel user are sent
+// with the code of the app. An error is returned when the user cannot be
+// read, or when the code of their panel user cannot, so their commands are
+// never attributed to someone else.
+func (h *handlerImpl) userContext(ctx context.Context, userID string) (context.Context, error) {
+	user, err := h.users.GetUser(ctx, userID)
+	if err == errUserNotFound {
+		return ctx, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read user %s: %w", userID, err)
+	}
+	if user.PanelUser == nil {
+		return ctx, nil
+	}
+	slot := *user.PanelUser
+	if h.userCodes == nil {
+		return nil, fmt.Errorf("no pass codes of panel users are configured, %s is linked to panel user %d", userID, slot)
+	}
+	passCode, err := h.userCodes(int(slot))
+	if err != nil {
+		return nil, fmt.Errorf("could not read pass code of panel user %d linked to %s: %w", slot, userID, err)
+	}
+
+	return WithPassCode(ctx, passCode), nil
+}
+
+// writeUserContextError reports that a command was not sent because the
+// pass code of the user could not be read.
+func writeUserContextError(w http.ResponseWriter, err error) {
+	log.Printf("Error reading pass code of user: %v", err)
+	writeJSONError(w, http.StatusServiceUnavailable, "The pass code of your panel user cannot be read")
+}
+
+// isAdmin tells whether the user can manage the users of the panel. Users
+// without a record are not admins.
+func (h *handlerImpl) isAdmin(ctx context.Context, userID string) (bool, error) {
+	user, err := h.users.GetUser(ctx, userID)
+	if err == errUserNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return user.Admin, nil
+}
+
 // AuthorizeHandler authorizes oauth clients
 func (h *handlerImpl) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
 	store, err := session.Start(r.Context(), w, r)
@@ -203,9 +719,26 @@ func (h *handlerImpl) TokenHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// StatusHandler always responds with 200 OK
+// StatusHandler always responds with 200 OK. On /status, the instance
+// leading the panel poll is reported along, null when no instance holds an
+// unexpired lease
 func (h *handlerImpl) StatusHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, "OK")
+	if r.URL.Path != "/status" {
+		fmt.Fprint(w, "OK")
+		return
+	}
+
+	lease, err := h.storer.GetLease(detectorsLease)
+	if err != nil {
+		log.Printf("Error reading the %s lease: %v", detectorsLease, err)
+	}
+	if lease != nil && !time.Now().Before(lease.ExpiresAt) {
+		lease = nil
+	}
+	writeJSON(w, map[string]interface{}{
+		"status": "OK",
+		"leader": lease,
+	})
 }
 
 // IFTTTHandler handles every request that is not an action from IFTTT
@@ -314,52 +847,45 @@ func (h *handlerImpl) NotHomeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userId := token.GetUserID()
-	user := map[string]interface{}{
-		"home": false,
-	}
 
 	ctx := r.Context()
-	_, err = h.firestoreClient.Collection("users").Doc(userId).Get(ctx)
-	if err != nil {
+	if err := h.users.SetUserHome(ctx, userId, false); err != nil {
 		log.Printf("Error setting user as not home: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 
 		return
 	}
-	_, err = h.firestoreClient.Collection("users").Doc(userId).Set(ctx, user, firestore.MergeAll)
+
+	users, err := h.users.ListUsers(ctx)
 	if err != nil {
-		log.Printf("Error setting user as not home: %v", err)
+		log.Printf("Error retrieving users for nothome: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 
 		return
 	}
-
-	someoneAtHome := true
-	iter := h.firestoreClient.Collection("users").Documents(ctx)
-	for {
-		doc, err := iter.Next()
-		if err == iterator.Done {
+	someoneAtHome := false
+	for _, user := range users {
+		if user.AtHome() {
+			someoneAtHome = true
 			break
 		}
+	}
+	if !someoneAtHome {
+		armCtx, err := h.userContext(ctx, userId)
 		if err != nil {
-			log.Printf("Error retrieving users for nothome: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeUserContextError(w, err)
+			return
+		}
+		if err := h.panel.Arm(armCtx, 0, AwayArm, ArmOptions{}); err != nil {
+			log.Printf("Error executing action arm: %v", err)
+			writePanelError(w, err)
 
 			return
 		}
-		user := doc.Data()
-		if userAtHome, ok := user["home"]; ok {
-			if someoneAtHome = userAtHome.(bool); someoneAtHome {
-				break
-			}
-		} else {
-			someoneAtHome = true
-			break
+		// the panel is armed already, a failed notification does not fail the request
+		if err := h.requester.RequestMaker(ctx, "EverybodyOut"); err != nil {
+			log.Printf("Error notifying that everybody is out: %v", err)
 		}
-	}
-	if !someoneAtHome {
-		h.requester.RequestFeenstra("arm")
-		h.requester.RequestMaker("EverybodyOut")
 		fmt.Fprintf(w, "Successfuly executed action %s", "arm")
 	} else {
 		fmt.Fprintf(w, "Successfuly marked user as not home")
@@ -376,20 +902,8 @@ func (h *handlerImpl) HomeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userId := token.GetUserID()
-	user := map[string]interface{}{
-		"home": true,
-	}
 
-	ctx := r.Context()
-	_, err = h.firestoreClient.Collection("users").Doc(userId).Get(ctx)
-	if err != nil {
-		log.Printf("Error setting user as at home: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-
-		return
-	}
-	_, err = h.firestoreClient.Collection("users").Doc(userId).Set(ctx, user, firestore.MergeAll)
-	if err != nil {
+	if err := h.users.SetUserHome(r.Context(), userId, true); err != nil {
 		log.Printf("Error setting user as at home: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 
@@ -452,23 +966,322 @@ func userAuthorizeHandler(w http.ResponseWriter, r *http.Request) (string, error
 	return userID, nil
 }
 
-func passwordAuthorizeHandlerGenerator(firestoreClient *firestore.Client) func(context.Context, string, string, string) (string, error) {
+func passwordAuthorizeHandlerGenerator(users UserStore) func(context.Context, string, string, string) (string, error) {
 	return func(ctx context.Context, clientID, username, password string) (userID string, err error) {
-		type User struct {
-			Username string `firestore:"username"`
-			Password string `firestore:"password"`
-		}
-		var user User
-		dsnap, err := firestoreClient.Collection("users").Doc(username).Get(ctx)
+		user, err := users.CheckPassword(ctx, username, password)
 		if err != nil {
 			return "", err
 		}
-		if err := dsnap.DataTo(&user); err != nil {
-			return "", err
+
+		return user.ID, nil
+	}
+}
+
+// maxExitDelay is the longest exit delay accepted by the panel.
+const maxExitDelay = 255 * time.Second
+
+// alarmRequest holds the parameters of an alarm action.
+type alarmRequest struct {
+	Partition int
+	Options   ArmOptions
+}
+
+// actionFields are the fields IFTTT sends along with an action.
+type actionFields struct {
+	Partition string `json:"partition"`
+	ExitDelay string `json:"exit_delay"`
+	Force     string `json:"force"`
+}
+
+// parseAlarmRequest reads the parameters of an alarm action. They come from
+// the action fields sent by IFTTT or from the query string, and the partition
+// can also be given in /alarm/{partition}/{action} paths. By default the first
+// partition is armed without exit delay.
+func parseAlarmRequest(action string, r *http.Request) (*alarmRequest, error) {
+	var body struct {
+		ActionFields actionFields `json:"actionFields"`
+	}
+	if r.Method == "POST" && r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("invalid action fields: %v", err)
+		}
+	}
+	fields := body.ActionFields
+
+	query := r.URL.Query()
+	if fields.Partition == "" {
+		fields.Partition = query.Get("partition")
+	}
+	if fields.ExitDelay == "" {
+		fields.ExitDelay = query.Get("exit_delay")
+	}
+	if fields.Force == "" {
+		fields.Force = query.Get("force")
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if segments[0] == "alarm" {
+		switch len(segments) {
+		case 2:
+		case 3:
+			fields.Partition = segments[1]
+		default:
+			return nil, fmt.Errorf("invalid alarm path %s", r.URL.Path)
+		}
+	}
+
+	alarmReq := &alarmRequest{}
+	if fields.Partition != "" {
+		partition, err := strconv.Atoi(fields.Partition)
+		if err != nil || partition < 0 {
+			return nil, fmt.Errorf("invalid partition %s", fields.Partition)
 		}
-		err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+		alarmReq.Partition = partition
+	}
 
-		return user.Username, err
+	if fields.ExitDelay != "" {
+		seconds, err := strconv.Atoi(fields.ExitDelay)
+		exitDelay := time.Duration(seconds) * time.Second
+		if err != nil || exitDelay < 0 || exitDelay > maxExitDelay {
+			return nil, fmt.Errorf("invalid exit delay %s, it must be between 0 and %d seconds", fields.ExitDelay, maxExitDelay/time.Second)
+		}
+		alarmReq.Options.ExitDelay = exitDelay
+	}
+
+	if fields.Force != "" {
+		force, err := strconv.ParseBool(fields.Force)
+		if err != nil {
+			return nil, fmt.Errorf("invalid force %s", fields.Force)
+		}
+		alarmReq.Options.Force = force
+	}
+
+	if actionStates[action] == Disarm && alarmReq.Options != (ArmOptions{}) {
+		return nil, fmt.Errorf("exit delay and force cannot be used with %s", action)
+	}
+
+	return alarmReq, nil
+}
+
+// userCodePattern matches the codes accepted by the panel.
+var userCodePattern = regexp.MustCompile(`^[0-9]{4,6}$`)
+
+var (
+	errUnusedUser  = fmt.Errorf("the user has no code")
+	errMissingCode = fmt.Errorf("missing code, the panel does not report the code of the user")
+)
+
+// userRequest is the body of the requests changing a panel user.
+type userRequest struct {
+	Name       string `json:"name"`
+	Code       string `json:"code"`
+	Type       string `json:"type"`
+	Partitions []int  `json:"partitions"`
+}
+
+func decodeUserRequest(r *http.Request) (*userRequest, error) {
+	var req userRequest
+	if r.Body == nil {
+		return nil, fmt.Errorf("missing user")
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid user: %v", err)
+	}
+
+	return &req, nil
+}
+
+// parseUserCodeRequest reads the user assigned to slot. The name and type
+// of the slot are kept when they are not given.
+func parseUserCodeRequest(r *http.Request, reply *PanelReading, slot PanelUser) (PanelUser, error) {
+	req, err := decodeUserRequest(r)
+	if err != nil {
+		return PanelUser{}, err
+	}
+
+	if !userCodePattern.MatchString(req.Code) {
+		return PanelUser{}, fmt.Errorf("invalid code, it must have 4 to 6 digits")
+	}
+	if err := checkPartitions(reply, req.Partitions); err != nil {
+		return PanelUser{}, err
+	}
+
+	if slot.Type != UnusedUserType {
+		if req.Name == "" {
+			req.Name = slot.Name
+		}
+		if req.Type == "" {
+			req.Type = slot.Type
+		}
+	}
+	if req.Type == "" || req.Type == UnusedUserType {
+		return PanelUser{}, fmt.Errorf("missing user type")
+	}
+
+	return PanelUser{
+		ID:         slot.ID,
+		Name:       req.Name,
+		Type:       req.Type,
+		PassCode:   req.Code,
+		Partitions: req.Partitions,
+	}, nil
+}
+
+// parseUserPartitionsRequest reads the partitions given to the user of
+// slot. The panel clears a slot sent without its code, and the real panel
+// does not report codes, so the code must be given unless the panel
+// reported it.
+func parseUserPartitionsRequest(r *http.Request, reply *PanelReading, slot PanelUser) (PanelUser, error) {
+	if slot.Type == UnusedUserType {
+		return PanelUser{}, errUnusedUser
+	}
+
+	req, err := decodeUserRequest(r)
+	if err != nil {
+		return PanelUser{}, err
+	}
+	if req.Code != "" {
+		slot.PassCode = req.Code
+	}
+	if slot.PassCode == "" {
+		return PanelUser{}, errMissingCode
+	}
+	if !userCodePattern.MatchString(slot.PassCode) {
+		return PanelUser{}, fmt.Errorf("invalid code, it must have 4 to 6 digits")
+	}
+	if err := checkPartitions(reply, req.Partitions); err != nil {
+		return PanelUser{}, err
+	}
+
+	slot.Part = ""
+	slot.Partitions = req.Partitions
+
+	return slot, nil
+}
+
+// checkPartitions fails unless partitions are known to the panel. A user
+// needs access to one partition at least.
+func checkPartitions(reply *PanelReading, partitions []int) error {
+	if len(partitions) == 0 {
+		return fmt.Errorf("missing partitions")
+	}
+	for _, id := range partitions {
+		found := false
+		for _, partition := range reply.Partitions {
+			if partition.ID == id {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid partition %d", id)
+		}
+	}
+
+	return nil
+}
+
+// partitionList formats partition ids as a comma separated list.
+func partitionList(partitions []int) string {
+	fields := make([]string, 0, len(partitions))
+	for _, id := range partitions {
+		fields = append(fields, strconv.Itoa(id))
+	}
+	return strings.Join(fields, ",")
+}
+
+// parseHistoryRange reads the from and to times of a history query. Without
+// to the range ends now, and without from it starts a day before its end.
+func parseHistoryRange(query url.Values, now time.Time) (from, to time.Time, err error) {
+	to = now
+	if value := query.Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			return from, to, fmt.Errorf("invalid to %s, it must be an RFC 3339 time", value)
+		}
+	}
+	from = to.Add(-24 * time.Hour)
+	if value := query.Get("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			return from, to, fmt.Errorf("invalid from %s, it must be an RFC 3339 time", value)
+		}
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+
+	return from, to, nil
+}
+
+// panelErrorStatus returns the http status used to report an error returned
+// while sending a command to the panel.
+func panelErrorStatus(err error) int {
+	if err == ErrPanelUnreachable {
+		return http.StatusServiceUnavailable
+	}
+	if refusedErr, ok := err.(*RefusedError); ok {
+		switch refusedErr.Reason {
+		case InvalidPassCode:
+			return http.StatusForbidden
+		case NotReady, ArmNotAllowed, DisarmNotAllowed:
+			return http.StatusConflict
+		case PanelNotAvailable:
+			return http.StatusServiceUnavailable
+		}
+	}
+
+	return http.StatusBadGateway
+}
+
+// panelErrorMessage returns a message describing an error returned while
+// sending a command to the panel.
+func panelErrorMessage(err error) string {
+	if err == ErrPanelUnreachable {
+		return "The panel is unreachable"
+	}
+	if refusedErr, ok := err.(*RefusedError); ok {
+		switch refusedErr.Reason {
+		case InvalidPassCode:
+			return "The panel refused the pass code"
+		case NotReady:
+			return "The panel is not ready, a zone may be open"
+		case ArmNotAllowed:
+			return "The panel does not allow arming right now"
+		case DisarmNotAllowed:
+			return "The panel does not allow disarming right now"
+		case PanelNotAvailable:
+			return "The panel is unavailable"
+		}
+		return fmt.Sprintf("The panel answered with %s", refusedErr.Reason)
+	}
+
+	return "Could not reach the panel"
+}
+
+// writePanelError reports an error returned by the panel using the error
+// format of the IFTTT actions API.
+func writePanelError(w http.ResponseWriter, err error) {
+	writeJSONError(w, panelErrorStatus(err), panelErrorMessage(err))
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("Error encoding json: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	data := map[string]interface{}{
+		"errors": []map[string]string{
+			{
+				"message": message,
+			},
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("Error encoding json: %v", err)
 	}
 }
 
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"encoding/xml"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -11,28 +13,107 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
-	"cloud.google.com/go/firestore"
+	gooauth2 "github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/go-oauth2/oauth2/v4/store"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/oauth2"
-	"google.golang.org/api/iterator"
+
+	"github.com/vitorarins/magic-island/elas"
 )
 
-type fakeRequester struct{}
+type fakePanel struct {
+	armErr error
+}
+
+func (f *fakePanel) State(ctx context.Context) (*PanelReading, error) {
+	log.Printf("State was called")
+	return &PanelReading{}, nil
+}
+
+func (f *fakePanel) Arm(ctx context.Context, partition int, state ArmedState, options ArmOptions) error {
+	log.Printf("Arm was called with partition '%v', state '%v' and options '%+v'", partition, state, options)
+	return f.armErr
+}
+
+func (f *fakePanel) Bypass(ctx context.Context, zone int64, bypass bool) error {
+	log.Printf("Bypass was called with zone '%v' and bypass '%v'", zone, bypass)
+	return f.armErr
+}
+
+func (f *fakePanel) Events(ctx context.Context, newerThan time.Time, offset, count int) ([]PanelEvent, error) {
+	log.Printf("Events was called with newerThan '%v', offset '%v' and count '%v'", newerThan, offset, count)
+	return nil, nil
+}
+
+func (f *fakePanel) SetUser(ctx context.Context, user PanelUser) error {
+	log.Printf("SetUser was called with user '%v'", user.ID)
+	return f.armErr
+}
+
+// fixtureBackend answers with the state of a real panel, which reports no
+// codes, and records the users sent to it.
+type fixtureBackend struct {
+	reply elas.ECReply
+	users []elas.User
+}
+
+func newFixtureBackend(t *testing.T) *fixtureBackend {
+	data, err := ioutil.ReadFile("elas/testdata/detectors.xml")
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	var envelope struct {
+		Response elas.GetCPStateResponse `xml:"Body>GetCPStateResponse"`
+	}
+	if err := xml.Unmarshal(data, &envelope); err != nil {
+		t.Fatalf("Failed to decode fixture: %v", err)
+	}
+
+	return &fixtureBackend{reply: envelope.Response.Reply}
+}
+
+func (f *fixtureBackend) State(ctx context.Context) (*elas.ECReply, error) {
+	reply := f.reply
+	return &reply, nil
+}
+
+func (f *fixtureBackend) Arm(ctx context.Context, partition int, state elas.ArmedState, options elas.ArmOptions) error {
+	return nil
+}
+
+func (f *fixtureBackend) Bypass(ctx context.Context, zone int64, bypass bool) error {
+	return nil
+}
+
+func (f *fixtureBackend) Events(ctx context.Context, newerThan time.Time, offset, count int) ([]elas.Event, error) {
+	return nil, nil
+}
+
+func (f *fixtureBackend) SetUser(ctx context.Context, user elas.User) error {
+	f.users = append(f.users, user)
+	return nil
+}
 
-func (f *fakeRequester) RequestFeenstra(action string) string {
-	log.Printf("RequestFeenstra was called with action: %v", action)
-	return "big xml"
+type fakeRequester struct {
+	makerErr error
 }
 
-func (f *fakeRequester) RequestMakerDetector(detector, status string) string {
-	log.Printf("RequestMakerDetector was called with detect '%v' and status '%v'", detector, status)
-	return "maker response"
+func (f *fakeRequester) RequestMakerDetector(ctx context.Context, detector DetectorEvent, values ...string) error {
+	log.Printf("RequestMakerDetector was called with detector '%v', status '%v' and values '%v'", detector.ID, detector.Status, values)
+	return f.makerErr
 }
 
-func (f *fakeRequester) RequestMaker(event string) string {
+func (f *fakeRequester) RequestMaker(ctx context.Context, event string) error {
 	log.Printf("RequestMaker was called with event '%v'", event)
-	return "maker response"
+	return f.makerErr
+}
+
+func (f *fakeRequester) RequestMakerValues(ctx context.Context, event string, values ...string) error {
+	log.Printf("RequestMakerValues was called with event '%v' and values '%v'", event, values)
+	return f.makerErr
 }
 
 var (
@@ -45,21 +126,46 @@ var (
 	testDomain            = "https://magic.com"
 	testRedirectUrl       = "https://redirect.com/test"
 
-	requester = &fakeRequester{}
-	ctx       = context.Background()
+	panel      = &fakePanel{}
+	requester  = &fakeRequester{}
+	storer     = newFakeStorer()
+	escalation = NewEscalation(requester, storer, 5*time.Minute, 3)
+	users      = NewMemoryUserStore()
+	ctx        = context.Background()
 )
 
-func setupClient(t *testing.T) *firestore.Client {
-	if value := os.Getenv("FIRESTORE_EMULATOR_HOST"); value == "" {
-		os.Setenv("FIRESTORE_EMULATOR_HOST", "127.0.0.1:8080")
+// tokens is shared by the handlers of the tests, see issueToken.
+var tokens gooauth2.TokenStore
+
+func TestMain(m *testing.M) {
+	var err error
+	tokens, err = store.NewMemoryTokenStore()
+	if err != nil {
+		log.Fatalf("Could not create token store: %v", err)
 	}
 
-	firestoreClient, err := firestore.NewClient(ctx, "test")
+	os.Exit(m.Run())
+}
+
+// issueToken stores an access token of userID for the test client, so a
+// test is authorized without going through the oauth flow of the tests
+// before it.
+func issueToken(t *testing.T, userID string) string {
+	t.Helper()
+
+	access := fmt.Sprintf("%s-%s-%d", t.Name(), userID, time.Now().UnixNano())
+	err := tokens.Create(ctx, &models.Token{
+		ClientID:        testOauthClientId,
+		UserID:          userID,
+		Access:          access,
+		AccessCreateAt:  time.Now(),
+		AccessExpiresIn: time.Hour,
+	})
 	if err != nil {
-		t.Fatalf("Failed to create firestore client: %v", err)
+		t.Fatalf("Failed to issue token: %v", err)
 	}
 
-	return firestoreClient
+	return access
 }
 
 func TestLoginHandler(t *testing.T) {
@@ -68,17 +174,15 @@ func TestLoginHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	user := map[string]string{
-		"username": "vitorarins",
-		"password": string(hashedPassword),
+	user := User{
+		ID:       "vitorarins",
+		Username: "vitorarins",
+		Password: string(hashedPassword),
 	}
 
-	firestoreClient := setupClient(t)
-	defer firestoreClient.Close()
-
-	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, requester, firestoreClient)
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, users, tokens, nil)
 
-	if _, err := firestoreClient.Collection("users").Doc("vitorarins").Set(ctx, user, firestore.MergeAll); err != nil {
+	if err := users.PutUser(ctx, user); err != nil {
 		t.Fatalf("Failed to set user: %v", err)
 	}
 
@@ -159,10 +263,7 @@ func TestAuthHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	firestoreClient := setupClient(t)
-	defer firestoreClient.Close()
-
-	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, requester, firestoreClient)
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, users, tokens, nil)
 
 	rr := httptest.NewRecorder()
 	server := http.HandlerFunc(handler.AuthHandler)
@@ -208,10 +309,7 @@ func TestAuthorizeHandler(t *testing.T) {
 		},
 	}
 
-	firestoreClient := setupClient(t)
-	defer firestoreClient.Close()
-
-	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, requester, firestoreClient)
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, users, tokens, nil)
 
 	tests := []struct {
 		caseNumber   int
@@ -313,12 +411,7 @@ func TestAuthorizeHandler(t *testing.T) {
 }
 
 func TestTokenHandler(t *testing.T) {
-	firestoreClient, err := firestore.NewClient(ctx, "test")
-	if err != nil {
-		t.Fatalf("Failed to create firestore client: %v", err)
-	}
-
-	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, requester, firestoreClient)
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, users, tokens, nil)
 
 	tests := []struct {
 		caseNumber   int
@@ -377,8 +470,8 @@ func TestTokenHandler(t *testing.T) {
 			clientSecret: testOauthClientSecret,
 			redirectUrl:  testRedirectUrl,
 			code:         "randomCode",
-			status:       http.StatusInternalServerError,
-			body:         `{"error":"server_error","error_description":"The authorization server encountered an unexpected condition that prevented it from fulfilling the request"}` + "\n",
+			status:       http.StatusUnauthorized,
+			body:         `{"error":"invalid_grant","error_description":"The provided authorization grant (e.g., authorization code, resource owner credentials) or refresh token is invalid, expired, revoked, does not match the redirection URI used in the authorization request, or was issued to another client"}` + "\n",
 		},
 	}
 
@@ -450,10 +543,8 @@ func TestTokenHandler(t *testing.T) {
 }
 
 func TestIndexHandler(t *testing.T) {
-	firestoreClient := setupClient(t)
-	defer firestoreClient.Close()
-
-	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, requester, firestoreClient)
+	token := issueToken(t, "vitorarins")
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, users, tokens, nil)
 
 	tests := []struct {
 		caseNumber int
@@ -467,20 +558,20 @@ func TestIndexHandler(t *testing.T) {
 			route:      "/",
 			status:     http.StatusOK,
 			body:       "Matrix",
-			token:      globalToken.AccessToken,
+			token:      token,
 		},
 		{
 			caseNumber: 2,
 			route:      "/404",
 			status:     http.StatusNotFound,
 			body:       "404 page not found\n",
-			token:      globalToken.AccessToken,
+			token:      token,
 		},
 		{
 			caseNumber: 3,
 			route:      "/",
 			status:     http.StatusUnauthorized,
-			body:       "no more items in iterator\n",
+			body:       "invalid access token\n",
 			token:      "unauthorized",
 		},
 		{
@@ -526,10 +617,8 @@ func TestIndexHandler(t *testing.T) {
 }
 
 func TestAlarmHandler(t *testing.T) {
-	firestoreClient := setupClient(t)
-	defer firestoreClient.Close()
-
-	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, requester, firestoreClient)
+	token := issueToken(t, "vitorarins")
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, users, tokens, nil)
 
 	tests := []struct {
 		route  string
@@ -551,6 +640,16 @@ func TestAlarmHandler(t *testing.T) {
 			status: http.StatusOK,
 			body:   "Successfuly executed action arm",
 		},
+		{
+			route:  "/alarm/1/arm",
+			status: http.StatusOK,
+			body:   "Successfuly executed action arm",
+		},
+		{
+			route:  "/alarm/garage/arm",
+			status: http.StatusBadRequest,
+			body:   `{"errors":[{"message":"invalid partition garage"}]}` + "\n",
+		},
 		{
 			route:  "/alarm/404",
 			status: http.StatusNotFound,
@@ -565,7 +664,7 @@ func TestAlarmHandler(t *testing.T) {
 		}
 
 		q := req.URL.Query()
-		q.Add("access_token", globalToken.AccessToken)
+		q.Add("access_token", token)
 		req.URL.RawQuery = q.Encode()
 
 		rr := httptest.NewRecorder()
@@ -580,400 +679,1308 @@ func TestAlarmHandler(t *testing.T) {
 			t.Errorf("unexpected body: got (%v) want (%v)", rr.Body.String(), test.body)
 		}
 	}
-}
-
-func TestStatusHandler(t *testing.T) {
-	firestoreClient := setupClient(t)
-	defer firestoreClient.Close()
-
-	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, requester, firestoreClient)
-
-	req, err := http.NewRequest("GET", "/status", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	rr := httptest.NewRecorder()
-	server := http.HandlerFunc(handler.StatusHandler)
-	server.ServeHTTP(rr, req)
-
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("unexpected status: got (%v) want (%v)", status, http.StatusOK)
-	}
-
-	if rr.Body.String() != "OK" {
-		t.Errorf("unexpected body: got (%v) want (%v)", rr.Body.String(), "OK")
-	}
-}
-
-func TestIFTTTHandler(t *testing.T) {
-	firestoreClient, err := firestore.NewClient(ctx, "test")
-	if err != nil {
-		t.Fatalf("Failed to create firestore client: %v", err)
-	}
 
-	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, requester, firestoreClient)
+	failingPanel := &fakePanel{armErr: &RefusedError{Operation: "CPPartArm", Reason: NotReady}}
+	handler = NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, failingPanel, requester, escalation, storer, users, tokens, nil)
 
-	req, err := http.NewRequest("GET", "/ifttt/v1/user/info", nil)
+	req, err := http.NewRequest("GET", "/alarm/arm", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	q := req.URL.Query()
-	q.Add("access_token", globalToken.AccessToken)
+	q.Add("access_token", token)
 	req.URL.RawQuery = q.Encode()
 
 	rr := httptest.NewRecorder()
-	server := http.HandlerFunc(handler.IFTTTHandler)
+	server := http.HandlerFunc(handler.AlarmHandler)
 	server.ServeHTTP(rr, req)
 
-	resp := rr.Result()
-	if status := resp.StatusCode; status != http.StatusOK {
-		t.Errorf("unexpected status: got (%v) want (%v)", status, http.StatusOK)
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.Errorf("Error reading response from ifttt handler: %v", err)
-	}
-
-	var userInfo map[string](map[string]string)
-	err = json.Unmarshal(body, &userInfo)
-	if err != nil {
-		t.Errorf("Error unmarshaling user info: %v", err)
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("unexpected status: got (%v) want (%v)", status, http.StatusConflict)
 	}
 
-	userData, ok := userInfo["data"]
-	if !ok {
-		t.Errorf("Could not find data inside user info.")
+	expectedBody := `{"errors":[{"message":"The panel is not ready, a zone may be open"}]}` + "\n"
+	if rr.Body.String() != expectedBody {
+		t.Errorf("unexpected body: got (%v) want (%v)", rr.Body.String(), expectedBody)
 	}
+}
 
-	userName, ok := userData["name"]
-	if !ok || userName != "vitorarins" {
-		t.Errorf("unexpected user data name: got (%v) want (%v)", userName, "vitorarins")
+func TestAlarmHandlerWithPanelUser(t *testing.T) {
+	token := issueToken(t, "vitorarins")
+	panel := NewSimulatedPanel("1234", "key")
+	if err := panel.SetUser(ctx, PanelUser{ID: 3, Name: "Schoonmaker", Type: "GRAND_08", PassCode: "5678", Partitions: []int{0}}); err != nil {
+		t.Fatalf("Failed to set panel user: %v", err)
 	}
-
-	userId, ok := userData["id"]
-	if !ok || userId != "vitorarins" {
-		t.Errorf("unexpected user data id: got (%v) want (%v)", userId, "vitorarins")
+	userCodes := func(slot int) (string, error) {
+		if slot != 3 {
+			return "", fmt.Errorf("secret PANEL_USER_%d not found", slot)
+		}
+		return "5678", nil
 	}
-}
-
-func TestNotHomeHandler(t *testing.T) {
-	firestoreClient := setupClient(t)
-	defer firestoreClient.Close()
-
-	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, requester, firestoreClient)
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, users, tokens, userCodes)
 
+	linked, unknown := int64(3), int64(2)
 	tests := []struct {
-		caseNumber int
-		route      string
-		status     int
-		body       string
-		users      []map[string]interface{}
+		panelUser *int64
+		status    int
+		body      string
+		eventUser string
 	}{
 		{
-			caseNumber: 1,
-			route:      "/ifttt/v1/actions/nothome",
-			status:     http.StatusInternalServerError,
-			body:       `rpc error: code = NotFound desc = "projects/test/databases/(default)/documents/users/vitorarins" not found` + "\n",
-			users:      []map[string]interface{}{},
-		},
-		{
-			caseNumber: 2,
-			route:      "/ifttt/v1/actions/nothome",
-			status:     http.StatusOK,
-			body:       "Successfuly executed action arm",
-			users: []map[string]interface{}{
-				{
-					"username": "vitorarins",
-				},
-			},
-		},
-		{
-			caseNumber: 3,
-			route:      "/ifttt/v1/actions/nothome",
-			status:     http.StatusOK,
-			body:       "Successfuly executed action arm",
-			users: []map[string]interface{}{
-				{
-					"username": "vitorarins",
-					"home":     false,
-				},
-			},
-		},
-		{
-			caseNumber: 4,
-			route:      "/ifttt/v1/actions/nothome",
-			status:     http.StatusOK,
-			body:       "Successfuly executed action arm",
-			users: []map[string]interface{}{
-				{
-					"username": "vitorarins",
-					"home":     true,
-				},
-			},
-		},
-		{
-			caseNumber: 5,
-			route:      "/ifttt/v1/actions/nothome",
-			status:     http.StatusOK,
-			body:       "Successfuly marked user as not home",
-			users: []map[string]interface{}{
-				{
-					"username": "vitorarins",
-					"home":     true,
-				},
-				{
-					"username": "testuser",
-					"home":     true,
-				},
-			},
+			panelUser: nil,
+			status:    http.StatusOK,
+			body:      "Successfuly executed action arm",
+			eventUser: "Gebruiker 00",
 		},
 		{
-			caseNumber: 6,
-			route:      "/ifttt/v1/actions/nothome",
-			status:     http.StatusOK,
-			body:       "Successfuly executed action arm",
-			users: []map[string]interface{}{
-				{
-					"username": "vitorarins",
-					"home":     true,
-				},
-				{
-					"username": "testuser",
-					"home":     false,
-				},
-			},
+			panelUser: &linked,
+			status:    http.StatusOK,
+			body:      "Successfuly executed action arm",
+			eventUser: "Schoonmaker",
 		},
 		{
-			caseNumber: 7,
-			route:      "/ifttt/v1/actions/nothome",
-			status:     http.StatusOK,
-			body:       "Successfuly marked user as not home",
-			users: []map[string]interface{}{
-				{
-					"username": "vitorarins",
-					"home":     true,
-				},
-				{
-					"username": "testuser",
-				},
-			},
+			panelUser: &unknown,
+			status:    http.StatusServiceUnavailable,
+			body:      `{"errors":[{"message":"The pass code of your panel user cannot be read"}]}` + "\n",
+			eventUser: "Schoonmaker",
 		},
 	}
 
-	for _, test := range tests {
-		if err := deleteCollection(ctx, firestoreClient, firestoreClient.Collection("users"), 10); err != nil {
-			t.Fatalf("Failed to delete collection 'users': %v", err)
+	for i, test := range tests {
+		user := User{
+			ID:        "vitorarins",
+			Username:  "vitorarins",
+			PanelUser: test.panelUser,
 		}
-		for _, user := range test.users {
-			if _, err := firestoreClient.Collection("users").Doc(user["username"].(string)).Set(ctx, user, firestore.MergeAll); err != nil {
-				t.Fatalf("Failed to set user: %v", err)
-			}
+		if err := users.PutUser(ctx, user); err != nil {
+			t.Fatalf("Failed to set user: %v", err)
 		}
 
-		req, err := http.NewRequest("GET", test.route, nil)
+		req, err := http.NewRequest("GET", "/alarm/arm", nil)
 		if err != nil {
 			t.Fatal(err)
 		}
 
 		q := req.URL.Query()
-		q.Add("access_token", globalToken.AccessToken)
+		q.Add("access_token", token)
 		req.URL.RawQuery = q.Encode()
 
 		rr := httptest.NewRecorder()
-		server := http.HandlerFunc(handler.NotHomeHandler)
+		server := http.HandlerFunc(handler.AlarmHandler)
 		server.ServeHTTP(rr, req)
 
 		if status := rr.Code; status != test.status {
-			t.Errorf("unexpected status on test case '%v': got (%v) want (%v)", test.caseNumber, status, test.status)
+			t.Errorf("unexpected status on test case '%v': got (%v) want (%v)", i, status, test.status)
 		}
 
 		if rr.Body.String() != test.body {
-			t.Errorf("unexpected body on test case '%v': got (%v) want (%v)", test.caseNumber, rr.Body.String(), test.body)
+			t.Errorf("unexpected body on test case '%v': got (%v) want (%v)", i, rr.Body.String(), test.body)
+		}
+
+		// a command that is not sent leaves the last event of the panel as is
+		events, err := panel.Events(ctx, time.Time{}, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := events[len(events)-1].User; got != test.eventUser {
+			t.Errorf("unexpected event user on test case '%v': got (%v) want (%v)", i, got, test.eventUser)
 		}
 	}
-}
 
-func TestHomeHandler(t *testing.T) {
-	firestoreClient := setupClient(t)
-	defer firestoreClient.Close()
+	if err := users.PutUser(ctx, User{ID: "vitorarins", Username: "vitorarins"}); err != nil {
+		t.Fatalf("Failed to set user: %v", err)
+	}
+}
 
-	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, requester, firestoreClient)
+func TestBypassHandler(t *testing.T) {
+	token := issueToken(t, "vitorarins")
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, users, tokens, nil)
 
 	tests := []struct {
-		caseNumber int
-		route      string
-		status     int
-		body       string
-		users      []map[string]interface{}
+		method string
+		route  string
+		status int
+		body   string
 	}{
 		{
-			caseNumber: 1,
-			route:      "/ifttt/v1/actions/home",
-			status:     http.StatusInternalServerError,
-			body:       `rpc error: code = NotFound desc = "projects/test/databases/(default)/documents/users/vitorarins" not found` + "\n",
-			users:      []map[string]interface{}{},
-		},
-		{
-			caseNumber: 2,
-			route:      "/ifttt/v1/actions/home",
-			status:     http.StatusOK,
-			body:       "Successfuly marked user as at home",
-			users: []map[string]interface{}{
-				{
-					"username": "vitorarins",
-				},
-			},
-		},
-		{
-			caseNumber: 3,
-			route:      "/ifttt/v1/actions/home",
-			status:     http.StatusOK,
-			body:       "Successfuly marked user as at home",
-			users: []map[string]interface{}{
-				{
-					"username": "vitorarins",
-					"home":     false,
-				},
-			},
+			method: "POST",
+			route:  "/alarm/zones/6/bypass",
+			status: http.StatusOK,
+			body:   "Successfuly bypassed zone 6",
 		},
 		{
-			caseNumber: 4,
-			route:      "/ifttt/v1/actions/home",
-			status:     http.StatusOK,
-			body:       "Successfuly marked user as at home",
-			users: []map[string]interface{}{
-				{
-					"username": "vitorarins",
-					"home":     true,
-				},
-			},
+			method: "DELETE",
+			route:  "/alarm/zones/6/bypass",
+			status: http.StatusOK,
+			body:   "Successfuly restored zone 6",
 		},
 		{
-			caseNumber: 5,
-			route:      "/ifttt/v1/actions/home",
-			status:     http.StatusOK,
-			body:       "Successfuly marked user as at home",
-			users: []map[string]interface{}{
-				{
-					"username": "vitorarins",
-					"home":     true,
-				},
-				{
-					"username": "testuser",
-					"home":     true,
-				},
-			},
+			method: "GET",
+			route:  "/alarm/zones/6/bypass",
+			status: http.StatusMethodNotAllowed,
+			body:   "Method Not Allowed\n",
 		},
 		{
-			caseNumber: 6,
-			route:      "/ifttt/v1/actions/home",
-			status:     http.StatusOK,
-			body:       "Successfuly marked user as at home",
-			users: []map[string]interface{}{
-				{
-					"username": "vitorarins",
-					"home":     true,
-				},
-				{
-					"username": "testuser",
-					"home":     false,
-				},
-			},
+			method: "POST",
+			route:  "/alarm/zones/balkon/bypass",
+			status: http.StatusBadRequest,
+			body:   `{"errors":[{"message":"invalid zone balkon"}]}` + "\n",
 		},
 		{
-			caseNumber: 7,
-			route:      "/ifttt/v1/actions/home",
-			status:     http.StatusOK,
-			body:       "Successfuly marked user as at home",
-			users: []map[string]interface{}{
-				{
-					"username": "vitorarins",
-					"home":     true,
-				},
-				{
-					"username": "testuser",
-				},
-			},
+			method: "POST",
+			route:  "/alarm/zones/6",
+			status: http.StatusNotFound,
+			body:   "404 page not found\n",
 		},
 	}
 
 	for _, test := range tests {
-		if err := deleteCollection(ctx, firestoreClient, firestoreClient.Collection("users"), 10); err != nil {
-			t.Fatalf("Failed to delete collection 'users': %v", err)
-		}
-
-		for _, user := range test.users {
-			if _, err := firestoreClient.Collection("users").Doc(user["username"].(string)).Set(ctx, user, firestore.MergeAll); err != nil {
-				t.Fatalf("Failed to set user: %v", err)
-			}
-		}
-
-		req, err := http.NewRequest("GET", test.route, nil)
+		req, err := http.NewRequest(test.method, test.route, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
 
 		q := req.URL.Query()
-		q.Add("access_token", globalToken.AccessToken)
+		q.Add("access_token", token)
 		req.URL.RawQuery = q.Encode()
 
 		rr := httptest.NewRecorder()
-		server := http.HandlerFunc(handler.HomeHandler)
+		server := http.HandlerFunc(handler.BypassHandler)
 		server.ServeHTTP(rr, req)
 
 		if status := rr.Code; status != test.status {
-			t.Errorf("unexpected status on test case '%v': got (%v) want (%v)", test.caseNumber, status, test.status)
+			t.Errorf("unexpected status for %v %v: got (%v) want (%v)", test.method, test.route, status, test.status)
 		}
 
 		if rr.Body.String() != test.body {
-			t.Errorf("unexpected body on test case '%v': got (%v) want (%v)", test.caseNumber, rr.Body.String(), test.body)
+			t.Errorf("unexpected body for %v %v: got (%v) want (%v)", test.method, test.route, rr.Body.String(), test.body)
 		}
 	}
 }
 
-func restoreCookies(request *http.Request) {
-	for _, cookie := range globalCookieJar {
-		request.AddCookie(cookie)
-	}
-}
+func TestAcknowledgeHandler(t *testing.T) {
+	token := issueToken(t, "vitorarins")
+	escalation := NewEscalation(requester, newFakeStorer(), 5*time.Minute, 3)
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, users, tokens, nil)
 
-func deleteCollection(ctx context.Context, client *firestore.Client,
-	ref *firestore.CollectionRef, batchSize int) error {
+	acknowledge := func() *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/alarm/acknowledge", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	for {
-		// Get a batch of documents
-		iter := ref.Limit(batchSize).Documents(ctx)
-		numDeleted := 0
+		q := req.URL.Query()
+		q.Add("access_token", token)
+		req.URL.RawQuery = q.Encode()
 
-		// Iterate through the documents, adding
-		// a delete operation for each one to a
-		// WriteBatch.
-		batch := client.Batch()
-		for {
-			doc, err := iter.Next()
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				return err
-			}
+		rr := httptest.NewRecorder()
+		server := http.HandlerFunc(handler.AcknowledgeHandler)
+		server.ServeHTTP(rr, req)
+		return rr
+	}
 
-			batch.Delete(doc.Ref)
-			numDeleted++
-		}
+	tests := []struct {
+		inAlarm bool
+		status  int
+		body    string
+	}{
+		{
+			inAlarm: false,
+			status:  http.StatusConflict,
+			body:    `{"errors":[{"message":"There is no alarm to acknowledge"}]}` + "\n",
+		},
+		{
+			inAlarm: true,
+			status:  http.StatusOK,
+			body:    "Successfuly acknowledged alarm",
+		},
+	}
+
+	for _, test := range tests {
+		escalation.Update(ctx, test.inAlarm)
+		rr := acknowledge()
 
-		// If there are no documents to delete,
-		// the process is over.
-		if numDeleted == 0 {
-			return nil
+		if status := rr.Code; status != test.status {
+			t.Errorf("unexpected status in alarm %v: got (%v) want (%v)", test.inAlarm, status, test.status)
 		}
 
-		_, err := batch.Commit(ctx)
-		if err != nil {
-			return err
+		if rr.Body.String() != test.body {
+			t.Errorf("unexpected body in alarm %v: got (%v) want (%v)", test.inAlarm, rr.Body.String(), test.body)
 		}
 	}
 }
+
+func TestUsersHandler(t *testing.T) {
+	token := issueToken(t, "vitorarins")
+	storer := newFakeStorer()
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, NewSimulatedPanel("1234", "key"), requester, escalation, storer, users, tokens, nil)
+
+	tests := []struct {
+		admin  bool
+		method string
+		route  string
+		body   string
+		status int
+		want   string
+	}{
+		{
+			admin:  false,
+			method: "GET",
+			route:  "/alarm/users",
+			status: http.StatusForbidden,
+			want:   `{"errors":[{"message":"Only admins can manage panel users"}]}` + "\n",
+		},
+		{
+			admin:  true,
+			method: "PUT",
+			route:  "/alarm/users/3",
+			body:   `{"name":"Schoonmaker","code":"5678","type":"GRAND_08","partitions":[0]}`,
+			status: http.StatusOK,
+			want:   "Successfuly assigned code to user 3",
+		},
+		{
+			admin:  true,
+			method: "GET",
+			route:  "/alarm/users",
+			status: http.StatusOK,
+			want: `[{"id":0,"name":"Gebruiker 00","type":"GRAND_08","part":"F","partitions":[0]},` +
+				`{"id":1,"name":"","type":"UserTypeNotSet","part":"No","partitions":null},` +
+				`{"id":2,"name":"","type":"UserTypeNotSet","part":"No","partitions":null},` +
+				`{"id":3,"name":"Schoonmaker","type":"GRAND_08","part":"F","partitions":[0]}]` + "\n",
+		},
+		{
+			admin:  true,
+			method: "PUT",
+			route:  "/alarm/users/2",
+			body:   `{"name":"Oppas","code":"56","type":"GRAND_08","partitions":[0]}`,
+			status: http.StatusBadRequest,
+			want:   `{"errors":[{"message":"invalid code, it must have 4 to 6 digits"}]}` + "\n",
+		},
+		{
+			admin:  true,
+			method: "PUT",
+			route:  "/alarm/users/2",
+			body:   `{"name":"Oppas","code":"4321","partitions":[0]}`,
+			status: http.StatusBadRequest,
+			want:   `{"errors":[{"message":"missing user type"}]}` + "\n",
+		},
+		{
+			admin:  true,
+			method: "PUT",
+			route:  "/alarm/users/3/partitions",
+			body:   `{"partitions":[1]}`,
+			status: http.StatusBadRequest,
+			want:   `{"errors":[{"message":"invalid partition 1"}]}` + "\n",
+		},
+		{
+			admin:  true,
+			method: "PUT",
+			route:  "/alarm/users/2/partitions",
+			body:   `{"partitions":[0]}`,
+			status: http.StatusConflict,
+			want:   `{"errors":[{"message":"the user has no code"}]}` + "\n",
+		},
+		{
+			admin:  true,
+			method: "PUT",
+			route:  "/alarm/users/3/partitions",
+			body:   `{"partitions":[0]}`,
+			status: http.StatusOK,
+			want:   "Successfuly set partitions of user 3",
+		},
+		{
+			admin:  true,
+			method: "DELETE",
+			route:  "/alarm/users/3",
+			status: http.StatusOK,
+			want:   "Successfuly revoked code of user 3",
+		},
+		{
+			admin:  true,
+			method: "DELETE",
+			route:  "/alarm/users/9",
+			status: http.StatusNotFound,
+			want:   `{"errors":[{"message":"unknown user 9"}]}` + "\n",
+		},
+		{
+			admin:  true,
+			method: "POST",
+			route:  "/alarm/users",
+			status: http.StatusMethodNotAllowed,
+			want:   "Method Not Allowed\n",
+		},
+	}
+
+	for _, test := range tests {
+		user := User{
+			ID:       "vitorarins",
+			Username: "vitorarins",
+			Admin:    test.admin,
+		}
+		if err := users.PutUser(ctx, user); err != nil {
+			t.Fatalf("Failed to set user: %v", err)
+		}
+
+		req, err := http.NewRequest(test.method, test.route, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := req.URL.Query()
+		q.Add("access_token", token)
+		req.URL.RawQuery = q.Encode()
+
+		rr := httptest.NewRecorder()
+		server := http.HandlerFunc(handler.UsersHandler)
+		server.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("unexpected status for %v %v: got (%v) want (%v)", test.method, test.route, status, test.status)
+		}
+
+		if rr.Body.String() != test.want {
+			t.Errorf("unexpected body for %v %v: got (%v) want (%v)", test.method, test.route, rr.Body.String(), test.want)
+		}
+	}
+
+	if len(storer.audit) != 3 {
+		t.Fatalf("unexpected audit entries: got (%+v) want (3)", storer.audit)
+	}
+	for i, action := range []string{"assign-user-code", "set-user-partitions", "revoke-user-code"} {
+		entry := storer.audit[i]
+		if entry.Actor != "vitorarins" || entry.Action != action || entry.Target != "user 3" {
+			t.Errorf("unexpected audit entry %d: got (%+v) want action (%v)", i, entry, action)
+		}
+		if strings.Contains(entry.Details, "5678") {
+			t.Errorf("audit entry %d exposes the user code: %+v", i, entry)
+		}
+	}
+}
+
+func TestUsersHandlerWithPanelFixture(t *testing.T) {
+	token := issueToken(t, "vitorarins")
+	backend := newFixtureBackend(t)
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, &elasPanel{backend: backend}, requester, escalation, newFakeStorer(), users, tokens, nil)
+	if err := users.PutUser(ctx, User{ID: "vitorarins", Username: "vitorarins", Admin: true}); err != nil {
+		t.Fatalf("Failed to set user: %v", err)
+	}
+
+	tests := []struct {
+		route  string
+		body   string
+		status int
+		want   string
+		sent   *elas.User
+	}{
+		{
+			route:  "/alarm/users/0/partitions",
+			body:   `{"partitions":[0]}`,
+			status: http.StatusBadRequest,
+			want:   `{"errors":[{"message":"missing code, the panel does not report the code of the user"}]}` + "\n",
+		},
+		{
+			route:  "/alarm/users/0/partitions",
+			body:   `{"code":"12","partitions":[0]}`,
+			status: http.StatusBadRequest,
+			want:   `{"errors":[{"message":"invalid code, it must have 4 to 6 digits"}]}` + "\n",
+		},
+		{
+			route:  "/alarm/users/0/partitions",
+			body:   `{"code":"1234","partitions":[0]}`,
+			status: http.StatusOK,
+			want:   "Successfuly set partitions of user 0",
+			sent:   &elas.User{ID: 0, Name: "Gebruiker 00", UserType: "GRAND_08", PassCode: "1234", PartAssociationCSV: "0"},
+		},
+		{
+			route:  "/alarm/users/1",
+			body:   `{"name":"Oppas","code":"1234","type":"GRAND_08","partitions":[0]}`,
+			status: http.StatusOK,
+			want:   "Successfuly assigned code to user 1",
+			sent:   &elas.User{ID: 1, Name: "Oppas", UserType: "GRAND_08", PassCode: "1234", PartAssociationCSV: "0"},
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("PUT", test.route, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := req.URL.Query()
+		q.Add("access_token", token)
+		req.URL.RawQuery = q.Encode()
+
+		backend.users = nil
+		rr := httptest.NewRecorder()
+		server := http.HandlerFunc(handler.UsersHandler)
+		server.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("unexpected status for %v %v: got (%v) want (%v)", test.route, test.body, status, test.status)
+		}
+
+		if rr.Body.String() != test.want {
+			t.Errorf("unexpected body for %v %v: got (%v) want (%v)", test.route, test.body, rr.Body.String(), test.want)
+		}
+
+		if test.sent == nil && len(backend.users) != 0 {
+			t.Errorf("unexpected users sent for %v %v: %+v", test.route, test.body, backend.users)
+		}
+		if test.sent != nil && (len(backend.users) != 1 || backend.users[0] != *test.sent) {
+			t.Errorf("unexpected users sent for %v %v: got (%+v) want (%+v)", test.route, test.body, backend.users, *test.sent)
+		}
+	}
+}
+
+func TestAdminHandlersWithoutAudit(t *testing.T) {
+	token := issueToken(t, "vitorarins")
+	storer := newFakeStorer()
+	storer.auditErr = fmt.Errorf("audit unavailable")
+	backend := newFixtureBackend(t)
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, &elasPanel{backend: backend}, requester, escalation, storer, users, tokens, nil)
+	if err := users.PutUser(ctx, User{ID: "vitorarins", Username: "vitorarins", Admin: true}); err != nil {
+		t.Fatalf("Failed to set user: %v", err)
+	}
+
+	tests := []struct {
+		method  string
+		route   string
+		body    string
+		handler http.HandlerFunc
+	}{
+		{
+			method:  "PUT",
+			route:   "/alarm/users/1",
+			body:    `{"name":"Oppas","code":"4321","type":"GRAND_08","partitions":[0]}`,
+			handler: handler.UsersHandler,
+		},
+		{
+			method:  "DELETE",
+			route:   "/alarm/users/0",
+			handler: handler.UsersHandler,
+		},
+		{
+			method:  "PUT",
+			route:   "/alarm/policies/zone-0",
+			body:    `{"disarmed":"silent","armed":"intrusion"}`,
+			handler: handler.PoliciesHandler,
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.route, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := req.URL.Query()
+		q.Add("access_token", token)
+		req.URL.RawQuery = q.Encode()
+
+		rr := httptest.NewRecorder()
+		test.handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusInternalServerError {
+			t.Errorf("unexpected status for %v %v: got (%v) want (%v)", test.method, test.route, status, http.StatusInternalServerError)
+		}
+	}
+
+	if len(backend.users) != 0 {
+		t.Errorf("unaudited users sent to the panel: %+v", backend.users)
+	}
+	if len(storer.policies) != 0 {
+		t.Errorf("unaudited policies stored: %+v", storer.policies)
+	}
+}
+
+func TestAdminHandlersWithUnknownUser(t *testing.T) {
+	token := issueToken(t, "vitorarins")
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, NewSimulatedPanel("1234", "key"), requester, escalation, newFakeStorer(), NewMemoryUserStore(), tokens, nil)
+
+	tests := []struct {
+		route   string
+		handler http.HandlerFunc
+		want    string
+	}{
+		{
+			route:   "/alarm/users/3",
+			handler: handler.UsersHandler,
+			want:    `{"errors":[{"message":"Only admins can manage panel users"}]}` + "\n",
+		},
+		{
+			route:   "/alarm/policies/zone-0",
+			handler: handler.PoliciesHandler,
+			want:    `{"errors":[{"message":"Only admins can change notification policies"}]}` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("DELETE", test.route, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := req.URL.Query()
+		q.Add("access_token", token)
+		req.URL.RawQuery = q.Encode()
+
+		rr := httptest.NewRecorder()
+		test.handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusForbidden {
+			t.Errorf("unexpected status for %v: got (%v) want (%v)", test.route, status, http.StatusForbidden)
+		}
+
+		if rr.Body.String() != test.want {
+			t.Errorf("unexpected body for %v: got (%v) want (%v)", test.route, rr.Body.String(), test.want)
+		}
+	}
+}
+
+func TestPoliciesHandler(t *testing.T) {
+	token := issueToken(t, "vitorarins")
+	storer := newFakeStorer()
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, users, tokens, nil)
+
+	tests := []struct {
+		admin  bool
+		method string
+		route  string
+		body   string
+		status int
+		want   string
+	}{
+		{
+			admin:  false,
+			method: "PUT",
+			route:  "/alarm/policies/zone-0",
+			body:   `{"disarmed":"silent","armed":"intrusion"}`,
+			status: http.StatusForbidden,
+			want:   `{"errors":[{"message":"Only admins can change notification policies"}]}` + "\n",
+		},
+		{
+			admin:  true,
+			method: "PUT",
+			route:  "/alarm/policies/zone-0",
+			body:   `{"disarmed":"silent","armed":"intrusion"}`,
+			status: http.StatusOK,
+			want:   "Successfuly set policy of detector zone-0",
+		},
+		{
+			admin:  true,
+			method: "PUT",
+			route:  "/alarm/policies/zone-3",
+			body:   `{"disarmed":"loud"}`,
+			status: http.StatusBadRequest,
+			want:   `{"errors":[{"message":"invalid level loud for disarmed, it must be silent, info or intrusion"}]}` + "\n",
+		},
+		{
+			admin:  true,
+			method: "PUT",
+			route:  "/alarm/policies/1-Voordeur",
+			body:   `{"disarmed":"silent"}`,
+			status: http.StatusBadRequest,
+			want:   `{"errors":[{"message":"invalid detector 1-Voordeur, detectors are keyed by zone id such as zone-2"}]}` + "\n",
+		},
+		{
+			admin:  false,
+			method: "GET",
+			route:  "/alarm/policies",
+			status: http.StatusOK,
+			want:   `[{"detector":"zone-0","disarmed":"silent","partArmed":"","armed":"intrusion"}]` + "\n",
+		},
+		{
+			admin:  false,
+			method: "GET",
+			route:  "/alarm/policies/zone-3",
+			status: http.StatusOK,
+			want:   `{"detector":"zone-3","disarmed":"","partArmed":"","armed":""}` + "\n",
+		},
+		{
+			admin:  true,
+			method: "DELETE",
+			route:  "/alarm/policies/zone-0",
+			status: http.StatusOK,
+			want:   "Successfuly reset policy of detector zone-0",
+		},
+		{
+			admin:  true,
+			method: "POST",
+			route:  "/alarm/policies",
+			status: http.StatusMethodNotAllowed,
+			want:   "Method Not Allowed\n",
+		},
+	}
+
+	for _, test := range tests {
+		user := User{
+			ID:       "vitorarins",
+			Username: "vitorarins",
+			Admin:    test.admin,
+		}
+		if err := users.PutUser(ctx, user); err != nil {
+			t.Fatalf("Failed to set user: %v", err)
+		}
+
+		req, err := http.NewRequest(test.method, test.route, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := req.URL.Query()
+		q.Add("access_token", token)
+		req.URL.RawQuery = q.Encode()
+
+		rr := httptest.NewRecorder()
+		server := http.HandlerFunc(handler.PoliciesHandler)
+		server.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("unexpected status for %v %v: got (%v) want (%v)", test.method, test.route, status, test.status)
+		}
+
+		if rr.Body.String() != test.want {
+			t.Errorf("unexpected body for %v %v: got (%v) want (%v)", test.method, test.route, rr.Body.String(), test.want)
+		}
+	}
+
+	if len(storer.policies) != 0 {
+		t.Errorf("unexpected policies after reset: %+v", storer.policies)
+	}
+	if len(storer.audit) != 2 || storer.audit[0].Action != "set-policy" || storer.audit[1].Action != "reset-policy" {
+		t.Errorf("unexpected audit entries: %+v", storer.audit)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	token := issueToken(t, "vitorarins")
+	storer := newFakeStorer()
+	storer.PutDetectorHistory([]DetectorTransition{
+		{Detector: "zone-5", Name: "6 Keukendeur", Time: time.Date(2019, 8, 2, 10, 0, 0, 0, time.UTC), Status: "On"},
+		{Detector: "zone-5", Name: "6 Keukendeur", Time: time.Date(2019, 8, 3, 10, 0, 0, 0, time.UTC), Status: "Off"},
+	})
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, users, tokens, nil)
+
+	tests := []struct {
+		method string
+		route  string
+		status int
+		body   string
+	}{
+		{
+			method: "GET",
+			route:  "/api/detectors/zone-5/history?from=2019-08-02T00:00:00Z&to=2019-08-03T00:00:00Z",
+			status: http.StatusOK,
+			body:   `[{"detector":"zone-5","name":"6 Keukendeur","time":"2019-08-02T10:00:00Z","status":"On","trouble":false}]` + "\n",
+		},
+		{
+			method: "GET",
+			route:  "/api/detectors/zone-0/history?to=2019-08-03T00:00:00Z",
+			status: http.StatusOK,
+			body:   "[]\n",
+		},
+		{
+			method: "GET",
+			route:  "/api/detectors/zone-5/history?from=yesterday",
+			status: http.StatusBadRequest,
+			body:   `{"errors":[{"message":"invalid from yesterday, it must be an RFC 3339 time"}]}` + "\n",
+		},
+		{
+			method: "GET",
+			route:  "/api/detectors/6-Keukendeur/history",
+			status: http.StatusBadRequest,
+			body:   `{"errors":[{"message":"invalid detector 6-Keukendeur, detectors are keyed by zone id such as zone-2"}]}` + "\n",
+		},
+		{
+			method: "POST",
+			route:  "/api/detectors/zone-5/history",
+			status: http.StatusMethodNotAllowed,
+			body:   "Method Not Allowed\n",
+		},
+		{
+			method: "GET",
+			route:  "/api/detectors/zone-5",
+			status: http.StatusNotFound,
+			body:   "404 page not found\n",
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.route, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := req.URL.Query()
+		q.Add("access_token", token)
+		req.URL.RawQuery = q.Encode()
+
+		rr := httptest.NewRecorder()
+		server := http.HandlerFunc(handler.HistoryHandler)
+		server.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("unexpected status for %v %v: got (%v) want (%v)", test.method, test.route, status, test.status)
+		}
+
+		if rr.Body.String() != test.body {
+			t.Errorf("unexpected body for %v %v: got (%v) want (%v)", test.method, test.route, rr.Body.String(), test.body)
+		}
+	}
+}
+
+func TestParseHistoryRange(t *testing.T) {
+	now := time.Date(2019, 8, 3, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		query string
+		from  time.Time
+		to    time.Time
+		err   string
+	}{
+		{
+			query: "",
+			from:  now.Add(-24 * time.Hour),
+			to:    now,
+		},
+		{
+			query: "from=2019-08-01T00:00:00Z&to=2019-08-02T00:00:00%2B02:00",
+			from:  time.Date(2019, 8, 1, 0, 0, 0, 0, time.UTC),
+			to:    time.Date(2019, 8, 1, 22, 0, 0, 0, time.UTC),
+		},
+		{
+			query: "to=2019-08-02",
+			err:   "invalid to 2019-08-02, it must be an RFC 3339 time",
+		},
+		{
+			query: "from=2019-08-04T00:00:00Z",
+			err:   "from must be before to",
+		},
+	}
+
+	for _, test := range tests {
+		query, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from, to, err := parseHistoryRange(query, now)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("unexpected error for %v: got (%v) want (%v)", test.query, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", test.query, err)
+			continue
+		}
+		if !from.Equal(test.from) || !to.Equal(test.to) {
+			t.Errorf("unexpected range for %v: got (%v, %v) want (%v, %v)", test.query, from, to, test.from, test.to)
+		}
+	}
+}
+
+func TestParseAlarmRequest(t *testing.T) {
+	tests := []struct {
+		action    string
+		method    string
+		route     string
+		body      string
+		partition int
+		options   ArmOptions
+		err       string
+	}{
+		{
+			method:    "GET",
+			route:     "/alarm/arm",
+			partition: 0,
+		},
+		{
+			method:    "GET",
+			route:     "/alarm/2/disarm",
+			partition: 2,
+		},
+		{
+			method: "GET",
+			route:  "/alarm/-1/disarm",
+			err:    "invalid partition -1",
+		},
+		{
+			method: "GET",
+			route:  "/alarm/1/2/disarm",
+			err:    "invalid alarm path /alarm/1/2/disarm",
+		},
+		{
+			method:    "POST",
+			route:     "/ifttt/v1/actions/fullarm",
+			body:      `{"actionFields":{"partition":"1"},"user":{"timezone":"Europe/Amsterdam"}}`,
+			partition: 1,
+		},
+		{
+			method:    "POST",
+			route:     "/ifttt/v1/actions/fullarm",
+			partition: 0,
+		},
+		{
+			method: "POST",
+			route:  "/ifttt/v1/actions/fullarm",
+			body:   `{"actionFields":`,
+			err:    "invalid action fields: unexpected EOF",
+		},
+		{
+			action:    "arm",
+			method:    "POST",
+			route:     "/ifttt/v1/actions/fullarm",
+			body:      `{"actionFields":{"partition":"0","exit_delay":"60","force":"true"}}`,
+			partition: 0,
+			options:   ArmOptions{ExitDelay: 60 * time.Second, Force: true},
+		},
+		{
+			action:    "partarm",
+			method:    "GET",
+			route:     "/alarm/1/partarm?exit_delay=30",
+			partition: 1,
+			options:   ArmOptions{ExitDelay: 30 * time.Second},
+		},
+		{
+			action: "arm",
+			method: "GET",
+			route:  "/alarm/arm?exit_delay=300",
+			err:    "invalid exit delay 300, it must be between 0 and 255 seconds",
+		},
+		{
+			action: "arm",
+			method: "GET",
+			route:  "/alarm/arm?force=maybe",
+			err:    "invalid force maybe",
+		},
+		{
+			action: "disarm",
+			method: "GET",
+			route:  "/alarm/disarm?force=true",
+			err:    "exit delay and force cannot be used with disarm",
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.route, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		action := test.action
+		if action == "" {
+			action = "arm"
+		}
+		got, err := parseAlarmRequest(action, req)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("unexpected error for %v: got (%v) want (%v)", test.route, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", test.route, err)
+			continue
+		}
+		if got.Partition != test.partition {
+			t.Errorf("unexpected partition for %v: got (%v) want (%v)", test.route, got.Partition, test.partition)
+		}
+		if got.Options != test.options {
+			t.Errorf("unexpected options for %v: got (%+v) want (%+v)", test.route, got.Options, test.options)
+		}
+	}
+}
+
+func TestWritePanelError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		body   string
+	}{
+		{
+			err:    &RefusedError{Operation: "CPPartArm", Reason: InvalidPassCode},
+			status: http.StatusForbidden,
+			body:   `{"errors":[{"message":"The panel refused the pass code"}]}` + "\n",
+		},
+		{
+			err:    &RefusedError{Operation: "CPPartArm", Reason: PanelNotAvailable},
+			status: http.StatusServiceUnavailable,
+			body:   `{"errors":[{"message":"The panel is unavailable"}]}` + "\n",
+		},
+		{
+			err:    &RefusedError{Operation: "CPPartArm", Reason: "ASSomethingNew"},
+			status: http.StatusBadGateway,
+			body:   `{"errors":[{"message":"The panel answered with ASSomethingNew"}]}` + "\n",
+		},
+		{
+			err:    fmt.Errorf("soap:Receiver: Server was unable to process request."),
+			status: http.StatusBadGateway,
+			body:   `{"errors":[{"message":"Could not reach the panel"}]}` + "\n",
+		},
+		{
+			err:    ErrPanelUnreachable,
+			status: http.StatusServiceUnavailable,
+			body:   `{"errors":[{"message":"The panel is unreachable"}]}` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		writePanelError(rr, test.err)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("unexpected status for error '%v': got (%v) want (%v)", test.err, status, test.status)
+		}
+
+		if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("unexpected content type for error '%v': got (%v) want (%v)", test.err, contentType, "application/json")
+		}
+
+		if rr.Body.String() != test.body {
+			t.Errorf("unexpected body for error '%v': got (%v) want (%v)", test.err, rr.Body.String(), test.body)
+		}
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, users, tokens, nil)
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	storer.leases[detectorsLease] = Lease{Holder: "instance-a", AcquiredAt: time.Date(2019, 8, 2, 10, 0, 0, 0, time.UTC), ExpiresAt: expiresAt}
+	defer delete(storer.leases, detectorsLease)
+
+	tests := []struct {
+		route string
+		body  string
+	}{
+		{
+			route: "/status",
+			body:  fmt.Sprintf(`{"leader":{"holder":"instance-a","acquiredAt":"2019-08-02T10:00:00Z","expiresAt":"%s"},"status":"OK"}`+"\n", expiresAt.Format(time.RFC3339)),
+		},
+		{
+			route: "/ifttt/v1/status",
+			body:  "OK",
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.route, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		server := http.HandlerFunc(handler.StatusHandler)
+		server.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("unexpected status: got (%v) want (%v)", status, http.StatusOK)
+		}
+
+		if rr.Body.String() != test.body {
+			t.Errorf("unexpected body: got (%v) want (%v)", rr.Body.String(), test.body)
+		}
+	}
+}
+
+func TestIFTTTHandler(t *testing.T) {
+	token := issueToken(t, "vitorarins")
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, users, tokens, nil)
+
+	req, err := http.NewRequest("GET", "/ifttt/v1/user/info", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := req.URL.Query()
+	q.Add("access_token", token)
+	req.URL.RawQuery = q.Encode()
+
+	rr := httptest.NewRecorder()
+	server := http.HandlerFunc(handler.IFTTTHandler)
+	server.ServeHTTP(rr, req)
+
+	resp := rr.Result()
+	if status := resp.StatusCode; status != http.StatusOK {
+		t.Errorf("unexpected status: got (%v) want (%v)", status, http.StatusOK)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("Error reading response from ifttt handler: %v", err)
+	}
+
+	var userInfo map[string](map[string]string)
+	err = json.Unmarshal(body, &userInfo)
+	if err != nil {
+		t.Errorf("Error unmarshaling user info: %v", err)
+	}
+
+	userData, ok := userInfo["data"]
+	if !ok {
+		t.Errorf("Could not find data inside user info.")
+	}
+
+	userName, ok := userData["name"]
+	if !ok || userName != "vitorarins" {
+		t.Errorf("unexpected user data name: got (%v) want (%v)", userName, "vitorarins")
+	}
+
+	userId, ok := userData["id"]
+	if !ok || userId != "vitorarins" {
+		t.Errorf("unexpected user data id: got (%v) want (%v)", userId, "vitorarins")
+	}
+}
+
+func TestNotHomeHandler(t *testing.T) {
+	token := issueToken(t, "vitorarins")
+	atHome, notHome := true, false
+
+	tests := []struct {
+		caseNumber int
+		route      string
+		status     int
+		body       string
+		users      []User
+	}{
+		{
+			caseNumber: 1,
+			route:      "/ifttt/v1/actions/nothome",
+			status:     http.StatusInternalServerError,
+			body:       "user not found\n",
+			users:      []User{},
+		},
+		{
+			caseNumber: 2,
+			route:      "/ifttt/v1/actions/nothome",
+			status:     http.StatusOK,
+			body:       "Successfuly executed action arm",
+			users: []User{
+				{ID: "vitorarins", Username: "vitorarins"},
+			},
+		},
+		{
+			caseNumber: 3,
+			route:      "/ifttt/v1/actions/nothome",
+			status:     http.StatusOK,
+			body:       "Successfuly executed action arm",
+			users: []User{
+				{ID: "vitorarins", Username: "vitorarins", Home: &notHome},
+			},
+		},
+		{
+			caseNumber: 4,
+			route:      "/ifttt/v1/actions/nothome",
+			status:     http.StatusOK,
+			body:       "Successfuly executed action arm",
+			users: []User{
+				{ID: "vitorarins", Username: "vitorarins", Home: &atHome},
+			},
+		},
+		{
+			caseNumber: 5,
+			route:      "/ifttt/v1/actions/nothome",
+			status:     http.StatusOK,
+			body:       "Successfuly marked user as not home",
+			users: []User{
+				{ID: "vitorarins", Username: "vitorarins", Home: &atHome},
+				{ID: "testuser", Username: "testuser", Home: &atHome},
+			},
+		},
+		{
+			caseNumber: 6,
+			route:      "/ifttt/v1/actions/nothome",
+			status:     http.StatusOK,
+			body:       "Successfuly executed action arm",
+			users: []User{
+				{ID: "vitorarins", Username: "vitorarins", Home: &atHome},
+				{ID: "testuser", Username: "testuser", Home: &notHome},
+			},
+		},
+		{
+			caseNumber: 7,
+			route:      "/ifttt/v1/actions/nothome",
+			status:     http.StatusOK,
+			body:       "Successfuly marked user as not home",
+			users: []User{
+				{ID: "vitorarins", Username: "vitorarins", Home: &atHome},
+				{ID: "testuser", Username: "testuser"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, NewMemoryUserStore(test.users...), tokens, nil)
+
+		req, err := http.NewRequest("GET", test.route, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := req.URL.Query()
+		q.Add("access_token", token)
+		req.URL.RawQuery = q.Encode()
+
+		rr := httptest.NewRecorder()
+		server := http.HandlerFunc(handler.NotHomeHandler)
+		server.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("unexpected status on test case '%v': got (%v) want (%v)", test.caseNumber, status, test.status)
+		}
+
+		if rr.Body.String() != test.body {
+			t.Errorf("unexpected body on test case '%v': got (%v) want (%v)", test.caseNumber, rr.Body.String(), test.body)
+		}
+	}
+}
+
+func TestNotHomeHandlerWithPanelUser(t *testing.T) {
+	token := issueToken(t, "vitorarins")
+	panel := NewSimulatedPanel("1234", "key")
+	if err := panel.SetUser(ctx, PanelUser{ID: 3, Name: "Schoonmaker", Type: "GRAND_08", PassCode: "5678", Partitions: []int{0}}); err != nil {
+		t.Fatalf("Failed to set panel user: %v", err)
+	}
+	userCodes := func(slot int) (string, error) {
+		return "5678", nil
+	}
+	linked := int64(3)
+	users := NewMemoryUserStore(User{ID: "vitorarins", Username: "vitorarins", PanelUser: &linked})
+	handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, users, tokens, userCodes)
+
+	req, err := http.NewRequest("GET", "/ifttt/v1/actions/nothome", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := req.URL.Query()
+	q.Add("access_token", token)
+	req.URL.RawQuery = q.Encode()
+
+	rr := httptest.NewRecorder()
+	server := http.HandlerFunc(handler.NotHomeHandler)
+	server.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("unexpected status: got (%v) want (%v)", status, http.StatusOK)
+	}
+
+	events, err := panel.Events(ctx, time.Time{}, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := events[len(events)-1]; got.EventType != "AwayArm" || got.User != "Schoonmaker" {
+		t.Errorf("unexpected last event: got (%+v) want (AwayArm by Schoonmaker)", got)
+	}
+}
+
+func TestHomeHandler(t *testing.T) {
+	token := issueToken(t, "vitorarins")
+	atHome, notHome := true, false
+
+	tests := []struct {
+		caseNumber int
+		route      string
+		status     int
+		body       string
+		users      []User
+	}{
+		{
+			caseNumber: 1,
+			route:      "/ifttt/v1/actions/home",
+			status:     http.StatusInternalServerError,
+			body:       "user not found\n",
+			users:      []User{},
+		},
+		{
+			caseNumber: 2,
+			route:      "/ifttt/v1/actions/home",
+			status:     http.StatusOK,
+			body:       "Successfuly marked user as at home",
+			users: []User{
+				{ID: "vitorarins", Username: "vitorarins"},
+			},
+		},
+		{
+			caseNumber: 3,
+			route:      "/ifttt/v1/actions/home",
+			status:     http.StatusOK,
+			body:       "Successfuly marked user as at home",
+			users: []User{
+				{ID: "vitorarins", Username: "vitorarins", Home: &notHome},
+			},
+		},
+		{
+			caseNumber: 4,
+			route:      "/ifttt/v1/actions/home",
+			status:     http.StatusOK,
+			body:       "Successfuly marked user as at home",
+			users: []User{
+				{ID: "vitorarins", Username: "vitorarins", Home: &atHome},
+			},
+		},
+		{
+			caseNumber: 5,
+			route:      "/ifttt/v1/actions/home",
+			status:     http.StatusOK,
+			body:       "Successfuly marked user as at home",
+			users: []User{
+				{ID: "vitorarins", Username: "vitorarins", Home: &atHome},
+				{ID: "testuser", Username: "testuser", Home: &atHome},
+			},
+		},
+		{
+			caseNumber: 6,
+			route:      "/ifttt/v1/actions/home",
+			status:     http.StatusOK,
+			body:       "Successfuly marked user as at home",
+			users: []User{
+				{ID: "vitorarins", Username: "vitorarins", Home: &atHome},
+				{ID: "testuser", Username: "testuser", Home: &notHome},
+			},
+		},
+		{
+			caseNumber: 7,
+			route:      "/ifttt/v1/actions/home",
+			status:     http.StatusOK,
+			body:       "Successfuly marked user as at home",
+			users: []User{
+				{ID: "vitorarins", Username: "vitorarins", Home: &atHome},
+				{ID: "testuser", Username: "testuser"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		handler := NewHandler(testOauthClientId, testOauthClientSecret, testDomain, []string{testRedirectUrl}, panel, requester, escalation, storer, NewMemoryUserStore(test.users...), tokens, nil)
+
+		req, err := http.NewRequest("GET", test.route, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := req.URL.Query()
+		q.Add("access_token", token)
+		req.URL.RawQuery = q.Encode()
+
+		rr := httptest.NewRecorder()
+		server := http.HandlerFunc(handler.HomeHandler)
+		server.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("unexpected status on test case '%v': got (%v) want (%v)", test.caseNumber, status, test.status)
+		}
+
+		if rr.Body.String() != test.body {
+			t.Errorf("unexpected body on test case '%v': got (%v) want (%v)", test.caseNumber, rr.Body.String(), test.body)
+		}
+	}
+}
+
+func restoreCookies(request *http.Request) {
+	for _, cookie := range globalCookieJar {
+		request.AddCookie(cookie)
+	}
+}
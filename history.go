@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// DetectorTransition is a change of the status or trouble condition of a
+// detector, as seen by a poll of the panel.
+type DetectorTransition struct {
+	Detector string    `json:"detector" firestore:"detector"`
+	Name     string    `json:"name" firestore:"name"`
+	Time     time.Time `json:"time" firestore:"time"`
+	Status   string    `json:"status" firestore:"status"`
+	Trouble  bool      `json:"trouble" firestore:"trouble"`
+}
+
+// maxHistory is the maximum number of transitions returned by a query of
+// the history of a detector.
+const maxHistory = 1000
+
+// storeTransitions appends to the history the detectors in zones whose
+// status or trouble condition differ from the last transition stored for
+// them. Comparing with the stored transition keeps changes made while the
+// app restarted or another instance led the poll. A detector without
+// history gets its current status as first transition.
+func storeTransitions(storer Storer, zones []Zone) {
+	now := time.Now()
+	var transitions []DetectorTransition
+	for _, zone := range zones {
+		id := detectorID(zone.ID)
+		detector, err := storer.GetDetector(id)
+		if err != nil {
+			log.Printf("Could not read the last transition of detector '%v': %v", id, err)
+			continue
+		}
+		if detector.HistoryStatus == zone.Status && detector.HistoryTrouble == zone.Trouble {
+			continue
+		}
+		transitions = append(transitions, DetectorTransition{
+			Detector: id,
+			Name:     zone.Name,
+			Time:     now,
+			Status:   zone.Status,
+			Trouble:  zone.Trouble,
+		})
+	}
+
+	if err := storer.PutDetectorHistory(transitions); err != nil {
+		log.Printf("Got the following error trying to save detector history: %s", err)
+	}
+}
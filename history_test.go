@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreTransitions(t *testing.T) {
+	storer := newFakeStorer()
+	storer.PutDetector("zone-0", "1 Voordeur", "Off")
+	storer.PutDetector("zone-3", "4 Hal Rook", "Off")
+	zones := []Zone{
+		{ID: 0, Name: "1 Voordeur", Status: "Off"},
+		{ID: 3, Name: "4 Hal Rook", Status: "Off"},
+	}
+
+	storeTransitions(storer, zones)
+	assert.Len(t, storer.history, 2, "detectors without history get their current status")
+	storeTransitions(storer, zones)
+	assert.Len(t, storer.history, 2)
+
+	storeTransitions(storer, []Zone{
+		{ID: 0, Name: "1 Voordeur", Status: "On"},
+		{ID: 3, Name: "4 Hal Rook", Status: "Off"},
+	})
+	storeTransitions(storer, []Zone{
+		{ID: 0, Name: "1 Voordeur", Status: "On"},
+		{ID: 3, Name: "4 Hal Rook", Status: "Off", Trouble: true},
+	})
+
+	assert.Len(t, storer.history, 4)
+	assert.Equal(t, "zone-0", storer.history[2].Detector)
+	assert.Equal(t, "1 Voordeur", storer.history[2].Name)
+	assert.Equal(t, "On", storer.history[2].Status)
+	assert.False(t, storer.history[2].Time.IsZero())
+	assert.Equal(t, "zone-3", storer.history[3].Detector)
+	assert.True(t, storer.history[3].Trouble)
+
+	// a change seen by the next leader, or after a restart, is kept
+	storeTransitions(storer, []Zone{
+		{ID: 0, Name: "1 Voordeur", Status: "Off"},
+		{ID: 3, Name: "4 Hal Rook", Status: "Off", Trouble: true},
+	})
+	assert.Len(t, storer.history, 5)
+	assert.Equal(t, "Off", storer.history[4].Status)
+
+	// detectors not stored yet are left for the next poll
+	storeTransitions(storer, []Zone{{ID: 7, Name: "8 Garagedeur", Status: "On"}})
+	assert.Len(t, storer.history, 5)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// detectorsLease is held by the only instance polling the panel for
+// detector changes and reading its event log.
+const detectorsLease = "detectors"
+
+// Lease is held by one instance until it expires, unless renewed.
+type Lease struct {
+	Holder     string    `json:"holder" firestore:"holder"`
+	AcquiredAt time.Time `json:"acquiredAt" firestore:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt" firestore:"expiresAt"`
+}
+
+// Elector runs a task on the only instance holding a lease. The leader
+// renews the lease every third of its ttl, and another instance takes over
+// once it expires.
+type Elector struct {
+	storer Storer
+	name   string
+	holder string
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// NewElector returns an elector competing for the lease name as holder,
+// which must be unique among instances.
+func NewElector(storer Storer, name, holder string, ttl time.Duration) *Elector {
+	return &Elector{
+		storer: storer,
+		name:   name,
+		holder: holder,
+		ttl:    ttl,
+		now:    time.Now,
+	}
+}
+
+// Run runs task whenever the lease is held, until ctx is done. The context
+// given to task is done when ctx is done or the lease is lost, and the
+// lease is only given up once task returned. It is released when ctx is
+// done, so another instance takes over without waiting for it to expire.
+func (e *Elector) Run(ctx context.Context, task func(ctx context.Context)) {
+	for {
+		if e.acquire() {
+			log.Printf("Instance %s is leading %s", e.holder, e.name)
+			e.lead(ctx, task)
+			log.Printf("Instance %s stopped leading %s", e.holder, e.name)
+		}
+		if !sleep(ctx, e.ttl/3) {
+			return
+		}
+	}
+}
+
+// lead runs task while renewing the lease.
+func (e *Elector) lead(ctx context.Context, task func(ctx context.Context)) {
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		task(leaderCtx)
+	}()
+
+	renewed := e.now()
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			e.release()
+			return
+		case <-ctx.Done():
+			<-done
+			e.release()
+			return
+		case <-ticker.C:
+			held, err := e.storer.AcquireLease(e.name, e.holder, e.now(), e.ttl)
+			switch {
+			case err == nil && held:
+				renewed = e.now()
+				continue
+			case err == nil:
+				log.Printf("Instance %s lost the %s lease", e.holder, e.name)
+			case e.now().Sub(renewed) < e.ttl*2/3:
+				log.Printf("Could not renew the %s lease, retrying: %v", e.name, err)
+				continue
+			default:
+				// give the lease up before it expires, another instance
+				// may take it over as soon as it does
+				log.Printf("Could not renew the %s lease in time: %v", e.name, err)
+			}
+			cancel()
+			<-done
+			return
+		}
+	}
+}
+
+// acquire tells whether the lease was acquired.
+func (e *Elector) acquire() bool {
+	held, err := e.storer.AcquireLease(e.name, e.holder, e.now(), e.ttl)
+	if err != nil {
+		log.Printf("Could not acquire the %s lease: %v", e.name, err)
+		return false
+	}
+	return held
+}
+
+func (e *Elector) release() {
+	if err := e.storer.ReleaseLease(e.name, e.holder); err != nil {
+		log.Printf("Could not release the %s lease: %v", e.name, err)
+	}
+}
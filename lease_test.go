@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// leaderTask records which electors run it.
+type leaderTask struct {
+	mu      sync.Mutex
+	running map[string]bool
+	started chan string
+	max     int
+}
+
+func newLeaderTask() *leaderTask {
+	return &leaderTask{running: make(map[string]bool), started: make(chan string, 10)}
+}
+
+func (l *leaderTask) run(holder string) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		l.mu.Lock()
+		l.running[holder] = true
+		if len(l.running) > l.max {
+			l.max = len(l.running)
+		}
+		l.mu.Unlock()
+		l.started <- holder
+
+		<-ctx.Done()
+
+		l.mu.Lock()
+		delete(l.running, holder)
+		l.mu.Unlock()
+	}
+}
+
+func waitLeader(t *testing.T, task *leaderTask) string {
+	select {
+	case holder := <-task.started:
+		return holder
+	case <-time.After(time.Second):
+		t.Fatal("no instance took the lead")
+	}
+	return ""
+}
+
+func TestElector(t *testing.T) {
+	const ttl = 30 * time.Millisecond
+
+	t.Run("RunsTaskOnOneInstance", func(t *testing.T) {
+		storer := newFakeStorer()
+		task := newLeaderTask()
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var wg sync.WaitGroup
+		for _, holder := range []string{"a", "b", "c"} {
+			wg.Add(1)
+			go func(holder string) {
+				defer wg.Done()
+				NewElector(storer, detectorsLease, holder, ttl).Run(ctx, task.run(holder))
+			}(holder)
+		}
+
+		leader := waitLeader(t, task)
+		time.Sleep(5 * ttl)
+		lease, _ := storer.GetLease(detectorsLease)
+		assert.Equal(t, leader, lease.Holder, "the leader keeps renewing its lease")
+
+		cancel()
+		wg.Wait()
+		assert.Equal(t, 1, task.max)
+		lease, _ = storer.GetLease(detectorsLease)
+		assert.Nil(t, lease, "the lease is released on shutdown")
+	})
+
+	t.Run("TakesOverReleasedLease", func(t *testing.T) {
+		storer := newFakeStorer()
+		task := newLeaderTask()
+
+		ctxA, stopA := context.WithCancel(context.Background())
+		doneA := make(chan struct{})
+		go func() {
+			NewElector(storer, detectorsLease, "a", ttl).Run(ctxA, task.run("a"))
+			close(doneA)
+		}()
+		assert.Equal(t, "a", waitLeader(t, task))
+
+		ctxB, stopB := context.WithCancel(context.Background())
+		defer stopB()
+		go NewElector(storer, detectorsLease, "b", ttl).Run(ctxB, task.run("b"))
+
+		stopA()
+		<-doneA
+		assert.Equal(t, "b", waitLeader(t, task))
+	})
+
+	t.Run("StopsTaskWhenLeaseIsLost", func(t *testing.T) {
+		storer := newFakeStorer()
+		task := newLeaderTask()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go NewElector(storer, detectorsLease, "a", ttl).Run(ctx, task.run("a"))
+		waitLeader(t, task)
+
+		// another instance took the lease over while this one was paused
+		storer.leaseMu.Lock()
+		storer.leases[detectorsLease] = Lease{Holder: "b", ExpiresAt: time.Now().Add(time.Hour)}
+		storer.leaseMu.Unlock()
+
+		assert.Eventually(t, func() bool {
+			task.mu.Lock()
+			defer task.mu.Unlock()
+			return !task.running["a"]
+		}, time.Second, ttl/3)
+	})
+}
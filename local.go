@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// localStorer keeps everything in an embedded buntdb database, so the app
+// runs without firestore. Values are JSON encoded under keys prefixed by
+// their kind, such as detector:zone-0.
+type localStorer struct {
+	db *buntdb.DB
+}
+
+// NewLocalStorer returns a storer keeping everything in db.
+func NewLocalStorer(db *buntdb.DB) Storer {
+	return &localStorer{db: db}
+}
+
+// getJSON decodes the value of key into v.
+func getJSON(tx *buntdb.Tx, key string, v interface{}) error {
+	value, err := tx.Get(key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(value), v)
+}
+
+// setJSON stores v encoded as the value of key.
+func setJSON(tx *buntdb.Tx, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, _, err = tx.Set(key, string(value), nil)
+	return err
+}
+
+// nextSequence returns the next value of the sequence name, starting at 1.
+func nextSequence(tx *buntdb.Tx, name string) (int64, error) {
+	key := "sequence:" + name
+	value, err := tx.Get(key)
+	if err != nil && err != buntdb.ErrNotFound {
+		return 0, err
+	}
+	next := int64(1)
+	if value != "" {
+		current, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		next = current + 1
+	}
+	_, _, err = tx.Set(key, strconv.FormatInt(next, 10), nil)
+	return next, err
+}
+
+// PutDetector adds or updates the detector with the given id, keeping its
+// name up to date with the panel.
+func (s *localStorer) PutDetector(id, name, status string) error {
+	if id == "" {
+		return fmt.Errorf("ID cannot be empty (id: %v, name: %v, status: %v)", id, name, status)
+	}
+
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		detector := Detector{ID: id}
+		if err := getJSON(tx, "detector:"+id, &detector); err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+		detector.Name = name
+		detector.Status = status
+		return setJSON(tx, "detector:"+id, detector)
+	})
+}
+
+// PutDetectorTrouble sets whether the detector with the given id is
+// reporting a trouble condition, keeping its status.
+func (s *localStorer) PutDetectorTrouble(id string, trouble bool) error {
+	if id == "" {
+		return fmt.Errorf("ID cannot be empty (id: %v, trouble: %v)", id, trouble)
+	}
+
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		detector := Detector{ID: id}
+		if err := getJSON(tx, "detector:"+id, &detector); err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+		detector.Trouble = trouble
+		return setJSON(tx, "detector:"+id, detector)
+	})
+}
+
+func (s *localStorer) GetDetector(id string) (*Detector, error) {
+	if id == "" {
+		return nil, fmt.Errorf("Cannot get detector with empty id")
+	}
+
+	var detector Detector
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		return getJSON(tx, "detector:"+id, &detector)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not get detector %s: %w", id, err)
+	}
+
+	return &detector, nil
+}
+
+// PutEvents stores the given events, keyed like in firestore so events read
+// twice are only stored once.
+func (s *localStorer) PutEvents(events []Event) error {
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		for _, event := range events {
+			if err := setJSON(tx, "event:"+eventID(event), event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetEventCursor returns the stored event log cursor, or nil if the event
+// log was never read.
+func (s *localStorer) GetEventCursor() (*EventCursor, error) {
+	var cursor EventCursor
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		return getJSON(tx, "cursor:events", &cursor)
+	})
+	if err == buntdb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &cursor, nil
+}
+
+func (s *localStorer) PutEventCursor(cursor *EventCursor) error {
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		return setJSON(tx, "cursor:events", cursor)
+	})
+}
+
+// PutPanelState replaces the stored state of the panel.
+func (s *localStorer) PutPanelState(state *PanelState) error {
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		return setJSON(tx, "panel:state", state)
+	})
+}
+
+func (s *localStorer) GetPanelState() (*PanelState, error) {
+	var state PanelState
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		return getJSON(tx, "panel:state", &state)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not get panel state: %w", err)
+	}
+
+	return &state, nil
+}
+
+// PutAuditEntry appends an entry to the audit log.
+func (s *localStorer) PutAuditEntry(entry AuditEntry) error {
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		seq, err := nextSequence(tx, "audit")
+		if err != nil {
+			return err
+		}
+		return setJSON(tx, fmt.Sprintf("audit:%020d", seq), entry)
+	})
+}
+
+// GetPolicies returns the notification policies keyed by detector.
+func (s *localStorer) GetPolicies() (map[string]NotificationPolicy, error) {
+	policies := make(map[string]NotificationPolicy)
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		tx.AscendKeys("policy:*", func(key, value string) bool {
+			var policy NotificationPolicy
+			if err = json.Unmarshal([]byte(value), &policy); err != nil {
+				return false
+			}
+			policies[policy.Detector] = policy
+			return true
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return policies, nil
+}
+
+// PutPolicy replaces the notification policy of a detector.
+func (s *localStorer) PutPolicy(policy NotificationPolicy) error {
+	if policy.Detector == "" {
+		return fmt.Errorf("Detector cannot be empty (policy: %+v)", policy)
+	}
+
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		return setJSON(tx, "policy:"+policy.Detector, policy)
+	})
+}
+
+// DeletePolicy removes the notification policy of a detector, which is
+// then informational in every armed state.
+func (s *localStorer) DeletePolicy(detector string) error {
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Delete("policy:" + detector); err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+// historyKey returns the key of a transition of a detector. Keys of a
+// detector sort by time, then by the order transitions were stored in.
+func historyKey(detector string, t time.Time, seq int64) string {
+	return fmt.Sprintf("history:%s:%020d:%020d", detector, t.UnixNano(), seq)
+}
+
+// PutDetectorHistory appends transitions to the history of their detectors
+// and stores them as the last transition of their detector.
+func (s *localStorer) PutDetectorHistory(transitions []DetectorTransition) error {
+	if len(transitions) == 0 {
+		return nil
+	}
+
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		for _, transition := range transitions {
+			if transition.Detector == "" {
+				return fmt.Errorf("Detector cannot be empty (transition: %+v)", transition)
+			}
+			seq, err := nextSequence(tx, "history")
+			if err != nil {
+				return err
+			}
+			if err := setJSON(tx, historyKey(transition.Detector, transition.Time, seq), transition); err != nil {
+				return err
+			}
+
+			detector := Detector{ID: transition.Detector}
+			if err := getJSON(tx, "detector:"+transition.Detector, &detector); err != nil && err != buntdb.ErrNotFound {
+				return err
+			}
+			detector.HistoryStatus = transition.Status
+			detector.HistoryTrouble = transition.Trouble
+			if err := setJSON(tx, "detector:"+transition.Detector, detector); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetDetectorHistory returns the transitions of a detector from from up to
+// to, excluded, oldest first. At most maxHistory transitions are returned.
+func (s *localStorer) GetDetectorHistory(id string, from, to time.Time) ([]DetectorTransition, error) {
+	if id == "" {
+		return nil, fmt.Errorf("Cannot get history of detector with empty id")
+	}
+
+	transitions := []DetectorTransition{}
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		tx.AscendRange("", historyKey(id, from, 0), historyKey(id, to, 0), func(key, value string) bool {
+			var transition DetectorTransition
+			if err = json.Unmarshal([]byte(value), &transition); err != nil {
+				return false
+			}
+			transitions = append(transitions, transition)
+			return len(transitions) < maxHistory
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return transitions, nil
+}
+
+// AcquireLease gives the lease name to holder for ttl from now when it is
+// free, expired or already held by holder. It tells whether holder holds
+// the lease.
+func (s *localStorer) AcquireLease(name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	if name == "" || holder == "" {
+		return false, fmt.Errorf("Name and holder cannot be empty (name: %v, holder: %v)", name, holder)
+	}
+
+	acquired := false
+	err := s.db.Update(func(tx *buntdb.Tx) error {
+		lease := Lease{Holder: holder, AcquiredAt: now}
+		var current Lease
+		err := getJSON(tx, "lease:"+name, &current)
+		switch {
+		case err == buntdb.ErrNotFound:
+		case err != nil:
+			return err
+		case current.Holder != holder && now.Before(current.ExpiresAt):
+			return nil
+		case current.Holder == holder:
+			lease.AcquiredAt = current.AcquiredAt
+		}
+		lease.ExpiresAt = now.Add(ttl)
+		acquired = true
+
+		return setJSON(tx, "lease:"+name, lease)
+	})
+
+	return acquired, err
+}
+
+// ReleaseLease frees the lease name when it is held by holder.
+func (s *localStorer) ReleaseLease(name, holder string) error {
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		var lease Lease
+		err := getJSON(tx, "lease:"+name, &lease)
+		if err == buntdb.ErrNotFound || (err == nil && lease.Holder != holder) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Delete("lease:" + name)
+		return err
+	})
+}
+
+// GetLease returns the lease name, or nil if it is not held.
+func (s *localStorer) GetLease(name string) (*Lease, error) {
+	var lease Lease
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		return getJSON(tx, "lease:"+name, &lease)
+	})
+	if err == buntdb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &lease, nil
+}
+
+// UpdateAlarm changes the stored alarm with update, which tells whether it
+// changed it. A missing alarm is given as the zero Alarm.
+func (s *localStorer) UpdateAlarm(update func(alarm *Alarm) bool) error {
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		var alarm Alarm
+		if err := getJSON(tx, "panel:alarm", &alarm); err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+		if !update(&alarm) {
+			return nil
+		}
+		return setJSON(tx, "panel:alarm", alarm)
+	})
+}
+
+type localUserStore struct {
+	db *buntdb.DB
+}
+
+// NewLocalUserStore returns a user store keeping users in db.
+func NewLocalUserStore(db *buntdb.DB) UserStore {
+	return &localUserStore{db: db}
+}
+
+func (s *localUserStore) GetUser(ctx context.Context, id string) (*User, error) {
+	var user User
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		return getJSON(tx, "user:"+id, &user)
+	})
+	if err == buntdb.ErrNotFound {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.ID = id
+
+	return &user, nil
+}
+
+func (s *localUserStore) ListUsers(ctx context.Context) ([]User, error) {
+	users := []User{}
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		tx.AscendKeys("user:*", func(key, value string) bool {
+			var user User
+			if err = json.Unmarshal([]byte(value), &user); err != nil {
+				return false
+			}
+			user.ID = strings.TrimPrefix(key, "user:")
+			users = append(users, user)
+			return true
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// PutUser replaces the user.
+func (s *localUserStore) PutUser(ctx context.Context, user User) error {
+	if user.ID == "" {
+		return fmt.Errorf("ID cannot be empty (username: %v)", user.Username)
+	}
+
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		return setJSON(tx, "user:"+user.ID, user)
+	})
+}
+
+// SetUserHome sets whether an existing user is at home.
+func (s *localUserStore) SetUserHome(ctx context.Context, id string, home bool) error {
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		var user User
+		err := getJSON(tx, "user:"+id, &user)
+		if err == buntdb.ErrNotFound {
+			return errUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		user.Home = &home
+		return setJSON(tx, "user:"+id, user)
+	})
+}
+
+func (s *localUserStore) CheckPassword(ctx context.Context, username, password string) (*User, error) {
+	user, err := s.GetUser(ctx, username)
+
+	return checkPassword(user, err, password)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/buntdb"
+)
+
+func newTestDB(t *testing.T) *buntdb.DB {
+	db, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatalf("Could not open buntdb: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestLocalStorerDetectors(t *testing.T) {
+	storer := NewLocalStorer(newTestDB(t))
+
+	assert.Nil(t, storer.PutDetector("zone-3", "4 Hal Rook", "Off"))
+	assert.Nil(t, storer.PutDetectorTrouble("zone-3", true))
+	assert.Nil(t, storer.PutDetector("zone-3", "4 Hal Rookmelder", "On"))
+
+	d, err := storer.GetDetector("zone-3")
+	assert.Nil(t, err)
+	assert.Equal(t, &Detector{ID: "zone-3", Name: "4 Hal Rookmelder", Status: "On", Trouble: true}, d)
+
+	_, err = storer.GetDetector("zone-4")
+	assert.Error(t, err)
+	assert.EqualError(t, storer.PutDetector("", "4 Hal Rook", "Off"), "ID cannot be empty (id: , name: 4 Hal Rook, status: Off)")
+	_, err = storer.GetDetector("")
+	assert.EqualError(t, err, "Cannot get detector with empty id")
+}
+
+func TestLocalStorerEvents(t *testing.T) {
+	storer := NewLocalStorer(newTestDB(t))
+
+	cursor, err := storer.GetEventCursor()
+	assert.Nil(t, err)
+	assert.Nil(t, cursor)
+
+	now := time.Date(2019, 8, 2, 10, 0, 0, 0, time.UTC)
+	assert.Nil(t, storer.PutEvents([]Event{{Time: now, EventType: "ZoneOpen", Zone: "1 Voordeur"}}))
+	assert.Nil(t, storer.PutEventCursor(&EventCursor{NewerThan: now, Offset: 1, Latest: now}))
+	cursor, err = storer.GetEventCursor()
+	assert.Nil(t, err)
+	assert.Equal(t, &EventCursor{NewerThan: now, Offset: 1, Latest: now}, cursor)
+
+	_, err = storer.GetPanelState()
+	assert.Error(t, err)
+	assert.Nil(t, storer.PutPanelState(&PanelState{UpdatedAt: now, SystemStatus: "Disarmed"}))
+	state, err := storer.GetPanelState()
+	assert.Nil(t, err)
+	assert.Equal(t, "Disarmed", state.SystemStatus)
+
+	assert.Nil(t, storer.PutAuditEntry(AuditEntry{Time: now, Actor: "admin", Action: "revoke-user-code", Target: "user 3"}))
+	assert.Nil(t, storer.PutAuditEntry(AuditEntry{Time: now, Actor: "admin", Action: "revoke-user-code", Target: "user 4"}))
+}
+
+func TestLocalStorerPolicies(t *testing.T) {
+	storer := NewLocalStorer(newTestDB(t))
+
+	assert.Nil(t, storer.PutPolicy(NotificationPolicy{Detector: "zone-0", Armed: intrusionLevel}))
+	assert.Nil(t, storer.PutPolicy(NotificationPolicy{Detector: "zone-3", Disarmed: silentLevel}))
+	assert.Nil(t, storer.DeletePolicy("zone-3"))
+	assert.Nil(t, storer.DeletePolicy("zone-5"))
+	assert.Error(t, storer.PutPolicy(NotificationPolicy{Armed: intrusionLevel}))
+
+	policies, err := storer.GetPolicies()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]NotificationPolicy{"zone-0": {Detector: "zone-0", Armed: intrusionLevel}}, policies)
+}
+
+func TestLocalStorerHistory(t *testing.T) {
+	storer := NewLocalStorer(newTestDB(t))
+
+	start := time.Date(2019, 8, 2, 10, 0, 0, 0, time.UTC)
+	assert.Nil(t, storer.PutDetectorHistory([]DetectorTransition{
+		{Detector: "zone-1", Time: start, Status: "On"},
+		{Detector: "zone-10", Time: start, Status: "On"},
+		{Detector: "zone-1", Time: start.Add(time.Minute), Status: "Off"},
+		{Detector: "zone-1", Time: start.Add(time.Hour), Status: "On"},
+	}))
+
+	history, err := storer.GetDetectorHistory("zone-1", start, start.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, []DetectorTransition{
+		{Detector: "zone-1", Time: start, Status: "On"},
+		{Detector: "zone-1", Time: start.Add(time.Minute), Status: "Off"},
+	}, history)
+
+	history, err = storer.GetDetectorHistory("zone-2", start, start.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Empty(t, history)
+
+	d, err := storer.GetDetector("zone-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "On", d.HistoryStatus, "the last transition is kept with the detector")
+}
+
+func TestLocalStorerLease(t *testing.T) {
+	storer := NewLocalStorer(newTestDB(t))
+
+	now := time.Date(2019, 8, 2, 10, 0, 0, 0, time.UTC)
+	held, err := storer.AcquireLease(detectorsLease, "a", now, 15*time.Second)
+	assert.Nil(t, err)
+	assert.True(t, held)
+	held, _ = storer.AcquireLease(detectorsLease, "b", now.Add(5*time.Second), 15*time.Second)
+	assert.False(t, held)
+	held, _ = storer.AcquireLease(detectorsLease, "b", now.Add(15*time.Second), 15*time.Second)
+	assert.True(t, held)
+
+	assert.Nil(t, storer.ReleaseLease(detectorsLease, "a"))
+	lease, err := storer.GetLease(detectorsLease)
+	assert.Nil(t, err)
+	assert.Equal(t, &Lease{Holder: "b", AcquiredAt: now.Add(15 * time.Second), ExpiresAt: now.Add(30 * time.Second)}, lease)
+
+	assert.Nil(t, storer.ReleaseLease(detectorsLease, "b"))
+	lease, err = storer.GetLease(detectorsLease)
+	assert.Nil(t, err)
+	assert.Nil(t, lease)
+}
+
+func TestLocalStorerAlarm(t *testing.T) {
+	storer := NewLocalStorer(newTestDB(t))
+	notified := time.Date(2019, 8, 2, 10, 0, 0, 0, time.UTC)
+
+	var read Alarm
+	assert.Nil(t, storer.UpdateAlarm(func(alarm *Alarm) bool {
+		read = *alarm
+		alarm.Active = true
+		alarm.LastNotified = notified
+		return true
+	}))
+	assert.Equal(t, Alarm{}, read)
+
+	// alarms left unchanged are not written
+	assert.Nil(t, storer.UpdateAlarm(func(alarm *Alarm) bool {
+		alarm.Acknowledged = true
+		return false
+	}))
+	assert.Nil(t, storer.UpdateAlarm(func(alarm *Alarm) bool {
+		read = *alarm
+		return false
+	}))
+	assert.Equal(t, Alarm{Active: true, LastNotified: notified}, read)
+}
+
+func TestLocalUserStore(t *testing.T) {
+	users := NewLocalUserStore(newTestDB(t))
+
+	_, err := users.GetUser(ctx, "alice")
+	assert.Equal(t, errUserNotFound, err)
+	assert.Equal(t, errUserNotFound, users.SetUserHome(ctx, "alice", true))
+
+	slot := int64(3)
+	assert.Nil(t, users.PutUser(ctx, User{ID: "alice", Username: "alice", Password: "hash", PanelUser: &slot}))
+	assert.Nil(t, users.PutUser(ctx, User{ID: "bob", Username: "bob", Admin: true}))
+	assert.Nil(t, users.SetUserHome(ctx, "alice", false))
+
+	user, err := users.GetUser(ctx, "alice")
+	assert.Nil(t, err)
+	assert.False(t, user.AtHome())
+	assert.Equal(t, int64(3), *user.PanelUser)
+
+	list, err := users.ListUsers(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, "bob", list[1].ID)
+	assert.True(t, list[1].AtHome(), "users that never reported are at home")
+}
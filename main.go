@@ -2,30 +2,53 @@ package main
 
 import (
 	"context"
+	"encoding/gob"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 
-	"cloud.google.com/go/firestore"
 	"github.com/alecthomas/kingpin"
+	"github.com/go-session/session"
 )
 
 var (
 
 	// flags
 	port              = kingpin.Flag("port", "The port to be allocated for this http service.").Default("8080").Envar("PORT").String()
-	actionsLocation   = kingpin.Flag("actions-location", "The location where to get data for actions against APIs.").Default("action-data").Envar("ACTIONS_LOCATION").String()
 	secretman         = kingpin.Flag("secretman", "Enable google's secret manager to access config variables.").Envar("SECRETMAN").Bool()
+	panelDriver       = kingpin.Flag("panel", "Driver of the alarm panel, elas or simulated.").Default(elasDriver).Envar("PANEL").Enum(elasDriver, simulatedDriver)
 	feenstraPassCode  = kingpin.Flag("pass-code", "Pass code used for Feenstra system.").Envar("PASS_CODE").String()
 	feenstraKey       = kingpin.Flag("feenstra-key", "Key used for requests against Feenstra sytem.").Envar("FEENSTRA_KEY").String()
+	feenstraUrl       = kingpin.Flag("feenstra-url", "Address of the Feenstra web service.").Default("https://www.feenstraveilig.nl:450/ELAS/WUWS/WUREQUEST.ASMX").Envar("FEENSTRA_URL").String()
 	makerKey          = kingpin.Flag("maker-key", "Key used for requests against IFTT Maker sytem.").Envar("MAKER_KEY").String()
-	firestoreProject  = kingpin.Flag("firestore-project", "Id of GCP project of firestore instance.").Envar("FIRESTORE_PROJECT_ID").Required().String()
+	firestoreProject  = kingpin.Flag("firestore-project", "Id of GCP project of firestore instance, required by the firestore storage and the secret manager.").Envar("FIRESTORE_PROJECT_ID").String()
+	storageDriver     = kingpin.Flag("storage", "Where data is kept, firestore or local files.").Default(firestoreStorage).Envar("STORAGE").Enum(firestoreStorage, localStorage)
+	storageDir        = kingpin.Flag("storage-dir", "Directory of the files of the local storage.").Default("data").Envar("STORAGE_DIR").String()
+	usersFile         = kingpin.Flag("users-file", "JSON file of users to add to the storage on start, with their username, bcrypt password hash, admin and panelUser, whose code is read from PANEL_USER_{id}.").Envar("USERS_FILE").String()
 	oauthClientId     = kingpin.Flag("client-id", "Id of Client to do OAuth.").Envar("OAUTH_CLIENT_ID").String()
 	oauthClientSecret = kingpin.Flag("client-secret", "OAuth server client secret.").Envar("OAUTH_CLIENT_SECRET").String()
 	redirectURIs      = kingpin.Flag("redirect-uris", "Comma separated list of authorized redirect URIs.").Envar("REDIRECT_URIS").String()
 	domain            = kingpin.Flag("domain", "Domain that this application will serve.").Envar("DOMAIN").String()
+	alarmRepeat       = kingpin.Flag("alarm-repeat", "Interval between notifications while an alarm is not acknowledged.").Default("5m").Envar("ALARM_REPEAT").Duration()
+	alarmEscalate     = kingpin.Flag("alarm-escalate-after", "Number of reminders sent before an alarm is escalated to more contacts.").Default("3").Envar("ALARM_ESCALATE_AFTER").Int()
+	eventsInterval    = kingpin.Flag("events-interval", "Interval between reads of the panel event log.").Default("1m").Envar("EVENTS_INTERVAL").Duration()
+	pollInterval      = kingpin.Flag("poll-interval", "Interval between reads of the panel state.").Default("1s").Envar("POLL_INTERVAL").Duration()
+	pollJitter        = kingpin.Flag("poll-jitter", "Maximum random delay added to every poll interval.").Default("0s").Envar("POLL_JITTER").Duration()
+	debounceHold      = kingpin.Flag("debounce-hold", "Time a detector status must last before it is reported.").Default("0s").Envar("DEBOUNCE_HOLD").Duration()
+	debounceWindow    = kingpin.Flag("debounce-window", "Minimum time between two reports of the status of a detector.").Default("0s").Envar("DEBOUNCE_WINDOW").Duration()
+	detectorDebounce  = kingpin.Flag("detector-debounce", "Hold time and window of a detector as ID=HOLD,WINDOW, such as zone-2=10s,1m. Can be repeated.").Envar("DETECTOR_DEBOUNCE").StringMap()
+	activationsPeriod = kingpin.Flag("activations-summary", "Period of the summaries of detector activations held back, 0 disables them.").Default("5m").Envar("ACTIVATIONS_SUMMARY").Duration()
+	detectorEvent     = kingpin.Flag("detector-event", "Template of the Maker event names of detector statuses, with the fields ID, Zone, Name and Status.").Default(DefaultDetectorEvent).Envar("DETECTOR_EVENT").String()
+	migrateDetectors  = kingpin.Flag("migrate-detectors", "Rewrite the detectors stored by name under the id of their zone before starting.").Envar("MIGRATE_DETECTORS").Bool()
+	instanceID        = kingpin.Flag("instance-id", "Id of this instance in the election of the instance polling the panel, the host name and process id by default.").Envar("GAE_INSTANCE").String()
+	leaseTTL          = kingpin.Flag("lease-ttl", "Time after which another instance takes over polling the panel when the leader stops renewing its lease.").Default("15s").Envar("LEASE_TTL").Duration()
+	shutdownTimeout   = kingpin.Flag("shutdown-timeout", "Time given to in-flight requests and notifications to finish on shutdown, and the longest a poll of the panel may take.").Default("25s").Envar("SHUTDOWN_TIMEOUT").Duration()
 )
 
 func main() {
@@ -47,7 +70,18 @@ func main() {
 	log.SetFlags(log.Flags() &^ (log.Ldate | log.Ltime))
 	log.Println("Alarm System is up and running...")
 
+	// a poll interval of 0 would poll the panel in a busy loop
+	if *pollInterval <= 0 {
+		log.Fatalf("The poll interval must be positive, got %v", *pollInterval)
+	}
+
+	// codes of the panel users linked to web users are kept with the other
+	// secrets, or in the environment without the secret manager
+	userCodes := UserCodes(EnvUserCode)
 	if *secretman {
+		if *firestoreProject == "" {
+			log.Fatal("The secret manager needs a firestore project")
+		}
 		secretAccessor, err := NewSecretAccessor(*firestoreProject)
 		if err != nil {
 			log.Fatal(err)
@@ -55,20 +89,62 @@ func main() {
 		if err := secretAccessor.GetAllVariables(flags); err != nil {
 			log.Fatal(err)
 		}
+		userCodes = secretAccessor.UserCode
 	}
 	redirectURIList := strings.Split(*redirectURIs, ",")
 
-	// setup firestore client
+	// setup storage, firestore uses a context that outlives the shutdown
 	ctx := context.Background()
-	client, err := firestore.NewClient(ctx, *firestoreProject)
+	storage, err := OpenStorage(ctx, *storageDriver, *firestoreProject, *storageDir)
 	if err != nil {
-		log.Fatalf("Could not create firestore client: %v", err)
+		log.Fatalf("Could not open storage: %v", err)
+	}
+	defer storage.Close()
+	if *usersFile != "" {
+		loaded, err := LoadUsers(ctx, storage.Users, *usersFile)
+		if err != nil {
+			log.Fatalf("Could not load users: %v", err)
+		}
+		log.Printf("Loaded %d users", loaded)
+	}
+	if storage.Sessions != nil {
+		// sessions hold the authorize request while users log in
+		gob.Register(url.Values{})
+		session.InitManager(session.SetStore(storage.Sessions))
 	}
 
 	// setup requester, storer and http handler
-	requester := NewRequester(*actionsLocation, *feenstraPassCode, *feenstraKey, *makerKey)
-	storer := NewStorer(ctx, client)
-	handler := NewHandler(*oauthClientId, *oauthClientSecret, *domain, redirectURIList, requester, client)
+	panel, err := NewAlarmPanel(*panelDriver, *feenstraPassCode, *feenstraKey, *feenstraUrl)
+	if err != nil {
+		log.Fatalf("Could not create alarm panel: %v", err)
+	}
+	if *migrateDetectors {
+		if storage.Firestore == nil {
+			log.Fatalf("Detectors can only be migrated in the firestore storage")
+		}
+		reply, err := panel.State(ctx)
+		if err != nil {
+			log.Fatalf("Could not read the panel zones to migrate detectors: %v", err)
+		}
+		migrated, err := MigrateDetectors(ctx, storage.Firestore, reply.Zones)
+		if err != nil {
+			log.Fatalf("Could not migrate detectors: %v", err)
+		}
+		log.Printf("Migrated %d detectors", migrated)
+	}
+	detectorEventTemplate, err := ParseDetectorEvent(*detectorEvent)
+	if err != nil {
+		log.Fatalf("Could not read detector event template: %v", err)
+	}
+	requester := NewRequester(*makerKey, detectorEventTemplate)
+	storer := storage.Storer
+	escalation := NewEscalation(requester, storer, *alarmRepeat, *alarmEscalate)
+	debounceConfigs, err := ParseDebounceConfigs(*detectorDebounce)
+	if err != nil {
+		log.Fatalf("Could not read detector debounce: %v", err)
+	}
+	debouncer := NewDebouncer(DebounceConfig{Hold: *debounceHold, Window: *debounceWindow}, debounceConfigs, *activationsPeriod)
+	handler := NewHandler(*oauthClientId, *oauthClientSecret, *domain, redirectURIList, panel, requester, escalation, storer, storage.Users, storage.Tokens, userCodes)
 
 	http.HandleFunc("/login", handler.LoginHandler)
 	http.HandleFunc("/auth", handler.AuthHandler)
@@ -76,18 +152,81 @@ func main() {
 	http.HandleFunc("/token", handler.TokenHandler)
 	http.HandleFunc("/", handler.IndexHandler)
 	http.HandleFunc("/alarm/", handler.AlarmHandler)
+	http.HandleFunc("/alarm/state", handler.StateHandler)
+	http.HandleFunc("/alarm/zones/", handler.BypassHandler)
+	http.HandleFunc("/alarm/acknowledge", handler.AcknowledgeHandler)
+	http.HandleFunc("/alarm/users", handler.UsersHandler)
+	http.HandleFunc("/alarm/users/", handler.UsersHandler)
+	http.HandleFunc("/alarm/policies", handler.PoliciesHandler)
+	http.HandleFunc("/alarm/policies/", handler.PoliciesHandler)
+	http.HandleFunc("/api/detectors/", handler.HistoryHandler)
+	http.HandleFunc("/metrics/latency", handler.MetricsHandler)
 	http.HandleFunc("/ifttt/v1/actions/partarm", handler.AlarmHandler)
 	http.HandleFunc("/ifttt/v1/actions/disarm", handler.AlarmHandler)
 	http.HandleFunc("/ifttt/v1/actions/fullarm", handler.AlarmHandler)
+	http.HandleFunc("/ifttt/v1/actions/acknowledge", handler.AcknowledgeHandler)
 	http.HandleFunc("/ifttt/v1/user/info", handler.IFTTTHandler)
 	http.HandleFunc("/ifttt/v1/status", handler.StatusHandler)
 	http.HandleFunc("/status", handler.StatusHandler)
 	http.HandleFunc("/ifttt/v1/actions/nothome", handler.NotHomeHandler)
 	http.HandleFunc("/ifttt/v1/actions/home", handler.HomeHandler)
 
-	log.Println("Managing Detectors Alert")
-	go ManageDectetorsAlert(storer, requester)
+	// App Engine sends SIGTERM before stopping an instance
+	runCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	var loops sync.WaitGroup
+	loops.Add(1)
+
+	// several instances may run, only the lease holder polls the detectors
+	// and ingests the event log
+	if *instanceID == "" {
+		hostname, _ := os.Hostname()
+		*instanceID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	elector := NewElector(storer, detectorsLease, *instanceID, *leaseTTL)
+
+	log.Println("Managing Detectors Alert and Ingesting Panel Events")
+	go func() {
+		defer loops.Done()
+		elector.Run(runCtx, func(ctx context.Context) {
+			ingested := make(chan struct{})
+			go func() {
+				defer close(ingested)
+				ManageEventsIngestion(ctx, storer, panel, *eventsInterval)
+			}()
+			ManageDectetorsAlert(ctx, storer, panel, requester, escalation, debouncer, *pollInterval, *pollJitter, *shutdownTimeout)
+			<-ingested
+		})
+	}()
 
-	log.Printf("Listening on port %s", *port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", *port), nil))
+	server := &http.Server{Addr: fmt.Sprintf(":%s", *port)}
+	go func() {
+		log.Printf("Listening on port %s", *port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-runCtx.Done()
+	stop()
+	log.Println("Shutting down, draining requests and notifications")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error draining http requests: %v", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		loops.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		log.Println("Alarm System stopped")
+	case <-shutdownCtx.Done():
+		log.Println("Alarm System stopped before the panel loops finished")
+	}
 }
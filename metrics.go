@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the buckets of latency histograms.
+// Slower requests land in a last, unbounded bucket.
+var latencyBuckets = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// Latency histograms of the requests sent to each endpoint, served by
+// MetricsHandler.
+var (
+	feenstraLatency = NewHistogram()
+	makerLatency    = NewHistogram()
+)
+
+// Histogram counts durations in latencyBuckets. It is safe for concurrent
+// use.
+type Histogram struct {
+	mu     sync.Mutex
+	counts []int64
+	count  int64
+	sum    time.Duration
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make([]int64, len(latencyBuckets)+1)}
+}
+
+// Observe adds a duration to the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+// HistogramSnapshot is the content of a histogram at some point, as
+// exposed by the API. Durations are in milliseconds.
+type HistogramSnapshot struct {
+	Count   int64            `json:"count"`
+	SumMs   float64          `json:"sumMs"`
+	Buckets []BucketSnapshot `json:"buckets"`
+}
+
+// BucketSnapshot counts the durations up to LeMs, or every duration
+// above the last bound when LeMs is nil. Counts are cumulative.
+type BucketSnapshot struct {
+	LeMs  *float64 `json:"leMs"`
+	Count int64    `json:"count"`
+}
+
+// Snapshot returns the current content of the histogram.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snapshot := HistogramSnapshot{
+		Count:   h.count,
+		SumMs:   milliseconds(h.sum),
+		Buckets: make([]BucketSnapshot, 0, len(h.counts)),
+	}
+	var cumulative int64
+	for i, count := range h.counts {
+		cumulative += count
+		bucket := BucketSnapshot{Count: cumulative}
+		if i < len(latencyBuckets) {
+			le := milliseconds(latencyBuckets[i])
+			bucket.LeMs = &le
+		}
+		snapshot.Buckets = append(snapshot.Buckets, bucket)
+	}
+
+	return snapshot
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// timedTransport observes the time taken by every round trip, up to the
+// response headers, failed ones included.
+type timedTransport struct {
+	base      http.RoundTripper
+	histogram *Histogram
+}
+
+func (t *timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	t.histogram.Observe(time.Since(start))
+
+	return resp, err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	histogram := NewHistogram()
+	histogram.Observe(10 * time.Millisecond)
+	histogram.Observe(100 * time.Millisecond)
+	histogram.Observe(300 * time.Millisecond)
+	histogram.Observe(time.Minute)
+
+	snapshot := histogram.Snapshot()
+
+	assert.Equal(t, int64(4), snapshot.Count)
+	assert.Equal(t, 60410.0, snapshot.SumMs)
+	assert.Len(t, snapshot.Buckets, len(latencyBuckets)+1)
+
+	var counts []int64
+	for _, bucket := range snapshot.Buckets {
+		counts = append(counts, bucket.Count)
+	}
+	assert.Equal(t, []int64{1, 2, 2, 3, 3, 3, 3, 3, 3, 4}, counts)
+	assert.Equal(t, 50.0, *snapshot.Buckets[0].LeMs)
+	assert.Nil(t, snapshot.Buckets[len(latencyBuckets)].LeMs)
+}
+
+func TestTimedTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	histogram := NewHistogram()
+	client := &http.Client{Transport: &timedTransport{base: http.DefaultTransport, histogram: histogram}}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	_, err := client.Get("http://127.0.0.1:0")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, int64(3), histogram.Snapshot().Count)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+)
+
+// maxBatchDocs is the number of history transitions moved per batch, each
+// of them being written and deleted, within the 500 writes allowed by
+// firestore.
+const maxBatchDocs = 250
+
+// MigrateDetectors rewrites the detectors stored under their name, with
+// spaces replaced by dashes, under the id of the zone of zones with that
+// name. Their history and notification policy are moved along. Detectors
+// already stored under the id of their zone are kept, so the migration can
+// be run again. It returns the number of detectors migrated.
+func MigrateDetectors(ctx context.Context, client *firestore.Client, zones []Zone) (int, error) {
+	byName := make(map[string]Zone, len(zones))
+	for _, zone := range zones {
+		byName[strings.Replace(zone.Name, " ", "-", -1)] = zone
+	}
+
+	docs, err := client.Collection("detectors").Documents(ctx).GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("could not read detectors: %w", err)
+	}
+
+	migrated := 0
+	for _, doc := range docs {
+		if strings.HasPrefix(doc.Ref.ID, "zone-") {
+			continue
+		}
+		zone, ok := byName[doc.Ref.ID]
+		if !ok {
+			log.Printf("No zone of the panel is named %s, detector not migrated", doc.Ref.ID)
+			continue
+		}
+		if err := migrateDetector(ctx, client, doc, zone); err != nil {
+			return migrated, fmt.Errorf("could not migrate detector %s: %w", doc.Ref.ID, err)
+		}
+		log.Printf("Migrated detector %s to %s", doc.Ref.ID, detectorID(zone.ID))
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// migrateDetector moves the legacy detector doc to the id of zone. The
+// legacy doc is deleted last, so a failed migration is retried on the next
+// run. The last transition moved is stored as the last transition of the
+// detector, so the first poll does not append it again.
+func migrateDetector(ctx context.Context, client *firestore.Client, doc *firestore.DocumentSnapshot, zone Zone) error {
+	var legacy Detector
+	if err := doc.DataTo(&legacy); err != nil {
+		return err
+	}
+
+	id := detectorID(zone.ID)
+	ref := client.Collection("detectors").Doc(id)
+	// missing docs are returned as snapshots that do not exist
+	snaps, err := client.GetAll(ctx, []*firestore.DocumentRef{
+		ref,
+		client.Collection("policies").Doc(doc.Ref.ID),
+		client.Collection("policies").Doc(id),
+	})
+	if err != nil {
+		return err
+	}
+	current, policy, currentPolicy := snaps[0], snaps[1], snaps[2]
+
+	history, err := doc.Ref.Collection("history").Documents(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	var last *DetectorTransition
+	for start := 0; start < len(history); start += maxBatchDocs {
+		end := start + maxBatchDocs
+		if end > len(history) {
+			end = len(history)
+		}
+		batch := client.Batch()
+		for _, h := range history[start:end] {
+			var transition DetectorTransition
+			if err := h.DataTo(&transition); err != nil {
+				return err
+			}
+			transition.Detector = id
+			transition.Name = zone.Name
+			if last == nil || transition.Time.After(last.Time) {
+				moved := transition
+				last = &moved
+			}
+			batch.Create(ref.Collection("history").NewDoc(), transition)
+			batch.Delete(h.Ref)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return err
+		}
+	}
+
+	batch := client.Batch()
+	// a detector already stored under its id is newer than the legacy one
+	if !current.Exists() {
+		detector := Detector{
+			ID:             id,
+			Name:           zone.Name,
+			Status:         legacy.Status,
+			Trouble:        legacy.Trouble,
+			HistoryStatus:  legacy.HistoryStatus,
+			HistoryTrouble: legacy.HistoryTrouble,
+		}
+		if last != nil {
+			detector.HistoryStatus = last.Status
+			detector.HistoryTrouble = last.Trouble
+		}
+		batch.Create(ref, detector)
+	}
+	// and so is a policy already stored under its id
+	if policy.Exists() && currentPolicy.Exists() {
+		log.Printf("Policy of %s is already stored under %s, dropping the legacy one", doc.Ref.ID, id)
+		batch.Delete(policy.Ref)
+	} else if policy.Exists() {
+		var p NotificationPolicy
+		if err := policy.DataTo(&p); err != nil {
+			return err
+		}
+		p.Detector = id
+		batch.Create(client.Collection("policies").Doc(id), p)
+		batch.Delete(policy.Ref)
+	}
+	batch.Delete(doc.Ref)
+	_, err = batch.Commit(ctx)
+
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+func TestMigrateDetectors(t *testing.T) {
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not create firestore client: %v", err)
+	}
+
+	legacy := client.Collection("detectors").Doc("8-Garagedeur")
+	if _, err := legacy.Set(ctx, map[string]interface{}{"name": "8-Garagedeur", "status": "On", "trouble": true}); err != nil {
+		t.Fatalf("unexpected error putting legacy detector: %v", err)
+	}
+	start := time.Date(2019, 8, 2, 10, 0, 0, 0, time.UTC)
+	for i, status := range []string{"On", "Off", "On"} {
+		transition := DetectorTransition{Detector: "8-Garagedeur", Time: start.Add(time.Duration(i) * time.Minute), Status: status, Trouble: i == 2}
+		if _, err := legacy.Collection("history").NewDoc().Create(ctx, transition); err != nil {
+			t.Fatalf("unexpected error putting legacy history: %v", err)
+		}
+	}
+	if _, err := client.Collection("policies").Doc("8-Garagedeur").Set(ctx, NotificationPolicy{Detector: "8-Garagedeur", Armed: intrusionLevel}); err != nil {
+		t.Fatalf("unexpected error putting legacy policy: %v", err)
+	}
+
+	zones := []Zone{{ID: 7, Name: "8 Garagedeur"}}
+	migrated, err := MigrateDetectors(ctx, client, zones)
+	if err != nil || migrated != 1 {
+		t.Fatalf("unexpected migration: got (%v, %v) want (1, nil)", migrated, err)
+	}
+
+	storer := NewStorer(ctx, client)
+	d, err := storer.GetDetector("zone-7")
+	if err != nil {
+		t.Fatalf("unexpected error getting detector: %v", err)
+	}
+	if *d != (Detector{ID: "zone-7", Name: "8 Garagedeur", Status: "On", Trouble: true, HistoryStatus: "On", HistoryTrouble: true}) {
+		t.Errorf("unexpected detector: got (%+v)", d)
+	}
+
+	history, err := storer.GetDetectorHistory("zone-7", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error getting detector history: %v", err)
+	}
+	if len(history) != 3 || history[0].Detector != "zone-7" || history[0].Name != "8 Garagedeur" {
+		t.Errorf("unexpected detector history: got (%+v)", history)
+	}
+
+	policies, err := storer.GetPolicies()
+	if err != nil {
+		t.Fatalf("unexpected error getting policies: %v", err)
+	}
+	if _, ok := policies["8-Garagedeur"]; ok || policies["zone-7"].Armed != intrusionLevel {
+		t.Errorf("unexpected policies: got (%+v)", policies)
+	}
+
+	if _, err := legacy.Get(ctx); err == nil {
+		t.Errorf("unexpected legacy detector left after migration")
+	}
+
+	// the policy stored under the id of a zone is newer than the legacy one
+	legacyPolicy := client.Collection("policies").Doc("1-Voordeur")
+	if _, err := client.Collection("detectors").Doc("1-Voordeur").Set(ctx, map[string]interface{}{"name": "1-Voordeur", "status": "Off"}); err != nil {
+		t.Fatalf("unexpected error putting legacy detector: %v", err)
+	}
+	if _, err := legacyPolicy.Set(ctx, NotificationPolicy{Detector: "1-Voordeur", Armed: infoLevel}); err != nil {
+		t.Fatalf("unexpected error putting legacy policy: %v", err)
+	}
+	current := NotificationPolicy{Detector: "zone-0", Armed: intrusionLevel}
+	if _, err := client.Collection("policies").Doc("zone-0").Set(ctx, current); err != nil {
+		t.Fatalf("unexpected error putting policy: %v", err)
+	}
+	zones = append(zones, Zone{ID: 0, Name: "1 Voordeur"})
+	if migrated, err := MigrateDetectors(ctx, client, zones); err != nil || migrated != 1 {
+		t.Fatalf("unexpected migration: got (%v, %v) want (1, nil)", migrated, err)
+	}
+	dsnap, err := client.Collection("policies").Doc("zone-0").Get(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting policy: %v", err)
+	}
+	var kept NotificationPolicy
+	if err := dsnap.DataTo(&kept); err != nil || kept != current {
+		t.Errorf("unexpected policy: got (%+v, %v) want (%+v)", kept, err, current)
+	}
+	if _, err := legacyPolicy.Get(ctx); err == nil {
+		t.Errorf("unexpected legacy policy left after migration")
+	}
+
+	// running again leaves migrated detectors alone
+	if migrated, err := MigrateDetectors(ctx, client, zones); err != nil || migrated != 0 {
+		t.Errorf("unexpected second migration: got (%v, %v) want (0, nil)", migrated, err)
+	}
+}
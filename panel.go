@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AlarmPanel is the alarm panel driven by the app. Calls are abandoned when
+// ctx is done. Commands are sent with the pass code carried by ctx, see
+// WithPassCode, or with the code of the app.
+type AlarmPanel interface {
+	// State reads the current state of the panel, its zones included.
+	State(ctx context.Context) (*PanelReading, error)
+	// Arm sets a partition to the given armed state, Disarm included.
+	Arm(ctx context.Context, partition int, state ArmedState, options ArmOptions) error
+	// Bypass bypasses a zone, or restores it.
+	Bypass(ctx context.Context, zone int64, bypass bool) error
+	// Events reads a page of the event log, oldest events first.
+	Events(ctx context.Context, newerThan time.Time, offset, count int) ([]PanelEvent, error)
+	// SetUser replaces a user slot of the panel. A user of UnusedUserType
+	// clears the slot.
+	SetUser(ctx context.Context, user PanelUser) error
+}
+
+// ArmedState is the arming level of a partition.
+type ArmedState string
+
+const (
+	AwayArm    ArmedState = "AwayArm"
+	PartialArm ArmedState = "PartialArm"
+	Disarm     ArmedState = "Disarm"
+)
+
+// ReadyState tells whether a partition is ready to be armed.
+type ReadyState string
+
+// AlarmState tells whether a partition is in alarm.
+type AlarmState string
+
+// NoAlarm is the alarm state of partitions that are not in alarm.
+const NoAlarm AlarmState = "NoAlarm"
+
+// Active tells whether the state reports an alarm. Every state other than
+// NoAlarm is an alarm, whatever its cause.
+func (s AlarmState) Active() bool {
+	return s != "" && s != NoAlarm
+}
+
+// ArmOptions tune how a partition is armed.
+type ArmOptions struct {
+	// ExitDelay is the time given to leave before the partition is armed.
+	ExitDelay time.Duration
+	// Force arms the partition even when zones are open.
+	Force bool
+}
+
+// PanelReading is the state of the panel read at once.
+type PanelReading struct {
+	SystemStatus     string
+	SystemReady      bool
+	Trouble          bool
+	AlarmPending     bool
+	BatteryLow       bool
+	ACLost           bool
+	BellOn           bool
+	ArmNotAllowed    bool
+	DisarmNotAllowed bool
+	Partitions       []Partition
+	Zones            []Zone
+	Users            []PanelUser
+}
+
+// Partition is the state of a partition of the panel.
+type Partition struct {
+	ID         int
+	ArmedState ArmedState
+	ReadyState ReadyState
+	AlarmState AlarmState
+}
+
+// Zone is a single detector connected to the panel.
+type Zone struct {
+	ID       int64
+	Name     string
+	Type     string
+	Status   string
+	Trouble  bool
+	Bypassed bool
+	Part     string
+	// Partitions are the ids of the partitions the zone belongs to.
+	Partitions []int
+	// Device is the serial number of the device the zone is wired to.
+	Device int
+}
+
+// UnusedUserType is the type of the user slots that are not in use.
+const UnusedUserType = "UserTypeNotSet"
+
+// PanelUser is a user slot of the panel.
+type PanelUser struct {
+	ID       int
+	Name     string
+	Type     string
+	PassCode string
+	Part     string
+	// Partitions are the ids of the partitions the user has access to.
+	Partitions []int
+}
+
+// PanelEvent is a single entry of the panel event log.
+type PanelEvent struct {
+	Time      time.Time
+	EventType string
+	User      string
+	Zone      string
+}
+
+// ErrPanelUnreachable is returned without contacting the panel while it is
+// known to be unreachable.
+var ErrPanelUnreachable = errors.New("panel unreachable")
+
+// Reasons a panel refuses a command.
+const (
+	InvalidPassCode   = "InvalidPassCode"
+	NotReady          = "NotReady"
+	ArmNotAllowed     = "ArmNotAllowed"
+	DisarmNotAllowed  = "DisarmNotAllowed"
+	PanelNotAvailable = "PanelNotAvailable"
+)
+
+// RefusedError is returned when the panel answers a command with a
+// failure. Reason is one of the reasons above, or the answer of the panel
+// when it is none of them.
+type RefusedError struct {
+	Operation string
+	Reason    string
+}
+
+func (e *RefusedError) Error() string {
+	return fmt.Sprintf("%s refused by the panel: %s", e.Operation, e.Reason)
+}
+
+type passCodeKey struct{}
+
+// WithPassCode returns a copy of ctx carrying the pass code of the user on
+// whose behalf commands are sent, so the panel attributes them to that user.
+func WithPassCode(ctx context.Context, passCode string) context.Context {
+	return context.WithValue(ctx, passCodeKey{}, passCode)
+}
+
+// PassCode returns the pass code carried by ctx, or fallback when there is
+// none.
+func PassCode(ctx context.Context, fallback string) string {
+	if passCode, ok := ctx.Value(passCodeKey{}).(string); ok && passCode != "" {
+		return passCode
+	}
+	return fallback
+}
+
+// Panel drivers selected with the panel flag.
+const (
+	elasDriver      = "elas"
+	simulatedDriver = "simulated"
+)
+
+// NewAlarmPanel returns the panel driven by driver. The simulated panel
+// keeps its state in memory and accepts passCode.
+func NewAlarmPanel(driver, passCode, key, url string) (AlarmPanel, error) {
+	switch driver {
+	case elasDriver:
+		return NewELASPanel(passCode, key, url), nil
+	case simulatedDriver:
+		return NewSimulatedPanel(passCode, key), nil
+	}
+
+	return nil, fmt.Errorf("unknown panel driver %s", driver)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAlarmPanel(t *testing.T) {
+	panel, err := NewAlarmPanel(simulatedDriver, "1234", "key", "")
+	assert.Nil(t, err)
+
+	assert.Nil(t, panel.Arm(ctx, 0, PartialArm, ArmOptions{}))
+	reply, err := panel.State(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, PartialArm, reply.Partitions[0].ArmedState)
+
+	panel, err = NewAlarmPanel(elasDriver, "1234", "key", "https://localhost")
+	assert.Nil(t, err)
+	_, ok := panel.(*elasPanel).backend.(*elasService)
+	assert.True(t, ok)
+
+	_, err = NewAlarmPanel("other", "1234", "key", "")
+	assert.EqualError(t, err, "unknown panel driver other")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Notification levels of a detector status change. Silent changes are
+// stored without notifying, informational ones trigger the Maker event of
+// the detector status and intrusions trigger intrusionEvent.
+const (
+	silentLevel    = "silent"
+	infoLevel      = "info"
+	intrusionLevel = "intrusion"
+)
+
+// intrusionEvent is the Maker event sent when a detector is activated while
+// its policy reports an intrusion. The detector and its status are sent as
+// values.
+const intrusionEvent = "Intrusion"
+
+// NotificationPolicy sets the notification level of the status changes of
+// a detector in each armed state. Empty levels are informational.
+type NotificationPolicy struct {
+	Detector  string `json:"detector" firestore:"detector"`
+	Disarmed  string `json:"disarmed" firestore:"disarmed"`
+	PartArmed string `json:"partArmed" firestore:"partArmed"`
+	Armed     string `json:"armed" firestore:"armed"`
+}
+
+// Level returns the notification level of a change to status in the given
+// armed state. Intrusions are only reported when the detector is activated,
+// restores are informational.
+func (p NotificationPolicy) Level(state ArmedState, status string) string {
+	var level string
+	switch state {
+	case AwayArm:
+		level = p.Armed
+	case PartialArm:
+		level = p.PartArmed
+	default:
+		level = p.Disarmed
+	}
+
+	switch {
+	case level == "":
+		return infoLevel
+	case level == intrusionLevel && status != activeStatus:
+		return infoLevel
+	}
+	return level
+}
+
+// Validate checks every level of the policy is known.
+func (p NotificationPolicy) Validate() error {
+	levels := []struct {
+		state string
+		level string
+	}{
+		{"disarmed", p.Disarmed},
+		{"partArmed", p.PartArmed},
+		{"armed", p.Armed},
+	}
+	for _, l := range levels {
+		switch l.level {
+		case "", silentLevel, infoLevel, intrusionLevel:
+		default:
+			return fmt.Errorf("invalid level %s for %s, it must be %s, %s or %s", l.level, l.state, silentLevel, infoLevel, intrusionLevel)
+		}
+	}
+
+	return nil
+}
+
+// zoneArmedState returns the armed state of a zone, the most armed state of
+// the partitions it belongs to.
+func zoneArmedState(zone Zone, partitions []Partition) ArmedState {
+	state := Disarm
+	for _, partition := range partitions {
+		if !inPartition(zone, partition.ID) {
+			continue
+		}
+		switch partition.ArmedState {
+		case AwayArm:
+			return AwayArm
+		case PartialArm:
+			state = PartialArm
+		}
+	}
+
+	return state
+}
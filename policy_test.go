@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotificationPolicyLevel(t *testing.T) {
+	policy := NotificationPolicy{Detector: "1-Voordeur", Disarmed: silentLevel, Armed: intrusionLevel}
+
+	assert.Equal(t, silentLevel, policy.Level(Disarm, "On"))
+	assert.Equal(t, infoLevel, policy.Level(PartialArm, "On"))
+	assert.Equal(t, intrusionLevel, policy.Level(AwayArm, "On"))
+	assert.Equal(t, infoLevel, policy.Level(AwayArm, "Off"))
+	assert.Equal(t, infoLevel, NotificationPolicy{}.Level(AwayArm, "On"))
+}
+
+func TestNotificationPolicyValidate(t *testing.T) {
+	assert.Nil(t, NotificationPolicy{Disarmed: silentLevel, PartArmed: infoLevel, Armed: intrusionLevel}.Validate())
+	assert.EqualError(t, NotificationPolicy{Armed: "loud"}.Validate(), "invalid level loud for armed, it must be silent, info or intrusion")
+}
+
+func TestZoneArmedState(t *testing.T) {
+	partitions := []Partition{
+		{ID: 0, ArmedState: PartialArm},
+		{ID: 1, ArmedState: AwayArm},
+		{ID: 2, ArmedState: Disarm},
+	}
+
+	assert.Equal(t, PartialArm, zoneArmedState(Zone{Partitions: []int{0}}, partitions))
+	assert.Equal(t, AwayArm, zoneArmedState(Zone{Partitions: []int{0, 1}}, partitions))
+	assert.Equal(t, Disarm, zoneArmedState(Zone{Partitions: []int{2}}, partitions))
+	assert.Equal(t, Disarm, zoneArmedState(Zone{Partitions: []int{0}}, nil))
+}
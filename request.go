@@ -1,125 +1,143 @@
 package main
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	neturl "net/url"
+	"strings"
 	"text/template"
 	"time"
 )
 
+// Requester sends notifications through IFTTT Maker. Requests are
+// abandoned when ctx is done.
 type Requester interface {
-	RequestFeenstra(action string) string
-	RequestMakerDetector(detector, status string) string
-	RequestMaker(event string) string
+	RequestMakerDetector(ctx context.Context, detector DetectorEvent, values ...string) error
+	RequestMaker(ctx context.Context, event string) error
+	RequestMakerValues(ctx context.Context, event string, values ...string) error
 }
 
-type requesterImpl struct {
-	ActionsLocation  string
-	FeenstraPassCode string
-	FeenstraKey      string
-	FeenstraUrl      string
-	MakerKey         string
-	MakerUrl         string
+// makerTimeout is the timeout of a whole request to Maker, reading the
+// reply included.
+const makerTimeout = 10 * time.Second
+
+// DefaultDetectorEvent names the Maker events of detector statuses after
+// the name of the detector, such as 1-Voordeur-On.
+const DefaultDetectorEvent = "{{.Name}}-{{.Status}}"
+
+// DetectorEvent is what the template of the Maker event names of detector
+// statuses is executed with.
+type DetectorEvent struct {
+	// ID is the key of the detector, such as zone-0.
+	ID   string
+	Zone int64
+	// Name is the name of the detector on the panel, with spaces replaced
+	// by dashes.
+	Name   string
+	Status string
 }
 
-func NewRequester(actionsLocation, feenstraPassCode, feenstraKey, makerKey string) Requester {
-	return &requesterImpl{
-		ActionsLocation:  actionsLocation,
-		FeenstraPassCode: feenstraPassCode,
-		FeenstraKey:      feenstraKey,
-		FeenstraUrl:      "https://www.feenstraveilig.nl:450/ELAS/WUWS/WUREQUEST.ASMX",
-		MakerKey:         makerKey,
-		MakerUrl:         "https://maker.ifttt.com/trigger",
+// newDetectorEvent returns the event of the detector of zone reaching
+// status.
+func newDetectorEvent(zone Zone, status string) DetectorEvent {
+	return DetectorEvent{
+		ID:     detectorID(zone.ID),
+		Zone:   zone.ID,
+		Name:   strings.Replace(zone.Name, " ", "-", -1),
+		Status: status,
 	}
 }
 
-func (r *requesterImpl) RequestFeenstra(action string) string {
-	file := fmt.Sprintf("%v/%v.xml", r.ActionsLocation, action)
-
-	actionTemplate, err := ioutil.ReadFile(file)
-	if err != nil {
-		log.Printf("Error opening action file %s", file)
-		panic(err)
-	}
-	t := template.Must(template.New("action").Parse(string(actionTemplate)))
-
-	var actionData bytes.Buffer
-	var templateData = map[string]string{
-		"PassCode": r.FeenstraPassCode,
-	}
-	err = t.Execute(&actionData, templateData)
-	if err != nil {
-		log.Printf("Error executing template for action %s", action)
-		panic(err)
-	}
-
-	req, err := http.NewRequest("POST", r.FeenstraUrl, &actionData)
+// ParseDetectorEvent parses the template of the Maker event names of
+// detector statuses, such as DefaultDetectorEvent. Templates referring to
+// unknown fields are refused.
+func ParseDetectorEvent(text string) (*template.Template, error) {
+	tmpl, err := template.New("detector-event").Parse(text)
 	if err != nil {
-		log.Printf("Error creating request for action %s", action)
-		panic(err)
-	}
-	req.Header.Set("Authorization", fmt.Sprintf("Basic %v", r.FeenstraKey))
-	req.Header.Set("User-Agent", "ksoap2-android/2.6.0+")
-	req.Header.Set("Content-Type", "application/soap+xml;charset=utf-8")
-	req.Host = "www.feenstraveilig.nl:450"
-
-	trRenegotiate := &http.Transport{
-		MaxIdleConnsPerHost: 10,
-		TLSClientConfig:     &tls.Config{Renegotiation: tls.RenegotiateFreelyAsClient},
-	}
-	timeout := time.Duration(30 * time.Second)
-
-	client := http.Client{
-		Transport: trRenegotiate,
-		Timeout:   timeout,
+		return nil, err
 	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Error executing request for action %s: %v", action, err)
-		return ""
+	if err := tmpl.Execute(ioutil.Discard, DetectorEvent{}); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, _ := ioutil.ReadAll(resp.Body)
+	return tmpl, nil
+}
 
-	return string(body)
+type requesterImpl struct {
+	MakerKey      string
+	MakerUrl      string
+	MakerHTTP     *http.Client
+	DetectorEvent *template.Template
 }
 
-func (r *requesterImpl) RequestMakerDetector(detector, status string) string {
-	url := fmt.Sprintf("%v/%v-%v/with/key/%v", r.MakerUrl, detector, status, r.MakerKey)
+// NewRequester returns a requester whose HTTP client is shared by every
+// request, so connections are kept alive. The Maker events of detector
+// statuses are named by executing detectorEvent.
+func NewRequester(makerKey string, detectorEvent *template.Template) Requester {
+	makerTransport := http.DefaultTransport.(*http.Transport).Clone()
+	makerTransport.MaxIdleConnsPerHost = 4
+	makerTransport.MaxConnsPerHost = 8
 
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("Error executing request for detector '%s' and status '%s': %v", detector, status, err)
-		return ""
+	return &requesterImpl{
+		MakerKey:      makerKey,
+		MakerUrl:      "https://maker.ifttt.com/trigger",
+		DetectorEvent: detectorEvent,
+		MakerHTTP: &http.Client{
+			Transport: &timedTransport{base: makerTransport, histogram: makerLatency},
+			Timeout:   makerTimeout,
+		},
 	}
-	defer resp.Body.Close()
+}
 
-	log.Println("response Status:", resp.Status)
-	body, _ := ioutil.ReadAll(resp.Body)
-	log.Println("response Body:", string(body))
+// RequestMakerDetector triggers the Maker event of a detector status,
+// carrying up to three values.
+func (r *requesterImpl) RequestMakerDetector(ctx context.Context, detector DetectorEvent, values ...string) error {
+	var event strings.Builder
+	if err := r.DetectorEvent.Execute(&event, detector); err != nil {
+		return fmt.Errorf("could not name event of detector %s: %w", detector.ID, err)
+	}
+	return r.RequestMakerValues(ctx, event.String(), values...)
+}
 
-	return string(body)
+// RequestMaker triggers a Maker event. Replies other than 2xx are returned
+// as errors.
+func (r *requesterImpl) RequestMaker(ctx context.Context, event string) error {
+	return r.RequestMakerValues(ctx, event)
 }
 
-func (r *requesterImpl) RequestMaker(event string) string {
+// RequestMakerValues triggers a Maker event carrying up to three values,
+// sent as the value1, value2 and value3 ingredients.
+func (r *requesterImpl) RequestMakerValues(ctx context.Context, event string, values ...string) error {
+	if len(values) > 3 {
+		return fmt.Errorf("too many values for event %s: %d", event, len(values))
+	}
 	url := fmt.Sprintf("%v/%v/with/key/%v", r.MakerUrl, event, r.MakerKey)
+	if len(values) > 0 {
+		query := neturl.Values{}
+		for i, value := range values {
+			query.Set(fmt.Sprintf("value%d", i+1), value)
+		}
+		url += "?" + query.Encode()
+	}
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		log.Printf("Error executing request for event '%s': %v", event, err)
-		return ""
+		return fmt.Errorf("could not create request for event %s: %w", event, err)
+	}
+	resp, err := r.MakerHTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not execute request for event %s: %w", event, err)
 	}
 	defer resp.Body.Close()
 
-	log.Println("response Status:", resp.Status)
 	body, _ := ioutil.ReadAll(resp.Body)
-	log.Println("response Body:", string(body))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status for event %s: %s: %s", event, resp.Status, body)
+	}
+	log.Printf("Triggered event %s: %s", event, body)
 
-	return string(body)
+	return nil
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestMaker(t *testing.T) {
+	var paths []string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.RequestURI())
+		w.WriteHeader(status)
+		fmt.Fprint(w, "Congratulations!")
+	}))
+	defer server.Close()
+
+	detectorEvent, err := ParseDetectorEvent(DefaultDetectorEvent)
+	assert.Nil(t, err)
+	requester := NewRequester("key", detectorEvent).(*requesterImpl)
+	requester.MakerUrl = server.URL + "/trigger"
+
+	assert.Nil(t, requester.RequestMakerDetector(ctx, newDetectorEvent(Zone{ID: 0, Name: "1 Voordeur"}, "On")))
+	assert.Equal(t, []string{"/trigger/1-Voordeur-On/with/key/key"}, paths)
+
+	assert.Nil(t, requester.RequestMakerDetector(ctx, newDetectorEvent(Zone{ID: 2, Name: "3 Hal Pir"}, activationsStatus), "12", "5"))
+	assert.Equal(t, "/trigger/3-Hal-Pir-Activations/with/key/key?value1=12&value2=5", paths[1])
+	assert.EqualError(t, requester.RequestMakerValues(ctx, "EverybodyOut", "1", "2", "3", "4"), "too many values for event EverybodyOut: 4")
+
+	status = http.StatusUnauthorized
+	err = requester.RequestMaker(ctx, "EverybodyOut")
+	assert.EqualError(t, err, "unexpected status for event EverybodyOut: 401 Unauthorized: Congratulations!")
+}
+
+func TestParseDetectorEvent(t *testing.T) {
+	tmpl, err := ParseDetectorEvent("Zone{{.Zone}}-{{.Status}}")
+	assert.Nil(t, err)
+
+	var event strings.Builder
+	assert.Nil(t, tmpl.Execute(&event, newDetectorEvent(Zone{ID: 2, Name: "3 Hal Pir"}, "On")))
+	assert.Equal(t, "Zone2-On", event.String())
+
+	_, err = ParseDetectorEvent("{{.Label}}-{{.Status}}")
+	assert.Error(t, err)
+	_, err = ParseDetectorEvent("{{.Name")
+	assert.Error(t, err)
+}
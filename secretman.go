@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
@@ -29,6 +30,22 @@ func NewSecretAccessor(projectName string) (SecretAccessor, error) {
 
 type secretAccess func(name string) (string, error)
 
+// UserCodes returns the pass code of a panel user slot.
+type UserCodes func(slot int) (string, error)
+
+// EnvUserCode returns the pass code of a panel user slot, kept in the
+// environment variable PANEL_USER_{slot}, for when the secret manager is
+// not used.
+func EnvUserCode(slot int) (string, error) {
+	name := fmt.Sprintf("PANEL_USER_%d", slot)
+	code := os.Getenv(name)
+	if code == "" {
+		return "", fmt.Errorf("environment variable %s not set", name)
+	}
+
+	return code, nil
+}
+
 func (sa SecretAccessor) GetAllVariables(flags map[string]*string) error {
 
 	if err := sa.PopulateFlags(flags, sa.accessSecretVersion); err != nil {
@@ -41,8 +58,7 @@ func (sa SecretAccessor) GetAllVariables(flags map[string]*string) error {
 func (sa SecretAccessor) PopulateFlags(flags map[string]*string, accessSecrets secretAccess) error {
 	var errs []error
 	for k, v := range flags {
-		secretName := fmt.Sprintf("projects/%s/secrets/%s/versions/latest", sa.projectName, k)
-		result, err := accessSecrets(secretName)
+		result, err := accessSecrets(sa.secretVersion(k))
 		if err != nil {
 			errs = append(errs, err)
 		}
@@ -55,6 +71,17 @@ func (sa SecretAccessor) PopulateFlags(flags map[string]*string, accessSecrets s
 	return nil
 }
 
+// UserCode returns the pass code of a panel user slot, kept in the secret
+// PANEL_USER_{slot}.
+func (sa SecretAccessor) UserCode(slot int) (string, error) {
+	return sa.accessSecretVersion(sa.secretVersion(fmt.Sprintf("PANEL_USER_%d", slot)))
+}
+
+// secretVersion returns the name of the latest version of a secret.
+func (sa SecretAccessor) secretVersion(secret string) string {
+	return fmt.Sprintf("projects/%s/secrets/%s/versions/latest", sa.projectName, secret)
+}
+
 // accessSecretVersion accesses the payload for the given secret version if one
 // exists. The version can be a version number as a string (e.g. "5") or an
 // alias (e.g. "latest").
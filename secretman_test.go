@@ -49,3 +49,14 @@ func TestPopulateFlags(t *testing.T) {
 		})
 	}
 }
+
+func TestEnvUserCode(t *testing.T) {
+	t.Setenv("PANEL_USER_3", "5678")
+
+	if code, err := EnvUserCode(3); code != "5678" || err != nil {
+		t.Errorf("unexpected code of slot 3: got (%v, %v) want (5678, nil)", code, err)
+	}
+	if _, err := EnvUserCode(4); err == nil {
+		t.Errorf("unexpected success reading the code of slot 4")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"reflect"
+	"time"
+)
+
+// PanelState is the state of the panel as exposed by the API and stored
+// in firestore.
+type PanelState struct {
+	UpdatedAt        time.Time        `json:"updatedAt" firestore:"updatedAt"`
+	SystemStatus     string           `json:"systemStatus" firestore:"systemStatus"`
+	SystemReady      bool             `json:"systemReady" firestore:"systemReady"`
+	Trouble          bool             `json:"trouble" firestore:"trouble"`
+	AlarmPending     bool             `json:"alarmPending" firestore:"alarmPending"`
+	BatteryLow       bool             `json:"batteryLow" firestore:"batteryLow"`
+	ACLost           bool             `json:"acLost" firestore:"acLost"`
+	BellOn           bool             `json:"bellOn" firestore:"bellOn"`
+	ArmNotAllowed    bool             `json:"armNotAllowed" firestore:"armNotAllowed"`
+	DisarmNotAllowed bool             `json:"disarmNotAllowed" firestore:"disarmNotAllowed"`
+	Partitions       []PartitionState `json:"partitions" firestore:"partitions"`
+	Users            []UserState      `json:"users" firestore:"users"`
+}
+
+// PartitionState is the state of a partition and the zones belonging to it.
+type PartitionState struct {
+	ID         int         `json:"id" firestore:"id"`
+	ArmedState ArmedState  `json:"armedState" firestore:"armedState"`
+	ReadyState ReadyState  `json:"readyState" firestore:"readyState"`
+	AlarmState AlarmState  `json:"alarmState" firestore:"alarmState"`
+	Zones      []ZoneState `json:"zones" firestore:"zones"`
+}
+
+// ZoneState is the state of a single zone.
+type ZoneState struct {
+	ID       int64  `json:"id" firestore:"id"`
+	Name     string `json:"name" firestore:"name"`
+	Type     string `json:"type" firestore:"type"`
+	Status   string `json:"status" firestore:"status"`
+	Trouble  bool   `json:"trouble" firestore:"trouble"`
+	Bypassed bool   `json:"bypassed" firestore:"bypassed"`
+	Part     string `json:"part" firestore:"part"`
+	Device   int    `json:"device" firestore:"device"`
+}
+
+// UserState describes a panel user slot. Pass codes are never
+// exposed nor stored.
+type UserState struct {
+	ID         int    `json:"id" firestore:"id"`
+	Name       string `json:"name" firestore:"name"`
+	Type       string `json:"type" firestore:"type"`
+	Part       string `json:"part" firestore:"part"`
+	Partitions []int  `json:"partitions" firestore:"partitions"`
+}
+
+func newPanelState(reply *PanelReading) *PanelState {
+	state := &PanelState{
+		SystemStatus:     reply.SystemStatus,
+		SystemReady:      reply.SystemReady,
+		Trouble:          reply.Trouble,
+		AlarmPending:     reply.AlarmPending,
+		BatteryLow:       reply.BatteryLow,
+		ACLost:           reply.ACLost,
+		BellOn:           reply.BellOn,
+		ArmNotAllowed:    reply.ArmNotAllowed,
+		DisarmNotAllowed: reply.DisarmNotAllowed,
+		Partitions:       make([]PartitionState, 0, len(reply.Partitions)),
+		Users:            []UserState{},
+	}
+
+	for _, partition := range reply.Partitions {
+		partitionState := PartitionState{
+			ID:         partition.ID,
+			ArmedState: partition.ArmedState,
+			ReadyState: partition.ReadyState,
+			AlarmState: partition.AlarmState,
+			Zones:      []ZoneState{},
+		}
+		for _, zone := range reply.Zones {
+			if !inPartition(zone, partition.ID) {
+				continue
+			}
+			partitionState.Zones = append(partitionState.Zones, ZoneState{
+				ID:       zone.ID,
+				Name:     zone.Name,
+				Type:     zone.Type,
+				Status:   zone.Status,
+				Trouble:  zone.Trouble,
+				Bypassed: zone.Bypassed,
+				Part:     zone.Part,
+				Device:   zone.Device,
+			})
+		}
+		state.Partitions = append(state.Partitions, partitionState)
+	}
+
+	for _, user := range reply.Users {
+		if user.Type == UnusedUserType {
+			continue
+		}
+		state.Users = append(state.Users, newUserState(user))
+	}
+
+	return state
+}
+
+func newUserState(user PanelUser) UserState {
+	return UserState{
+		ID:         user.ID,
+		Name:       user.Name,
+		Type:       user.Type,
+		Part:       user.Part,
+		Partitions: user.Partitions,
+	}
+}
+
+// sameState tells whether two states only differ in their update time.
+func sameState(a, b *PanelState) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	x, y := *a, *b
+	x.UpdatedAt, y.UpdatedAt = time.Time{}, time.Time{}
+
+	return reflect.DeepEqual(x, y)
+}
+
+func inPartition(zone Zone, partition int) bool {
+	for _, id := range zone.Partitions {
+		if id == partition {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPanelState(t *testing.T) {
+	reply := &PanelReading{
+		SystemStatus: "Disarmed",
+		SystemReady:  true,
+		BatteryLow:   true,
+		Zones: []Zone{
+			{ID: 0, Name: "1 Voordeur", Type: "Unknown", Status: "Off", Partitions: []int{0}, Part: "F", Device: 2},
+			{ID: 7, Name: "8 Garagedeur", Status: "On", Trouble: true, Partitions: []int{1}, Bypassed: true},
+			{ID: 8, Name: "9 Tuin Pir", Status: "Off", Partitions: []int{0, 1}},
+		},
+		Users: []PanelUser{
+			{ID: 0, Name: "Gebruiker 00", Type: "GRAND_08", PassCode: "1234", Part: "F", Partitions: []int{0}},
+			{ID: 1, Type: "UserTypeNotSet", Part: "No"},
+		},
+		Partitions: []Partition{
+			{ID: 0, ArmedState: Disarm, ReadyState: "AwayReady", AlarmState: NoAlarm},
+			{ID: 1, ArmedState: AwayArm, ReadyState: "AwayReady", AlarmState: NoAlarm},
+		},
+	}
+
+	got := newPanelState(reply)
+
+	assert.Equal(t, &PanelState{
+		SystemStatus: "Disarmed",
+		SystemReady:  true,
+		BatteryLow:   true,
+		Partitions: []PartitionState{
+			{
+				ID:         0,
+				ArmedState: Disarm,
+				ReadyState: "AwayReady",
+				AlarmState: NoAlarm,
+				Zones: []ZoneState{
+					{ID: 0, Name: "1 Voordeur", Type: "Unknown", Status: "Off", Part: "F", Device: 2},
+					{ID: 8, Name: "9 Tuin Pir", Status: "Off"},
+				},
+			},
+			{
+				ID:         1,
+				ArmedState: AwayArm,
+				ReadyState: "AwayReady",
+				AlarmState: NoAlarm,
+				Zones: []ZoneState{
+					{ID: 7, Name: "8 Garagedeur", Status: "On", Trouble: true, Bypassed: true},
+					{ID: 8, Name: "9 Tuin Pir", Status: "Off"},
+				},
+			},
+		},
+		Users: []UserState{
+			{ID: 0, Name: "Gebruiker 00", Type: "GRAND_08", Part: "F", Partitions: []int{0}},
+		},
+	}, got)
+}
+
+func TestSameState(t *testing.T) {
+	a := &PanelState{SystemStatus: "Disarmed", UpdatedAt: time.Now()}
+	b := &PanelState{SystemStatus: "Disarmed"}
+	c := &PanelState{SystemStatus: "Armed"}
+
+	assert.True(t, sameState(a, b))
+	assert.False(t, sameState(a, c))
+	assert.False(t, sameState(a, nil))
+	assert.True(t, sameState(nil, nil))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/firestore"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/store"
+	"github.com/go-session/session"
+	"github.com/tidwall/buntdb"
+
+	"github.com/vitorarins/magic-island/bstore"
+	"github.com/vitorarins/magic-island/fstore"
+)
+
+// Storage drivers selected with the storage flag.
+const (
+	firestoreStorage = "firestore"
+	localStorage     = "local"
+)
+
+// Storage is where the app keeps its data.
+type Storage struct {
+	Storer Storer
+	Users  UserStore
+	Tokens oauth2.TokenStore
+	// Sessions is nil when sessions are kept in memory.
+	Sessions session.ManagerStore
+	// Firestore is the client of the firestore storage, nil for the local
+	// one.
+	Firestore *firestore.Client
+
+	close func() error
+}
+
+// OpenStorage opens the storage of driver. Firestore storage uses the
+// firestore of project. Local storage keeps everything in buntdb files in
+// dir, so the app runs without a GCP account.
+func OpenStorage(ctx context.Context, driver, project, dir string) (*Storage, error) {
+	switch driver {
+	case firestoreStorage:
+		if project == "" {
+			return nil, fmt.Errorf("firestore storage needs a firestore project")
+		}
+		client, err := firestore.NewClient(ctx, project)
+		if err != nil {
+			return nil, fmt.Errorf("could not create firestore client: %w", err)
+		}
+		return &Storage{
+			Storer:    NewStorer(ctx, client),
+			Users:     NewFirestoreUserStore(client),
+			Tokens:    fstore.New(client, "tokens"),
+			Firestore: client,
+			close:     client.Close,
+		}, nil
+	case localStorage:
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("could not create storage directory: %w", err)
+		}
+		db, err := buntdb.Open(filepath.Join(dir, "magic-island.db"))
+		if err != nil {
+			return nil, fmt.Errorf("could not open local storage: %w", err)
+		}
+		// the token store opens its own database
+		tokens, err := store.NewFileTokenStore(filepath.Join(dir, "tokens.db"))
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("could not open local token storage: %w", err)
+		}
+		return &Storage{
+			Storer:   NewLocalStorer(db),
+			Users:    NewLocalUserStore(db),
+			Tokens:   tokens,
+			Sessions: bstore.NewManagerStore(db),
+			close:    db.Close,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown storage driver %s", driver)
+}
+
+// Close releases the storage.
+func (s *Storage) Close() error {
+	return s.close()
+}
+
+// LoadUsers adds the users of the JSON file at path to users, or replaces
+// them. Whether users are at home is kept. It returns the number of users
+// loaded.
+func LoadUsers(ctx context.Context, users UserStore, path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var loaded []User
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return 0, fmt.Errorf("invalid users file %s: %w", path, err)
+	}
+
+	for i, user := range loaded {
+		if user.Username == "" {
+			return i, fmt.Errorf("user %d of %s has no username", i, path)
+		}
+		user.ID = user.Username
+		if current, err := users.GetUser(ctx, user.ID); err == nil {
+			user.Home = current.Home
+		} else if err != errUserNotFound {
+			return i, err
+		}
+		if err := users.PutUser(ctx, user); err != nil {
+			return i, err
+		}
+	}
+
+	return len(loaded), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenLocalStorage(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenStorage(ctx, localStorage, "", dir)
+	assert.Nil(t, err)
+	assert.Nil(t, storage.Firestore)
+	assert.NotNil(t, storage.Sessions)
+	assert.Nil(t, storage.Storer.PutDetector("zone-0", "1 Voordeur", "On"))
+	assert.Nil(t, storage.Close())
+
+	// data outlives restarts
+	storage, err = OpenStorage(ctx, localStorage, "", dir)
+	assert.Nil(t, err)
+	defer storage.Close()
+	d, err := storage.Storer.GetDetector("zone-0")
+	assert.Nil(t, err)
+	assert.Equal(t, "On", d.Status)
+
+	_, err = OpenStorage(ctx, firestoreStorage, "", dir)
+	assert.EqualError(t, err, "firestore storage needs a firestore project")
+}
+
+func TestLoadUsers(t *testing.T) {
+	users := NewLocalUserStore(newTestDB(t))
+	path := filepath.Join(t.TempDir(), "users.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`[
+		{"username": "alice", "password": "hash", "panelUser": 3},
+		{"username": "bob", "password": "hash", "admin": true}
+	]`), 0600))
+
+	loaded, err := LoadUsers(ctx, users, path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, loaded)
+
+	// loading again keeps whether users are at home
+	assert.Nil(t, users.SetUserHome(ctx, "alice", false))
+	_, err = LoadUsers(ctx, users, path)
+	assert.Nil(t, err)
+	user, err := users.GetUser(ctx, "alice")
+	assert.Nil(t, err)
+	assert.False(t, user.AtHome())
+	assert.Equal(t, "hash", user.Password)
+
+	assert.Nil(t, os.WriteFile(path, []byte(`[{"password": "hash"}]`), 0600))
+	_, err = LoadUsers(ctx, users, path)
+	assert.EqualError(t, err, "user 0 of "+path+" has no username")
+}
@@ -2,79 +2,593 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
 	"fmt"
 	"log"
+	"regexp"
+	"time"
 
 	"cloud.google.com/go/firestore"
 )
 
+// Detector is a zone of the panel. Detectors are keyed by the id of their
+// zone, which stays the same when the zone is renamed on the panel.
 type Detector struct {
-	Name   string `firestore:"name"`
-	Status string `firestore:"status"`
+	ID      string `json:"id" firestore:"id"`
+	Name    string `json:"name" firestore:"name"`
+	Status  string `json:"status" firestore:"status"`
+	Trouble bool   `json:"trouble" firestore:"trouble"`
+	// HistoryStatus and HistoryTrouble are those of the last transition
+	// appended to the history of the detector. HistoryStatus is empty
+	// until the first transition.
+	HistoryStatus  string `json:"historyStatus" firestore:"historyStatus"`
+	HistoryTrouble bool   `json:"historyTrouble" firestore:"historyTrouble"`
+}
+
+// detectorID returns the key of the detector of a zone. Zone ids are
+// unique on the panel and a zone can belong to several partitions at once,
+// so the partition is not part of the key: it would split one detector, and
+// move its history, whenever the partitions of the zone change.
+func detectorID(zone int64) string {
+	return fmt.Sprintf("zone-%d", zone)
+}
+
+// detectorIDPattern matches the keys returned by detectorID.
+var detectorIDPattern = regexp.MustCompile(`^zone-[0-9]+$`)
+
+// checkDetectorID returns an error unless id is a key returned by
+// detectorID. Detectors stored by name by earlier versions are never read,
+// so settings keyed by their name would silently be ignored.
+func checkDetectorID(id string) error {
+	if !detectorIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid detector %s, detectors are keyed by zone id such as zone-2", id)
+	}
+	return nil
+}
+
+// Event is an entry of the panel event log.
+type Event struct {
+	Time      time.Time `json:"time" firestore:"time"`
+	User      string    `json:"user" firestore:"user"`
+	Zone      string    `json:"zone" firestore:"zone"`
+	EventType string    `json:"type" firestore:"type"`
+}
+
+// EventCursor tracks how far the panel event log was read. NewerThan and
+// Offset are the position of the next page, Latest is the time of the
+// newest event stored so far.
+type EventCursor struct {
+	NewerThan time.Time `json:"newerThan" firestore:"newerThan"`
+	Offset    int       `json:"offset" firestore:"offset"`
+	Latest    time.Time `json:"latest" firestore:"latest"`
+}
+
+// AuditEntry records a change made to the panel through the API. Pass
+// codes are never part of it.
+type AuditEntry struct {
+	Time    time.Time `json:"time" firestore:"time"`
+	Actor   string    `json:"actor" firestore:"actor"`
+	Action  string    `json:"action" firestore:"action"`
+	Target  string    `json:"target" firestore:"target"`
+	Details string    `json:"details" firestore:"details"`
 }
 
 type Storer interface {
-	PutDetector(name, status string) error
-	GetDetector(name string) (*Detector, error)
+	PutDetector(id, name, status string) error
+	PutDetectorTrouble(id string, trouble bool) error
+	GetDetector(id string) (*Detector, error)
+	PutEvents(events []Event) error
+	GetEventCursor() (*EventCursor, error)
+	PutEventCursor(cursor *EventCursor) error
+	PutPanelState(state *PanelState) error
+	GetPanelState() (*PanelState, error)
+	PutAuditEntry(entry AuditEntry) error
+	GetPolicies() (map[string]NotificationPolicy, error)
+	PutPolicy(policy NotificationPolicy) error
+	DeletePolicy(detector string) error
+	PutDetectorHistory(transitions []DetectorTransition) error
+	GetDetectorHistory(id string, from, to time.Time) ([]DetectorTransition, error)
+	AcquireLease(name, holder string, now time.Time, ttl time.Duration) (bool, error)
+	ReleaseLease(name, holder string) error
+	GetLease(name string) (*Lease, error)
+	UpdateAlarm(update func(alarm *Alarm) bool) error
 }
 
+// detectorsRetry is the delay before the detectors or policies listener is
+// started again after it failed.
+const detectorsRetry = 10 * time.Second
+
 type storerImpl struct {
 	ctx       context.Context
 	client    *firestore.Client
-	detectors map[string]*Detector
+	detectors *detectorCache
+	policies  *policyCache
 }
 
+// NewStorer returns a storer whose caches of detectors and notification
+// policies follow the changes made by other instances until ctx is done.
 func NewStorer(ctx context.Context, client *firestore.Client) Storer {
-	return &storerImpl{
+	s := &storerImpl{
 		ctx:       ctx,
 		client:    client,
-		detectors: make(map[string]*Detector),
+		detectors: newDetectorCache(),
+		policies:  newPolicyCache(),
+	}
+	go s.watchDetectors()
+	go s.watchPolicies()
+
+	return s
+}
+
+// watchDetectors keeps the cache of detectors up to date with the
+// detectors collection until the context of the storer is done. While the
+// listener is down, detectors are read from firestore.
+func (s *storerImpl) watchDetectors() {
+	for {
+		it := s.client.Collection("detectors").Snapshots(s.ctx)
+		err := s.applyDetectorSnapshots(it)
+		it.Stop()
+		if s.ctx.Err() != nil {
+			return
+		}
+		log.Printf("Detectors listener failed, retrying in %v: %v", detectorsRetry, err)
+		s.detectors.reset()
+		if !sleep(s.ctx, detectorsRetry) {
+			return
+		}
+	}
+}
+
+// applyDetectorSnapshots caches the changes of the snapshots returned by it
+// until it fails.
+func (s *storerImpl) applyDetectorSnapshots(it *firestore.QuerySnapshotIterator) error {
+	for {
+		snapshot, err := it.Next()
+		if err != nil {
+			return err
+		}
+		for _, change := range snapshot.Changes {
+			if change.Kind == firestore.DocumentRemoved {
+				s.detectors.remove(change.Doc.Ref.ID, snapshot.ReadTime)
+				continue
+			}
+			var detector Detector
+			if err := change.Doc.DataTo(&detector); err != nil {
+				log.Printf("Could not read detector %s from listener: %v", change.Doc.Ref.ID, err)
+				continue
+			}
+			detector.ID = change.Doc.Ref.ID
+			s.detectors.put(detector, change.Doc.UpdateTime)
+		}
+	}
+}
+
+// watchPolicies keeps the cache of notification policies up to date with
+// the policies collection until the context of the storer is done. While the
+// listener is down, the last policies it delivered are kept.
+func (s *storerImpl) watchPolicies() {
+	for {
+		it := s.client.Collection("policies").Snapshots(s.ctx)
+		err := s.applyPolicySnapshots(it)
+		it.Stop()
+		if s.ctx.Err() != nil {
+			return
+		}
+		log.Printf("Policies listener failed, retrying in %v: %v", detectorsRetry, err)
+		if !sleep(s.ctx, detectorsRetry) {
+			return
+		}
+	}
+}
+
+// applyPolicySnapshots caches the policies of the snapshots returned by it
+// until it fails.
+func (s *storerImpl) applyPolicySnapshots(it *firestore.QuerySnapshotIterator) error {
+	for {
+		snapshot, err := it.Next()
+		if err != nil {
+			return err
+		}
+		docs, err := snapshot.Documents.GetAll()
+		if err != nil {
+			return err
+		}
+		policies, err := policiesOf(docs)
+		if err != nil {
+			return err
+		}
+		s.policies.replace(policies, snapshot.ReadTime)
 	}
 }
 
-// PutDetector adds or updates a detector with the given name and id
-// to the firestore, returning the key of the newly created entity.
-func (s *storerImpl) PutDetector(name, status string) error {
-	if name == "" {
-		return fmt.Errorf("Name cannot be empty (name: %v, status: %v)", name, status)
+// PutDetector adds or updates the detector with the given id, keeping its
+// name up to date with the panel.
+func (s *storerImpl) PutDetector(id, name, status string) error {
+	if id == "" {
+		return fmt.Errorf("ID cannot be empty (id: %v, name: %v, status: %v)", id, name, status)
 	}
 
 	detector := map[string]string{
+		"id":     id,
 		"name":   name,
 		"status": status,
 	}
 
-	_, err := s.client.Collection("detectors").Doc(name).Set(s.ctx, detector, firestore.MergeAll)
+	result, err := s.client.Collection("detectors").Doc(id).Set(s.ctx, detector, firestore.MergeAll)
+	if err != nil {
+		return err
+	}
+
+	cached := s.detectors.update(id, result.UpdateTime, func(d *Detector) {
+		d.Name = name
+		d.Status = status
+	})
+	if !cached {
+		s.detectors.put(Detector{ID: id, Name: name, Status: status}, result.UpdateTime)
+	}
+
+	return nil
+}
+
+// PutDetectorTrouble sets whether the detector with the given id is
+// reporting a trouble condition, keeping its status.
+func (s *storerImpl) PutDetectorTrouble(id string, trouble bool) error {
+	if id == "" {
+		return fmt.Errorf("ID cannot be empty (id: %v, trouble: %v)", id, trouble)
+	}
+
+	detector := map[string]interface{}{
+		"id":      id,
+		"trouble": trouble,
+	}
+
+	result, err := s.client.Collection("detectors").Doc(id).Set(s.ctx, detector, firestore.MergeAll)
+	if err != nil {
+		return err
+	}
+
+	s.detectors.update(id, result.UpdateTime, func(d *Detector) {
+		d.Trouble = trouble
+	})
+
+	return nil
+}
+
+// GetDetector returns a copy of the detector with the given id, read from
+// firestore when it is not cached.
+func (s *storerImpl) GetDetector(id string) (*Detector, error) {
+	if id == "" {
+		return nil, fmt.Errorf("Cannot get detector with empty id")
+	}
+
+	if d, ok := s.detectors.get(id); ok {
+		return d, nil
+	}
 
-	if err == nil {
-		s.detectors[name] = &Detector{
-			Name:   name,
-			Status: status,
+	var detector Detector
+	log.Println("Detector not cached, going to firestore...")
+	dsnap, err := s.client.Collection("detectors").Doc(id).Get(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := dsnap.DataTo(&detector); err != nil {
+		return nil, err
+	}
+	detector.ID = id
+	s.detectors.put(detector, dsnap.UpdateTime)
+
+	return &detector, nil
+}
+
+// PutEvents stores the given events in the events collection. Events are
+// keyed by their contents, so storing the same event twice keeps one copy.
+func (s *storerImpl) PutEvents(events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	batch := s.client.Batch()
+	seen := make(map[string]bool)
+	for _, event := range events {
+		id := eventID(event)
+		if seen[id] {
+			continue
 		}
+		seen[id] = true
+		batch.Set(s.client.Collection("events").Doc(id), event)
 	}
+	_, err := batch.Commit(s.ctx)
 
 	return err
 }
 
-func (s *storerImpl) GetDetector(name string) (d *Detector, err error) {
-	if name == "" {
-		return nil, fmt.Errorf("Cannot get detector with empty name")
+// GetEventCursor returns the stored event log cursor, or nil if the event
+// log was never read.
+func (s *storerImpl) GetEventCursor() (*EventCursor, error) {
+	dsnap, err := s.client.Collection("cursors").Doc("events").Get(s.ctx)
+	if dsnap != nil && !dsnap.Exists() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	d, ok := s.detectors[name]
-	if !ok {
-		var detector Detector
-		log.Println("Detector not cached, going to firestore...")
-		dsnap, err := s.client.Collection("detectors").Doc(name).Get(s.ctx)
-		if err != nil {
+	var cursor EventCursor
+	if err := dsnap.DataTo(&cursor); err != nil {
+		return nil, err
+	}
+
+	return &cursor, nil
+}
+
+func (s *storerImpl) PutEventCursor(cursor *EventCursor) error {
+	_, err := s.client.Collection("cursors").Doc("events").Set(s.ctx, cursor)
+
+	return err
+}
+
+func eventID(event Event) string {
+	key := fmt.Sprintf("%v|%v|%v|%v", event.Time.UTC().Format(time.RFC3339Nano), event.EventType, event.User, event.Zone)
+
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key)))
+}
+
+// PutPanelState replaces the stored state of the panel.
+func (s *storerImpl) PutPanelState(state *PanelState) error {
+	_, err := s.client.Collection("panel").Doc("state").Set(s.ctx, state)
+
+	return err
+}
+
+func (s *storerImpl) GetPanelState() (*PanelState, error) {
+	dsnap, err := s.client.Collection("panel").Doc("state").Get(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var state PanelState
+	if err := dsnap.DataTo(&state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// PutAuditEntry appends an entry to the audit log.
+func (s *storerImpl) PutAuditEntry(entry AuditEntry) error {
+	_, _, err := s.client.Collection("audit").Add(s.ctx, entry)
+
+	return err
+}
+
+// GetPolicies returns the notification policies keyed by detector, as
+// followed by the policies listener. Until the listener delivered them, they
+// are read from firestore.
+func (s *storerImpl) GetPolicies() (map[string]NotificationPolicy, error) {
+	if policies, ok := s.policies.get(); ok {
+		return policies, nil
+	}
+
+	docs, err := s.client.Collection("policies").Documents(s.ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	return policiesOf(docs)
+}
+
+// policiesOf returns the policies of docs keyed by detector.
+func policiesOf(docs []*firestore.DocumentSnapshot) (map[string]NotificationPolicy, error) {
+	policies := make(map[string]NotificationPolicy, len(docs))
+	for _, doc := range docs {
+		var policy NotificationPolicy
+		if err := doc.DataTo(&policy); err != nil {
 			return nil, err
 		}
-		if err := dsnap.DataTo(&detector); err != nil {
+		policies[policy.Detector] = policy
+	}
+
+	return policies, nil
+}
+
+// PutPolicy replaces the notification policy of a detector.
+func (s *storerImpl) PutPolicy(policy NotificationPolicy) error {
+	if policy.Detector == "" {
+		return fmt.Errorf("Detector cannot be empty (policy: %+v)", policy)
+	}
+
+	result, err := s.client.Collection("policies").Doc(policy.Detector).Set(s.ctx, policy)
+	if err != nil {
+		return err
+	}
+	s.policies.put(policy, result.UpdateTime)
+
+	return nil
+}
+
+// DeletePolicy removes the notification policy of a detector, which is
+// then informational in every armed state.
+func (s *storerImpl) DeletePolicy(detector string) error {
+	result, err := s.client.Collection("policies").Doc(detector).Delete(s.ctx)
+	if err != nil {
+		return err
+	}
+	s.policies.remove(detector, result.UpdateTime)
+
+	return nil
+}
+
+// PutDetectorHistory appends transitions to the history of their detectors,
+// kept in the history collection of each detector, and stores them as the
+// last transition of their detector.
+func (s *storerImpl) PutDetectorHistory(transitions []DetectorTransition) error {
+	if len(transitions) == 0 {
+		return nil
+	}
+
+	batch := s.client.Batch()
+	for _, transition := range transitions {
+		if transition.Detector == "" {
+			return fmt.Errorf("Detector cannot be empty (transition: %+v)", transition)
+		}
+		ref := s.client.Collection("detectors").Doc(transition.Detector)
+		batch.Create(ref.Collection("history").NewDoc(), transition)
+		batch.Set(ref, map[string]interface{}{
+			"historyStatus":  transition.Status,
+			"historyTrouble": transition.Trouble,
+		}, firestore.MergeAll)
+	}
+	results, err := batch.Commit(s.ctx)
+	if err != nil {
+		return err
+	}
+
+	// detectors not cached yet are read with their history fields
+	for i, transition := range transitions {
+		transition := transition
+		s.detectors.update(transition.Detector, results[2*i+1].UpdateTime, func(d *Detector) {
+			d.HistoryStatus = transition.Status
+			d.HistoryTrouble = transition.Trouble
+		})
+	}
+
+	return nil
+}
+
+// GetDetectorHistory returns the transitions of a detector from from up to
+// to, excluded, oldest first. At most maxHistory transitions are returned.
+func (s *storerImpl) GetDetectorHistory(id string, from, to time.Time) ([]DetectorTransition, error) {
+	if id == "" {
+		return nil, fmt.Errorf("Cannot get history of detector with empty id")
+	}
+
+	docs, err := s.client.Collection("detectors").Doc(id).Collection("history").
+		Where("time", ">=", from).
+		Where("time", "<", to).
+		OrderBy("time", firestore.Asc).
+		Limit(maxHistory).
+		Documents(s.ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	transitions := make([]DetectorTransition, 0, len(docs))
+	for _, doc := range docs {
+		var transition DetectorTransition
+		if err := doc.DataTo(&transition); err != nil {
 			return nil, err
 		}
-		d = &detector
-		s.detectors[name] = d
+		transitions = append(transitions, transition)
+	}
+
+	return transitions, nil
+}
+
+// AcquireLease gives the lease name to holder for ttl from now when it is
+// free, expired or already held by holder. It tells whether holder holds
+// the lease. Concurrent calls are serialized by a transaction, so a lease
+// has one holder at a time.
+func (s *storerImpl) AcquireLease(name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	if name == "" || holder == "" {
+		return false, fmt.Errorf("Name and holder cannot be empty (name: %v, holder: %v)", name, holder)
 	}
 
-	return
+	acquired := false
+	ref := s.client.Collection("leases").Doc(name)
+	err := s.client.RunTransaction(s.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		acquired = false
+		// a missing lease is returned as a snapshot that does not exist
+		docs, err := tx.GetAll([]*firestore.DocumentRef{ref})
+		if err != nil {
+			return err
+		}
+		lease := Lease{Holder: holder, AcquiredAt: now}
+		if docs[0].Exists() {
+			var current Lease
+			if err := docs[0].DataTo(&current); err != nil {
+				return err
+			}
+			if current.Holder != holder && now.Before(current.ExpiresAt) {
+				return nil
+			}
+			if current.Holder == holder {
+				lease.AcquiredAt = current.AcquiredAt
+			}
+		}
+		lease.ExpiresAt = now.Add(ttl)
+		acquired = true
+
+		return tx.Set(ref, lease)
+	})
+
+	return acquired, err
+}
+
+// ReleaseLease frees the lease name when it is held by holder, so another
+// holder can acquire it without waiting for it to expire.
+func (s *storerImpl) ReleaseLease(name, holder string) error {
+	ref := s.client.Collection("leases").Doc(name)
+	return s.client.RunTransaction(s.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docs, err := tx.GetAll([]*firestore.DocumentRef{ref})
+		if err != nil {
+			return err
+		}
+		if !docs[0].Exists() {
+			return nil
+		}
+		var lease Lease
+		if err := docs[0].DataTo(&lease); err != nil {
+			return err
+		}
+		if lease.Holder != holder {
+			return nil
+		}
+
+		return tx.Delete(ref)
+	})
+}
+
+// GetLease returns the lease name, or nil if it is not held.
+func (s *storerImpl) GetLease(name string) (*Lease, error) {
+	dsnap, err := s.client.Collection("leases").Doc(name).Get(s.ctx)
+	if dsnap != nil && !dsnap.Exists() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lease Lease
+	if err := dsnap.DataTo(&lease); err != nil {
+		return nil, err
+	}
+
+	return &lease, nil
+}
+
+// UpdateAlarm changes the stored alarm with update, which tells whether it
+// changed it. A missing alarm is given as the zero Alarm. The alarm is read
+// and written in a transaction, so an acknowledgement sent to any instance
+// is not overwritten by the instance polling the panel. update is called
+// again when the alarm changed concurrently.
+func (s *storerImpl) UpdateAlarm(update func(alarm *Alarm) bool) error {
+	ref := s.client.Collection("panel").Doc("alarm")
+	return s.client.RunTransaction(s.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// a missing alarm is returned as a snapshot that does not exist
+		docs, err := tx.GetAll([]*firestore.DocumentRef{ref})
+		if err != nil {
+			return err
+		}
+		var alarm Alarm
+		if docs[0].Exists() {
+			if err := docs[0].DataTo(&alarm); err != nil {
+				return err
+			}
+		}
+		if !update(&alarm) {
+			return nil
+		}
+
+		return tx.Set(ref, alarm)
+	})
 }
@@ -5,37 +5,44 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 )
 
 var tests = []struct {
+	id     string
 	name   string
 	status string
 	putErr string
 	getErr string
 }{
 	{
-		name:   "1-Voordeur",
+		id:     "zone-0",
+		name:   "1 Voordeur",
 		status: "On",
 	},
 	{
+		id:     "zone-1",
 		name:   "2 Balkondeur",
 		status: "Off",
 	},
 	{
-		name:   "3-Woonkamer-Pir",
+		id:     "zone-2",
+		name:   "3 Woonkamer Pir",
 		status: "",
 	},
 	{
-		name:   "",
+		id:     "",
+		name:   "1 Voordeur",
 		status: "Off",
-		putErr: "Name cannot be empty (name: , status: Off)",
-		getErr: "Cannot get detector with empty name",
+		putErr: "ID cannot be empty (id: , name: 1 Voordeur, status: Off)",
+		getErr: "Cannot get detector with empty id",
 	},
 	{
+		id:     "",
 		name:   "",
 		status: "",
-		putErr: "Name cannot be empty (name: , status: )",
-		getErr: "Cannot get detector with empty name",
+		putErr: "ID cannot be empty (id: , name: , status: )",
+		getErr: "Cannot get detector with empty id",
 	},
 }
 
@@ -50,21 +57,24 @@ func TestPutDetector(t *testing.T) {
 
 	for _, test := range tests {
 
-		if err := storer.PutDetector(test.name, test.status); err != nil {
+		if err := storer.PutDetector(test.id, test.name, test.status); err != nil {
 			if test.putErr != fmt.Sprintf("%v", err) {
-				t.Errorf("unexpected error: got (%v) when putting detector (%v) with status (%v). Maybe it should be (%v)", err, test.name, test.status, test.putErr)
+				t.Errorf("unexpected error: got (%v) when putting detector (%v) with status (%v). Maybe it should be (%v)", err, test.id, test.status, test.putErr)
 			}
 		}
 
 		// Here we also test GetDetector in order to validate cache works
-		if d, err := storer.GetDetector(test.name); err != nil {
+		if d, err := storer.GetDetector(test.id); err != nil {
 			if test.getErr != fmt.Sprintf("%v", err) {
-				t.Errorf("unexpected error: got (%v) when getting detector (%v) with status (%v). Maybe it should be (%v)", err, test.name, test.status, test.getErr)
+				t.Errorf("unexpected error: got (%v) when getting detector (%v) with status (%v). Maybe it should be (%v)", err, test.id, test.status, test.getErr)
 			}
 		} else {
 			if d.Status != test.status {
 				t.Errorf("unexpected status: got (%v) want (%v)", d.Status, test.status)
 			}
+			if d.Name != test.name {
+				t.Errorf("unexpected name: got (%v) want (%v)", d.Name, test.name)
+			}
 		}
 	}
 }
@@ -80,14 +90,384 @@ func TestGetDetector(t *testing.T) {
 
 	for _, test := range tests {
 
-		if d, err := storer.GetDetector(test.name); err != nil {
+		if d, err := storer.GetDetector(test.id); err != nil {
 			if test.getErr != fmt.Sprintf("%v", err) {
-				t.Errorf("unexpected error: got (%v) when getting detector (%v) with status (%v). Maybe it should be (%v)", err, test.name, test.status, test.getErr)
+				t.Errorf("unexpected error: got (%v) when getting detector (%v) with status (%v). Maybe it should be (%v)", err, test.id, test.status, test.getErr)
 			}
 		} else {
 			if d.Status != test.status {
 				t.Errorf("unexpected status: got (%v) want (%v)", d.Status, test.status)
 			}
+			if d.Name != test.name {
+				t.Errorf("unexpected name: got (%v) want (%v)", d.Name, test.name)
+			}
+		}
+	}
+}
+
+func TestEventCursor(t *testing.T) {
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not create firestore client: %v", err)
+	}
+
+	storer := NewStorer(ctx, client)
+
+	cursor := &EventCursor{
+		NewerThan: time.Date(2019, 8, 1, 22, 30, 0, 0, time.UTC),
+		Offset:    100,
+		Latest:    time.Date(2019, 8, 2, 8, 2, 5, 0, time.UTC),
+	}
+	if err := storer.PutEventCursor(cursor); err != nil {
+		t.Fatalf("unexpected error putting cursor: %v", err)
+	}
+
+	got, err := storer.GetEventCursor()
+	if err != nil {
+		t.Fatalf("unexpected error getting cursor: %v", err)
+	}
+	if !got.NewerThan.Equal(cursor.NewerThan) || got.Offset != cursor.Offset || !got.Latest.Equal(cursor.Latest) {
+		t.Errorf("unexpected cursor: got (%v) want (%v)", got, cursor)
+	}
+
+	events := []Event{
+		{Time: cursor.Latest, User: "Gebruiker 00", EventType: "AwayArm"},
+		{Time: cursor.Latest, User: "Gebruiker 00", EventType: "AwayArm"},
+	}
+	if err := storer.PutEvents(events); err != nil {
+		t.Fatalf("unexpected error putting events: %v", err)
+	}
+}
+
+func TestPanelState(t *testing.T) {
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not create firestore client: %v", err)
+	}
+
+	storer := NewStorer(ctx, client)
+
+	state := &PanelState{
+		UpdatedAt:    time.Date(2019, 7, 28, 0, 20, 48, 0, time.UTC),
+		SystemStatus: "Disarmed",
+		SystemReady:  true,
+		Partitions: []PartitionState{
+			{ID: 0, ArmedState: "Disarm", Zones: []ZoneState{{ID: 0, Name: "1 Voordeur", Status: "Off"}}},
+		},
+		Users: []UserState{{ID: 0, Name: "Gebruiker 00", Type: "GRAND_08", Partitions: []int{0}}},
+	}
+	if err := storer.PutPanelState(state); err != nil {
+		t.Fatalf("unexpected error putting panel state: %v", err)
+	}
+
+	got, err := storer.GetPanelState()
+	if err != nil {
+		t.Fatalf("unexpected error getting panel state: %v", err)
+	}
+	if got.SystemStatus != state.SystemStatus || len(got.Partitions) != 1 || got.Partitions[0].Zones[0].Name != "1 Voordeur" || got.Users[0].Type != "GRAND_08" {
+		t.Errorf("unexpected panel state: got (%+v) want (%+v)", got, state)
+	}
+}
+
+func TestPutDetectorTrouble(t *testing.T) {
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not create firestore client: %v", err)
+	}
+
+	storer := NewStorer(ctx, client)
+
+	if err := storer.PutDetector("zone-3", "4 Hal Rook", "Off"); err != nil {
+		t.Fatalf("unexpected error putting detector: %v", err)
+	}
+	if err := storer.PutDetectorTrouble("zone-3", true); err != nil {
+		t.Fatalf("unexpected error putting detector trouble: %v", err)
+	}
+
+	// a new storer reads the detector from firestore instead of the cache
+	for _, s := range []Storer{storer, NewStorer(ctx, client)} {
+		d, err := s.GetDetector("zone-3")
+		if err != nil {
+			t.Fatalf("unexpected error getting detector: %v", err)
+		}
+		if d.Status != "Off" || !d.Trouble {
+			t.Errorf("unexpected detector: got (%+v) want status (Off) and trouble (true)", d)
+		}
+	}
+
+	if err := storer.PutDetectorTrouble("", true); err == nil || err.Error() != "ID cannot be empty (id: , trouble: true)" {
+		t.Errorf("unexpected error: got (%v) when putting trouble for detector with empty id", err)
+	}
+}
+
+func TestPutAuditEntry(t *testing.T) {
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not create firestore client: %v", err)
+	}
+
+	storer := NewStorer(ctx, client)
+
+	entry := AuditEntry{
+		Time:    time.Date(2019, 8, 2, 10, 0, 0, 0, time.UTC),
+		Actor:   "vitorarins",
+		Action:  "assign-user-code",
+		Target:  "user 3",
+		Details: "name Schoonmaker, type GRAND_08, partitions 0",
+	}
+	if err := storer.PutAuditEntry(entry); err != nil {
+		t.Fatalf("unexpected error putting audit entry: %v", err)
+	}
+
+	docs, err := client.Collection("audit").Where("target", "==", "user 3").Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("unexpected error getting audit entries: %v", err)
+	}
+	if len(docs) == 0 {
+		t.Fatalf("audit entry for user 3 was not stored")
+	}
+	var got AuditEntry
+	if err := docs[len(docs)-1].DataTo(&got); err != nil {
+		t.Fatalf("unexpected error reading audit entry: %v", err)
+	}
+	if got.Actor != entry.Actor || got.Action != entry.Action || !got.Time.Equal(entry.Time) {
+		t.Errorf("unexpected audit entry: got (%+v) want (%+v)", got, entry)
+	}
+}
+
+func TestFirestoreUserStorePutUser(t *testing.T) {
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not create firestore client: %v", err)
+	}
+
+	users := NewFirestoreUserStore(client)
+
+	ref := client.Collection("users").Doc("oppas")
+	if _, err := ref.Set(ctx, map[string]interface{}{"username": "oppas", "email": "oppas@example.com", "panelUser": 3}); err != nil {
+		t.Fatalf("unexpected error setting user by hand: %v", err)
+	}
+	if err := users.PutUser(ctx, User{ID: "oppas", Username: "oppas", Password: "hash"}); err != nil {
+		t.Fatalf("unexpected error putting user: %v", err)
+	}
+
+	doc, err := ref.Get(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting user: %v", err)
+	}
+	data := doc.Data()
+	if data["email"] != "oppas@example.com" {
+		t.Errorf("unexpected email: got (%v) want (oppas@example.com), fields set by hand must be kept", data["email"])
+	}
+	if data["password"] != "hash" {
+		t.Errorf("unexpected password: got (%v) want (hash)", data["password"])
+	}
+	if _, ok := data["panelUser"]; ok {
+		t.Errorf("unexpected panel user: got (%v) want none", data["panelUser"])
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := firestore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not create firestore client: %v", err)
+	}
+
+	storer := NewStorer(ctx, client)
+	// the instance polling the panel, which follows policies changed by others
+	poller := NewStorer(ctx, client)
+	if _, err := poller.GetPolicies(); err != nil {
+		t.Fatalf("unexpected error getting policies: %v", err)
+	}
+
+	policy := NotificationPolicy{Detector: "1-Voordeur", Disarmed: silentLevel, Armed: intrusionLevel}
+	if err := storer.PutPolicy(policy); err != nil {
+		t.Fatalf("unexpected error putting policy: %v", err)
+	}
+	waitForPolicies(t, poller, func(policies map[string]NotificationPolicy) bool {
+		return policies["1-Voordeur"] == policy
+	})
+
+	if err := storer.DeletePolicy("1-Voordeur"); err != nil {
+		t.Fatalf("unexpected error deleting policy: %v", err)
+	}
+	policies, err := storer.GetPolicies()
+	if err != nil {
+		t.Fatalf("unexpected error getting policies: %v", err)
+	}
+	if _, ok := policies["1-Voordeur"]; ok {
+		t.Errorf("unexpected policy after delete: %+v", policies["1-Voordeur"])
+	}
+	waitForPolicies(t, poller, func(policies map[string]NotificationPolicy) bool {
+		_, ok := policies["1-Voordeur"]
+		return !ok
+	})
+
+	if err := storer.PutPolicy(NotificationPolicy{}); err == nil {
+		t.Errorf("unexpected success putting policy without detector")
+	}
+}
+
+// waitForPolicies waits for the policies of storer to satisfy done.
+func waitForPolicies(t *testing.T, storer Storer, done func(map[string]NotificationPolicy) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		policies, err := storer.GetPolicies()
+		if err == nil && done(policies) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("policies not updated by the listener: got (%+v, %v)", policies, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDetectorHistory(t *testing.T) {
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not create firestore client: %v", err)
+	}
+
+	storer := NewStorer(ctx, client)
+
+	start := time.Date(2019, 8, 2, 10, 0, 0, 0, time.UTC)
+	transitions := []DetectorTransition{
+		{Detector: "zone-5", Name: "6 Keukendeur", Time: start, Status: "On"},
+		{Detector: "zone-5", Name: "6 Keukendeur", Time: start.Add(time.Minute), Status: "Off"},
+		{Detector: "zone-5", Name: "6 Keukendeur", Time: start.Add(time.Hour), Status: "On"},
+	}
+	if err := storer.PutDetectorHistory(transitions); err != nil {
+		t.Fatalf("unexpected error putting detector history: %v", err)
+	}
+
+	got, err := storer.GetDetectorHistory("zone-5", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error getting detector history: %v", err)
+	}
+	if len(got) != 2 || got[0].Status != "On" || got[1].Status != "Off" || !got[1].Time.Equal(start.Add(time.Minute)) {
+		t.Errorf("unexpected detector history: got (%+v) want (%+v)", got, transitions[:2])
+	}
+
+	// the next leader compares with the last transition
+	detector, err := NewStorer(ctx, client).GetDetector("zone-5")
+	if err != nil {
+		t.Fatalf("unexpected error getting detector: %v", err)
+	}
+	if detector.HistoryStatus != "On" {
+		t.Errorf("unexpected last transition status: got (%v) want (On)", detector.HistoryStatus)
+	}
+}
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not create firestore client: %v", err)
+	}
+
+	storer := NewStorer(ctx, client)
+
+	now := time.Date(2019, 8, 2, 10, 0, 0, 0, time.UTC)
+	steps := []struct {
+		holder string
+		now    time.Time
+		want   bool
+	}{
+		{holder: "a", now: now, want: true},
+		{holder: "b", now: now.Add(5 * time.Second), want: false},
+		{holder: "a", now: now.Add(10 * time.Second), want: true},
+		{holder: "b", now: now.Add(20 * time.Second), want: false},
+		{holder: "b", now: now.Add(25 * time.Second), want: true},
+	}
+	for _, step := range steps {
+		held, err := storer.AcquireLease("test", step.holder, step.now, 15*time.Second)
+		if err != nil || held != step.want {
+			t.Errorf("unexpected lease for (%v) at (%v): got (%v, %v) want (%v, nil)", step.holder, step.now, held, err, step.want)
+		}
+	}
+
+	lease, err := storer.GetLease("test")
+	if err != nil || lease == nil || lease.Holder != "b" || !lease.ExpiresAt.Equal(now.Add(40*time.Second)) {
+		t.Errorf("unexpected lease: got (%+v, %v)", lease, err)
+	}
+
+	if err := storer.ReleaseLease("test", "a"); err != nil {
+		t.Fatalf("unexpected error releasing lease: %v", err)
+	}
+	if lease, _ := storer.GetLease("test"); lease == nil {
+		t.Errorf("unexpected release of a lease held by another holder")
+	}
+	if err := storer.ReleaseLease("test", "b"); err != nil {
+		t.Fatalf("unexpected error releasing lease: %v", err)
+	}
+	if lease, err := storer.GetLease("test"); lease != nil || err != nil {
+		t.Errorf("unexpected lease after release: got (%+v, %v)", lease, err)
+	}
+}
+
+func TestAlarm(t *testing.T) {
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not create firestore client: %v", err)
+	}
+
+	// the alarm is acknowledged through another instance than the leader
+	leader := NewEscalation(&fakeRequester{}, NewStorer(ctx, client), time.Minute, 3)
+	other := NewEscalation(&fakeRequester{}, NewStorer(ctx, client), time.Minute, 3)
+
+	leader.Update(ctx, false)
+	if acknowledged, err := other.Acknowledge(); acknowledged || err != nil {
+		t.Errorf("unexpected acknowledgement without alarm: got (%v, %v) want (false, nil)", acknowledged, err)
+	}
+	leader.Update(ctx, true)
+	if acknowledged, err := other.Acknowledge(); !acknowledged || err != nil {
+		t.Errorf("unexpected acknowledgement in alarm: got (%v, %v) want (true, nil)", acknowledged, err)
+	}
+
+	leader.Update(ctx, true)
+	if !leader.alarm.Acknowledged {
+		t.Errorf("unexpected alarm read by the leader: got (%+v)", leader.alarm)
+	}
+	leader.Update(ctx, false)
+}
+
+func TestDetectorsListener(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := firestore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not create firestore client: %v", err)
+	}
+
+	storer := NewStorer(ctx, client)
+	if err := storer.PutDetector("zone-8", "9 Zolder Pir", "Off"); err != nil {
+		t.Fatalf("unexpected error putting detector: %v", err)
+	}
+
+	// another instance reports the detector was activated
+	if err := NewStorer(ctx, client).PutDetector("zone-8", "9 Zolder Pir", "On"); err != nil {
+		t.Fatalf("unexpected error putting detector: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d, err := storer.GetDetector("zone-8")
+		if err == nil && d.Status == "On" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cached detector not updated by the listener: got (%+v, %v)", d, err)
 		}
+		time.Sleep(10 * time.Millisecond)
 	}
 }
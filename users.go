@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// errUserNotFound is returned for users that do not exist.
+	errUserNotFound = errors.New("user not found")
+	// errInvalidCredentials is returned when a username and password do
+	// not match, without telling which one is wrong.
+	errInvalidCredentials = errors.New("invalid username or password")
+)
+
+// User is a person logging in to the app. Users are keyed by their
+// username.
+type User struct {
+	ID       string `json:"-" firestore:"-"`
+	Username string `json:"username" firestore:"username"`
+	// Password is the bcrypt hash of the password of the user.
+	Password string `json:"password" firestore:"password"`
+	Admin    bool   `json:"admin" firestore:"admin"`
+	// Home is whether the user is at home, nil until they report it.
+	Home *bool `json:"home,omitempty" firestore:"home,omitempty"`
+	// PanelUser is the panel user slot commands of the user are sent
+	// with, nil to use the code of the app.
+	PanelUser *int64 `json:"panelUser,omitempty" firestore:"panelUser,omitempty"`
+}
+
+// AtHome tells whether the user is at home. Users that never reported it
+// are considered at home.
+func (u User) AtHome() bool {
+	return u.Home == nil || *u.Home
+}
+
+// UserStore keeps the users of the app.
+type UserStore interface {
+	GetUser(ctx context.Context, id string) (*User, error)
+	ListUsers(ctx context.Context) ([]User, error)
+	PutUser(ctx context.Context, user User) error
+	SetUserHome(ctx context.Context, id string, home bool) error
+	// CheckPassword returns the user when password is theirs, and
+	// errInvalidCredentials otherwise.
+	CheckPassword(ctx context.Context, username, password string) (*User, error)
+}
+
+// checkPassword compares password with the hash of a user read from a
+// store.
+func checkPassword(user *User, err error, password string) (*User, error) {
+	if err == errUserNotFound {
+		return nil, errInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return nil, errInvalidCredentials
+	}
+
+	return user, nil
+}
+
+type firestoreUserStore struct {
+	client *firestore.Client
+}
+
+// NewFirestoreUserStore returns a user store keeping users in the users
+// collection.
+func NewFirestoreUserStore(client *firestore.Client) UserStore {
+	return &firestoreUserStore{client: client}
+}
+
+func (s *firestoreUserStore) GetUser(ctx context.Context, id string) (*User, error) {
+	dsnap, err := s.client.Collection("users").Doc(id).Get(ctx)
+	if dsnap != nil && !dsnap.Exists() {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+	if err := dsnap.DataTo(&user); err != nil {
+		return nil, err
+	}
+	user.ID = id
+
+	return &user, nil
+}
+
+func (s *firestoreUserStore) ListUsers(ctx context.Context) ([]User, error) {
+	docs, err := s.client.Collection("users").Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]User, 0, len(docs))
+	for _, doc := range docs {
+		var user User
+		if err := doc.DataTo(&user); err != nil {
+			return nil, err
+		}
+		user.ID = doc.Ref.ID
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+// PutUser replaces the fields of the user document known to User. Other
+// fields of the document, such as those set by hand, are kept.
+func (s *firestoreUserStore) PutUser(ctx context.Context, user User) error {
+	if user.ID == "" {
+		return fmt.Errorf("ID cannot be empty (username: %v)", user.Username)
+	}
+
+	data := map[string]interface{}{
+		"username":  user.Username,
+		"password":  user.Password,
+		"admin":     user.Admin,
+		"home":      firestore.Delete,
+		"panelUser": firestore.Delete,
+	}
+	if user.Home != nil {
+		data["home"] = *user.Home
+	}
+	if user.PanelUser != nil {
+		data["panelUser"] = *user.PanelUser
+	}
+	_, err := s.client.Collection("users").Doc(user.ID).Set(ctx, data, firestore.MergeAll)
+
+	return err
+}
+
+// SetUserHome sets whether an existing user is at home.
+func (s *firestoreUserStore) SetUserHome(ctx context.Context, id string, home bool) error {
+	ref := s.client.Collection("users").Doc(id)
+
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snaps, err := tx.GetAll([]*firestore.DocumentRef{ref})
+		if err != nil {
+			return err
+		}
+		if !snaps[0].Exists() {
+			return errUserNotFound
+		}
+
+		return tx.Update(ref, []firestore.Update{{Path: "home", Value: home}})
+	})
+}
+
+func (s *firestoreUserStore) CheckPassword(ctx context.Context, username, password string) (*User, error) {
+	user, err := s.GetUser(ctx, username)
+
+	return checkPassword(user, err, password)
+}
+
+type memoryUserStore struct {
+	mu    sync.Mutex
+	users map[string]User
+}
+
+// NewMemoryUserStore returns a user store keeping users in memory, starting
+// with users.
+func NewMemoryUserStore(users ...User) UserStore {
+	s := &memoryUserStore{users: make(map[string]User)}
+	for _, user := range users {
+		s.users[user.ID] = user
+	}
+
+	return s
+}
+
+func (s *memoryUserStore) GetUser(ctx context.Context, id string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return nil, errUserNotFound
+	}
+
+	return &user, nil
+}
+
+// ListUsers returns the users sorted by id, like the other stores do.
+func (s *memoryUserStore) ListUsers(ctx context.Context) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	return users, nil
+}
+
+// PutUser replaces the user.
+func (s *memoryUserStore) PutUser(ctx context.Context, user User) error {
+	if user.ID == "" {
+		return fmt.Errorf("ID cannot be empty (username: %v)", user.Username)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[user.ID] = user
+
+	return nil
+}
+
+// SetUserHome sets whether an existing user is at home.
+func (s *memoryUserStore) SetUserHome(ctx context.Context, id string, home bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return errUserNotFound
+	}
+	user.Home = &home
+	s.users[id] = user
+
+	return nil
+}
+
+func (s *memoryUserStore) CheckPassword(ctx context.Context, username, password string) (*User, error) {
+	user, err := s.GetUser(ctx, username)
+
+	return checkPassword(user, err, password)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMemoryUserStore(t *testing.T) {
+	users := NewMemoryUserStore(User{ID: "bob", Username: "bob"})
+
+	_, err := users.GetUser(ctx, "alice")
+	assert.Equal(t, errUserNotFound, err)
+	assert.Equal(t, errUserNotFound, users.SetUserHome(ctx, "alice", false))
+	assert.EqualError(t, users.PutUser(ctx, User{Username: "alice"}), "ID cannot be empty (username: alice)")
+
+	assert.Nil(t, users.PutUser(ctx, User{ID: "alice", Username: "alice", Admin: true}))
+	assert.Nil(t, users.SetUserHome(ctx, "alice", false))
+
+	user, err := users.GetUser(ctx, "alice")
+	assert.Nil(t, err)
+	assert.True(t, user.Admin)
+	assert.False(t, user.AtHome())
+
+	list, err := users.ListUsers(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"alice", "bob"}, []string{list[0].ID, list[1].ID})
+	assert.True(t, list[1].AtHome())
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("test"), bcrypt.MinCost)
+	assert.Nil(t, err)
+	users := NewMemoryUserStore(User{ID: "alice", Username: "alice", Password: string(hash)})
+
+	user, err := users.CheckPassword(ctx, "alice", "test")
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", user.ID)
+
+	_, err = users.CheckPassword(ctx, "alice", "wrong")
+	assert.Equal(t, errInvalidCredentials, err)
+	_, err = users.CheckPassword(ctx, "bob", "test")
+	assert.Equal(t, errInvalidCredentials, err, "unknown users look like wrong passwords")
+}